@@ -0,0 +1,68 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"sync/atomic"
+)
+
+// Buffered returns the number of bytes received on all channels of the stream
+// that have not yet been read by the application.
+func (m *MultiplexedStream) Buffered() int {
+	return int(atomic.LoadInt64(&m.buffered))
+}
+
+// Whether the stream is buffering more unread data than it is allowed to.
+func (m *MultiplexedStream) overBudget() bool {
+	return m.config.maxBuffered > 0 && atomic.LoadInt64(&m.buffered) >= int64(m.config.maxBuffered)
+}
+
+// Withhold window from a channel until the stream is back under budget.
+func (m *MultiplexedStream) starve(c *Channel) {
+	m.starveLock.Lock()
+	m.starved[c] = struct{}{}
+	m.starveLock.Unlock()
+}
+
+// Grant window to starved channels if the stream is back under budget.
+func (m *MultiplexedStream) relieve() {
+	if m.overBudget() {
+		return
+	}
+	m.starveLock.Lock()
+	if len(m.starved) == 0 {
+		m.starveLock.Unlock()
+		return
+	}
+	starved := m.starved
+	m.starved = make(map[*Channel]struct{})
+	m.starveLock.Unlock()
+
+	for c := range starved {
+		c.updateWindow(0)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// Size of the CRC-32C that follows each packet when checksums are enabled. It
+// covers the header and payload as sent.
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(hdr, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(hdr, castagnoli), castagnoli, payload)
+}
+
+// Drop a packet that failed its checksum, resetting the channel it claims to
+// belong to, if any (see WithChecksumRecovery). The header may be what was
+// corrupted, in which case the wrong channel may be reset, or the stream may
+// fail later.
+func (m *MultiplexedStream) dropCorrupt(id uint32) {
+	atomic.AddUint64(&m.corrupt, 1)
+	m.log(levelWarn, "corrupt packet dropped", "channel_id", id)
+	ch, ok := m.channels.get(id)
+	if !ok {
+		return
+	}
+	ch.lock.Lock()
+	if ch.remote {
+		ch.lock.Unlock()
+		return
+	}
+	// Marked remote so that killing it doesn't block the reader, and the
+	// RST is sent as a reply instead.
+	ch.remote = true
+	atomic.StoreUint32(&ch.aborted, 1)
+	ch.pending = nil
+	ch.lock.Unlock()
+
+	ch.discard()
+	ch.kill(ErrChecksum)
+	m.reply(&packet{id: id, flags: RST | ABORT})
+}
+
+// CorruptPackets returns the number of packets received that failed their
+// checksum and were dropped (see WithChecksumRecovery).
+func (m *MultiplexedStream) CorruptPackets() uint64 {
+	return atomic.LoadUint64(&m.corrupt)
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Flips a bit of the first write containing marker, as an unreliable link
+// might.
+type corruptingWriter struct {
+	io.WriteCloser
+	marker []byte
+	once   sync.Once
+}
+
+func (c *corruptingWriter) Write(b []byte) (int, error) {
+	if i := bytes.Index(b, c.marker); i >= 0 {
+		c.once.Do(func() {
+			b = append([]byte(nil), b...)
+			b[i] ^= 1
+		})
+	}
+	return c.WriteCloser.Write(b)
+}
+
+func newCorruptedServerAndClient(marker string, options ...Option) (s *MultiplexedStream, c *MultiplexedStream) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	s = MultiplexedServer(&rwc{r: sr, w: sw}, options...)
+	c = MultiplexedClient(&rwc{r: cr, w: &corruptingWriter{WriteCloser: cw, marker: []byte(marker)}}, options...)
+	return
+}
+
+func TestChecksums(t *testing.T) {
+	sm, cm := newServerAndClient(WithChecksums())
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	data := bytes.Repeat([]byte("checksummed"), FragmentSize)
+	go c.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(s, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func TestChecksumsMismatch(t *testing.T) {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	server := MultiplexedServer(&rwc{r: sr, w: sw}, WithChecksums())
+	defer server.Close()
+
+	go sendHandshake(cw)
+	waitFor(t, func() bool { return server.Err() != nil })
+	assert.True(t, errors.Is(server.Err(), ErrChecksumsMismatch), "%s", server.Err())
+	assert.Equal(t, "checksums mismatch: we use checksums, peer doesn't", server.Err().Error())
+}
+
+func TestChecksumCorrupted(t *testing.T) {
+	sm, cm := newCorruptedServerAndClient("corrupt me", WithChecksums())
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("corrupt me"))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrChecksum), "%s", sm.Err())
+}
+
+func TestChecksumRecovery(t *testing.T) {
+	sm, cm := newCorruptedServerAndClient("corrupt me", WithChecksumRecovery())
+	defer sm.Close()
+	defer cm.Close()
+
+	c1, err := cm.Dial()
+	assert.NoError(t, err)
+	s1, err := sm.Accept()
+	assert.NoError(t, err)
+	c2, err := cm.Dial()
+	assert.NoError(t, err)
+	s2, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// The corrupted channel is reset at both ends.
+	_, err = c1.Write([]byte("corrupt me"))
+	assert.NoError(t, err)
+	_, err = s1.Read(make([]byte, 10))
+	assert.True(t, errors.Is(err, ErrChecksum), "%s", err)
+	waitFor(t, func() bool {
+		_, err := c1.Write([]byte("hello"))
+		return errors.Is(err, ErrChannelReset)
+	})
+	assert.Equal(t, uint64(1), sm.CorruptPackets())
+
+	// Other channels, and the stream, are unaffected.
+	go c2.Write([]byte("hello"))
+	received := make([]byte, 5)
+	_, err = io.ReadFull(s2, received)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(received))
+	assert.NoError(t, sm.Err())
+}
+
+func benchmarkChecksums(b *testing.B, options ...Option) {
+	sm, cm := newServerAndClient(options...)
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+
+	buf := make([]byte, FragmentSize)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	_, err = io.ReadFull(s, make([]byte, len(buf)*b.N))
+	assert.NoError(b, err)
+}
+
+func BenchmarkWithoutChecksums(b *testing.B) {
+	benchmarkChecksums(b)
+}
+
+func BenchmarkWithChecksums(b *testing.B) {
+	benchmarkChecksums(b, WithChecksums())
+}
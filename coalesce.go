@@ -0,0 +1,185 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"time"
+)
+
+// How long coalesced writes are held for when SetNoDelay(false) is used
+// without SetWriteCoalescing.
+const defaultCoalesceDelay = time.Millisecond
+
+// SetWriteCoalescing buffers small writes to the channel, so that they are
+// sent to the peer in fewer, larger packets.
+//
+// Written data is held until at least size bytes are buffered, or until delay
+// has passed since the first byte was buffered, whichever comes first; a delay
+// of zero or less means a millisecond. Flush sends buffered data immediately.
+// Writes still block while the peer's receive window is exhausted, and count
+// as complete once buffered.
+//
+// A size of zero or less disables coalescing, which is the default, and
+// flushes any buffered data. Otherwise this is equivalent to SetNoDelay(false)
+// with the given size and delay.
+func (c *Channel) SetWriteCoalescing(size int, delay time.Duration) {
+	c.lock.Lock()
+	c.coalesceSize = size
+	c.coalesceDelay = delay
+	c.lock.Unlock()
+	c.SetNoDelay(size <= 0)
+}
+
+// SetNoDelay controls whether writes are sent immediately, which is the
+// default, or may be coalesced into fewer packets. Like TCP_NODELAY, it can be
+// switched at any time, eg. for the interactive and bulk phases of a protocol.
+//
+// With noDelay false, writes are held as configured by SetWriteCoalescing, or
+// if it has not been called until a full packet has accumulated or a
+// millisecond has passed. Flush can be used to send them sooner, eg. at the
+// end of a request. Setting noDelay to true flushes anything held.
+func (c *Channel) SetNoDelay(noDelay bool) {
+	c.lock.Lock()
+	c.coalescing = !noDelay
+	c.lock.Unlock()
+	if noDelay {
+		c.Flush()
+	}
+}
+
+// Flush sends any data buffered by write coalescing to the peer. Like Write,
+// it fails once the channel has, or if buffered data could not be sent.
+func (c *Channel) Flush() error {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+	c.lock.Lock()
+	pending := c.takePending()
+	flushErr := c.takeFlushErr()
+	c.lock.Unlock()
+	if err := c.sendPending(pending); err != nil {
+		return err
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+	return c.err()
+}
+
+// Flush once the coalescing delay has passed. Nobody is waiting for the
+// result, so a failure is kept for the next Write or Flush.
+func (c *Channel) flushLater() {
+	if err := c.Flush(); err != nil {
+		c.lock.Lock()
+		if c.flushErr == nil {
+			c.flushErr = err
+		}
+		c.lock.Unlock()
+	}
+}
+
+// Must be called with the lock held.
+func (c *Channel) takeFlushErr() error {
+	err := c.flushErr
+	c.flushErr = nil
+	return err
+}
+
+func (c *Channel) isCoalescing() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.coalescing
+}
+
+// Buffer written data, sending it once enough has accumulated. An error is
+// returned if that, or an earlier flush by the timer, failed.
+func (c *Channel) coalesce(b []byte) error {
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+	c.lock.Lock()
+	if err := c.takeFlushErr(); err != nil {
+		c.lock.Unlock()
+		c.grow(uint32(len(b)))
+		return err
+	}
+	c.pending = append(c.pending, b...)
+	size, delay := c.coalesceSize, c.coalesceDelay
+	if size <= 0 {
+		size = int(c.m.MaxFrameSize())
+	}
+	if delay <= 0 {
+		delay = defaultCoalesceDelay
+	}
+	var pending []byte
+	if len(c.pending) >= size {
+		pending = c.takePending()
+	} else if c.flushTimer == nil {
+		c.flushTimer = c.m.config.clock.AfterFunc(delay, c.flushLater)
+	}
+	c.lock.Unlock()
+	return c.sendPending(pending)
+}
+
+// Must be called with the lock held.
+func (c *Channel) takePending() []byte {
+	pending := c.pending
+	c.pending = nil
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	return pending
+}
+
+// Send buffered data, split into packets no larger than the peer accepts. The
+// writes it came from have already completed, so unlike Write this ignores
+// deadlines.
+func (c *Channel) sendPending(b []byte) error {
+	var vetoed error
+	max := int(c.m.MaxFrameSize())
+	for len(b) > 0 {
+		l := len(b)
+		if l > max {
+			l = max
+		}
+		p := &packet{id: c.id, payload: b[:l], ch: c}
+		b = b[l:]
+		// Only the vetoed packet is dropped, returning its window.
+		if err := c.m.hook(Outbound, p); err != nil {
+			c.grow(uint32(l))
+			if vetoed == nil {
+				vetoed = err
+			}
+			continue
+		}
+		select {
+		case c.out <- p:
+		case <-c.tomb.Dying():
+			return c.err()
+		}
+	}
+	return vetoed
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestWriteCoalescing(t *testing.T) {
+	cr, _ := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	close(w.release)
+	cm := MultiplexedClient(&rwc{r: cr, w: w}, WithAsyncDial())
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	c.SetWriteCoalescing(100, time.Hour)
+
+	// Full packets are sent as soon as they accumulate.
+	for i := 0; i < 25; i++ {
+		_, err = c.Write([]byte("0123456789"))
+		assert.NoError(t, err)
+	}
+	waitFor(t, func() bool { return len(w.dataPackets()) == 2 })
+	time.Sleep(time.Millisecond * 10)
+	assert.Equal(t, 2, len(w.dataPackets()))
+
+	// The remainder is held until flushed.
+	assert.NoError(t, c.Flush())
+	waitFor(t, func() bool { return len(w.dataPackets()) == 3 })
+	var sizes []uint32
+	for _, hdr := range w.headers() {
+		if hdr.Type == typeData && hdr.Length > 0 {
+			sizes = append(sizes, hdr.Length)
+		}
+	}
+	assert.Equal(t, []uint32{100, 100, 50}, sizes)
+}
+
+func TestWriteCoalescingDelay(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	c.SetWriteCoalescing(4096, time.Millisecond*10)
+	_, err = c.Write([]byte("PI"))
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("NG"))
+	assert.NoError(t, err)
+
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+}
+
+func TestWriteCoalescingClose(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	c.SetWriteCoalescing(4096, time.Hour)
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(s)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+}
+
+func TestWriteCoalescingFlushFails(t *testing.T) {
+	errVeto := errors.New("veto")
+	var veto int32
+	hook := WithFrameHook(func(d Direction, f FrameInfo) error {
+		if d == Outbound && f.Type == FrameData && f.Length > 0 && atomic.LoadInt32(&veto) != 0 {
+			return errVeto
+		}
+		return nil
+	})
+	clock := newFakeClock()
+	sm, cm := newServerAndClient(hook, WithClock(clock))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	c.SetWriteCoalescing(8, time.Second)
+	atomic.StoreInt32(&veto, 1)
+
+	// Write fails when a full packet can't be sent.
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("PONG"))
+	assert.Equal(t, errVeto, err)
+
+	// A failure to flush after the delay is returned by the next Write.
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	advanceUntil(t, clock, func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.flushErr != nil
+	})
+	_, err = c.Write([]byte("PONG"))
+	assert.Equal(t, errVeto, err)
+
+	// Or Flush.
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	advanceUntil(t, clock, func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.flushErr != nil
+	})
+	assert.Equal(t, errVeto, c.Flush())
+
+	// Once reported, the channel carries on.
+	atomic.StoreInt32(&veto, 0)
+	_, err = c.Write([]byte("DONE"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Flush())
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "DONE", string(b))
+}
+
+func TestChannelNoDelay(t *testing.T) {
+	cr, _ := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	close(w.release)
+	cm := MultiplexedClient(&rwc{r: cr, w: w}, WithAsyncDial())
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+
+	// Writes are sent immediately by default.
+	for i := 0; i < 3; i++ {
+		_, err = c.Write([]byte("PING"))
+		assert.NoError(t, err)
+	}
+	waitFor(t, func() bool { return len(w.dataPackets()) == 3 })
+
+	// Then held until the delay passes.
+	c.SetNoDelay(false)
+	_, err = c.Write([]byte("BULK"))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(w.dataPackets()) == 4 })
+
+	// Or until explicitly flushed.
+	c.SetWriteCoalescing(4096, time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err = c.Write([]byte("BULK"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, c.Flush())
+	waitFor(t, func() bool { return len(w.dataPackets()) == 5 })
+
+	// Switching back flushes anything held.
+	_, err = c.Write([]byte("BULK"))
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 10)
+	assert.Equal(t, 5, len(w.dataPackets()))
+	c.SetNoDelay(true)
+	waitFor(t, func() bool { return len(w.dataPackets()) == 6 })
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(w.dataPackets()) == 7 })
+
+	var sizes []uint32
+	for _, hdr := range w.headers() {
+		if hdr.Type == typeData && hdr.Length > 0 {
+			sizes = append(sizes, hdr.Length)
+		}
+	}
+	assert.Equal(t, []uint32{4, 4, 4, 4, 12, 4, 4}, sizes)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// A transport that counts writes.
+type countingWriter struct {
+	io.WriteCloser
+	writes int64
+	bytes  int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	n, err := c.WriteCloser.Write(b)
+	atomic.AddInt64(&c.bytes, int64(n))
+	return n, err
+}
+
+func benchmarkSmallWrites(b *testing.B, coalesce int) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	w := &countingWriter{WriteCloser: cw}
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	cm := MultiplexedClient(&rwc{r: cr, w: w})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	c.SetWriteCoalescing(coalesce, time.Millisecond)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+	done := make(chan struct{})
+	go func() {
+		io.CopyN(ioutil.Discard, s, int64(b.N*16))
+		close(done)
+	}()
+
+	buf := make([]byte, 16)
+	start := atomic.LoadInt64(&w.writes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	c.Flush()
+	<-done
+	b.ReportMetric(float64(atomic.LoadInt64(&w.writes)-start)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSmallWrites(b *testing.B) {
+	benchmarkSmallWrites(b, 0)
+}
+
+func BenchmarkSmallWritesCoalesced(b *testing.B) {
+	benchmarkSmallWrites(b, FragmentSize)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// MaxCodecNameLength is the longest name a codec can be registered with (see
+// WithCodec).
+const MaxCodecNameLength = 16
+
+// ErrUnknownCodec is returned by Dial when WithChannelCompression names a codec
+// that hasn't been registered with WithCodec.
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// A Codec compresses the data sent in one direction of a channel (see
+// WithChannelCompression). Each channel has a Codec that compresses the data
+// it sends, one packet payload at a time in the order they are sent, and
+// another that decompresses the data it receives, in the same order. Codecs
+// may therefore keep state, such as a dictionary, between payloads.
+//
+// A Codec is only used by one goroutine at a time.
+type Codec interface {
+	// Compress appends the compressed form of src to dst. The result must be
+	// at most len(src)/64 + 64 bytes larger than src.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the data src was compressed from to dst, failing
+	// if it is more than max bytes.
+	Decompress(dst, src []byte, max int) ([]byte, error)
+}
+
+// CodecFlate is the name of the built in codec, which compresses with DEFLATE
+// (RFC 1951).
+const CodecFlate = "flate"
+
+type flateCodec struct {
+	compressor   *compressor
+	decompressor *decompressor
+}
+
+func newFlateCodec() Codec {
+	return &flateCodec{}
+}
+
+func (f *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	// Created on first use, as only the end that writes needs one.
+	if f.compressor == nil {
+		f.compressor = newCompressor()
+	}
+	b, err := f.compressor.compress(src)
+	return append(dst, b...), err
+}
+
+func (f *flateCodec) Decompress(dst, src []byte, max int) ([]byte, error) {
+	if f.decompressor == nil {
+		f.decompressor = newDecompressor()
+	}
+	return f.decompressor.decompress(dst, src, max)
+}
+
+// WithChannelCompression asks the peer to compress the channel's data, in
+// both directions, with the named codec, which must have been registered with
+// WithCodec unless it is CodecFlate. The peer declines if it doesn't have the
+// codec, or doesn't support FeatureChannelCompression, in which case the
+// channel is opened uncompressed. See Channel.Codec.
+//
+// Each channel compresses its data separately, so that data on one channel
+// doesn't affect the compression of another.
+func WithChannelCompression(codec string) DialOption {
+	return func(c *dialConfig) {
+		c.codec = codec
+	}
+}
+
+// Codec returns the name of the codec compressing the channel's data, or ""
+// if it isn't compressed. Until the peer accepts the codec, this is "" for
+// channels opened with DialAsync.
+func (c *Channel) Codec() string {
+	if atomic.LoadUint32(&c.compressing) == 0 {
+		return ""
+	}
+	return c.codec
+}
+
+// Set up ch to compress its data with the named codec, returning false if it
+// isn't registered.
+func (m *MultiplexedStream) useCodec(ch *Channel, name string) bool {
+	newCodec, ok := m.config.codecs[name]
+	if !ok {
+		return false
+	}
+	ch.codec = name
+	ch.encoder = newCodec()
+	ch.decoder = newCodec()
+	return true
+}
+
+// Decompress the payload of a data packet compressed by the peer's codec into
+// a pooled buffer.
+func (c *Channel) decompress(p *packet) error {
+	if c.decoder == nil {
+		return errors.New("compressed data without a codec")
+	}
+	max := int(c.m.config.maxRecvSize)
+	buf := getBuffer(max)
+	payload, err := c.decoder.Decompress((*buf)[:0], p.payload, max)
+	if err == nil && len(payload) > max {
+		err = errors.New("decompressed payload too large")
+	}
+	if err != nil {
+		putBuffer(buf)
+		return err
+	}
+	putBuffer(p.buf)
+	p.buf, p.payload = pooled(buf, payload)
+	return nil
+}
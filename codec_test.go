@@ -0,0 +1,154 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestChannelCompression(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	counter := &countingWriter{WriteCloser: cw}
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	cm := MultiplexedClient(&rwc{r: cr, w: counter})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial(WithChannelCompression(CodecFlate))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, CodecFlate, c.Codec())
+	assert.Equal(t, CodecFlate, s.Codec())
+
+	// Other channels are unaffected.
+	plain, err := cm.Dial()
+	assert.NoError(t, err)
+	assert.Equal(t, "", plain.Codec())
+
+	data := []byte(strings.Repeat(`{"level":"info","msg":"hello world"}`, 1000))
+	before := atomic.LoadInt64(&counter.bytes)
+	go c.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(s, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+	sent := atomic.LoadInt64(&counter.bytes) - before
+	assert.True(t, sent < int64(len(data))/4, "%d bytes sent", sent)
+
+	// And in the other direction.
+	go s.Write(data)
+	_, err = io.ReadFull(c, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func TestChannelCompressionDeclined(t *testing.T) {
+	for _, server := range [][]Option{
+		{WithoutFeatures(FeatureChannelCompression)},
+		{},
+	} {
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		sm := MultiplexedServer(&rwc{r: sr, w: sw}, server...)
+		cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithCodec("reverse", newReverseCodec))
+
+		// Either the peer can't compress channels, or doesn't have the codec.
+		c, err := cm.Dial(WithChannelCompression("reverse"))
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, "", c.Codec())
+		assert.Equal(t, "", s.Codec())
+
+		go c.Write([]byte("hello"))
+		b := make([]byte, 5)
+		_, err = io.ReadFull(s, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		sm.Close()
+		cm.Close()
+	}
+}
+
+func TestChannelCompressionUnknownCodec(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	_, err := cm.Dial(WithChannelCompression("snappy"))
+	assert.Equal(t, ErrUnknownCodec, err)
+}
+
+// Reverses each payload, which is enough to tell whether it was used.
+type reverseCodec struct{ calls *int64 }
+
+var reverseCalls int64
+
+func newReverseCodec() Codec { return reverseCodec{calls: &reverseCalls} }
+
+func (r reverseCodec) Compress(dst, src []byte) ([]byte, error) {
+	atomic.AddInt64(r.calls, 1)
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return dst, nil
+}
+
+func (r reverseCodec) Decompress(dst, src []byte, max int) ([]byte, error) {
+	if len(src) > max {
+		return dst, io.ErrShortBuffer
+	}
+	return r.Compress(dst, src)
+}
+
+func TestCustomCodec(t *testing.T) {
+	sm, cm := newServerAndClient(WithCodec("reverse", newReverseCodec))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial(WithChannelCompression("reverse"))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, "reverse", s.Codec())
+
+	atomic.StoreInt64(&reverseCalls, 0)
+	go c.Write([]byte("hello"))
+	b := &bytes.Buffer{}
+	_, err = io.CopyN(b, s, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", b.String())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&reverseCalls))
+}
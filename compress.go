@@ -0,0 +1,149 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Compression is an algorithm used to compress data sent on a stream (see
+// WithCompression).
+type Compression uint8
+
+const (
+	// CompressionNone sends data as is. This is the default.
+	CompressionNone Compression = iota
+	// CompressionFlate compresses data with DEFLATE (RFC 1951).
+	CompressionFlate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// How far back compressed data may refer to data sent earlier.
+const flateWindow = 1 << 15
+
+// The largest a payload of n bytes may grow when compressed. DEFLATE falls
+// back to stored blocks of up to 64KB, with 5 bytes of overhead each, and
+// each payload ends with a 5 byte empty block that aligns it to a byte, so
+// is well within this.
+func compressedSize(n uint32) uint32 {
+	return n + n/64 + 64
+}
+
+// The largest frame size whose payloads still fit in a header once compressed
+// twice, by a channel's codec and by the stream.
+const maxCompressibleFrameSize = (maxPayloadSize - 2*64) * 64 / 65 * 64 / 65
+
+// Whether a packet's payload is compressed by the stream. Only data is, so that
+// channels can be opened and closed without involving the compressor.
+func isCompressed(typ uint8, flags uint16, length int) bool {
+	return typ == typeData && flags&(SYN|RST) == 0 && length > 0
+}
+
+// Compresses the payloads of data packets as a single DEFLATE stream, so that
+// each payload may refer back to data in earlier ones. Only used by the
+// writer.
+type compressor struct {
+	w   *flate.Writer
+	out bytes.Buffer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	c.w, _ = flate.NewWriter(&c.out, flate.DefaultCompression)
+	return c
+}
+
+// Compress b, returning a slice that is valid until the next call. Each
+// payload is flushed, so it can be decompressed as soon as it is received.
+func (c *compressor) compress(b []byte) ([]byte, error) {
+	c.out.Reset()
+	if _, err := c.w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.out.Bytes(), nil
+}
+
+// Decompresses the payloads written by the peer's compressor. Each payload
+// ends at a block boundary, so the decoder is restarted for each one with the
+// data decompressed so far as its dictionary. Only used by the reader.
+type decompressor struct {
+	r       io.ReadCloser
+	src     bytes.Reader
+	history []byte // The last flateWindow bytes of decompressed data.
+}
+
+func newDecompressor() *decompressor {
+	return &decompressor{r: flate.NewReader(nil)}
+}
+
+// Decompress src, which must decompress to no more than max bytes, appending
+// the data to dst. If dst has room for max more bytes it isn't reallocated.
+func (d *decompressor) decompress(dst, src []byte, max int) ([]byte, error) {
+	d.src.Reset(src)
+	if err := d.r.(flate.Resetter).Reset(&d.src, d.history); err != nil {
+		return dst, err
+	}
+	start := len(dst)
+	if cap(dst)-start < max {
+		dst = append(dst, make([]byte, max)...)[:start]
+	}
+	out := dst[start : start+max]
+	n, err := io.ReadFull(d.r, out)
+	switch err {
+	case io.ErrUnexpectedEOF:
+		// The end of the payload, which doesn't end the stream.
+	case nil:
+		var extra [1]byte
+		if more, _ := d.r.Read(extra[:]); more > 0 {
+			return dst, fmt.Errorf("decompressed payload larger than %d bytes", max)
+		}
+	default:
+		return dst, err
+	}
+
+	d.history = append(d.history, out[:n]...)
+	if over := len(d.history) - flateWindow; over > 0 {
+		copy(d.history, d.history[over:])
+		d.history = d.history[:flateWindow]
+	}
+	return dst[:start+n], nil
+}
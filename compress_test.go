@@ -0,0 +1,126 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	counter := &countingWriter{WriteCloser: cw}
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithCompression(CompressionFlate))
+	cm := MultiplexedClient(&rwc{r: cr, w: counter}, WithCompression(CompressionFlate))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Spans several packets, which refer back to earlier ones.
+	data := []byte(strings.Repeat(`{"level":"info","msg":"hello world"}`, 1000))
+	go func() {
+		c.Write(data)
+		c.Close()
+	}()
+	b := &bytes.Buffer{}
+	_, err = b.ReadFrom(s)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b.Bytes())
+	sent := atomic.LoadInt64(&counter.bytes)
+	assert.True(t, sent < int64(len(data))/4, "%d bytes sent", sent)
+}
+
+func TestCompressionIncompressible(t *testing.T) {
+	sm, cm := newServerAndClient(WithCompression(CompressionFlate), WithMaxFrameSize(FragmentSize*70))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Random frames grow when compressed, but are still accepted.
+	data := make([]byte, FragmentSize*200)
+	rand.Read(data)
+	go c.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(s, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func TestCompressionMismatch(t *testing.T) {
+	// Each end fails on the other's handshake, before any packet is read.
+	for _, test := range []struct {
+		compression Compression
+		handshake   string
+		err         string
+	}{
+		{CompressionFlate, handshakeMagic + "\x00\x03\x00\x00", "compression mismatch: peer uses none, we use flate"},
+		{CompressionNone, handshakeMagic + "\x00\x03\x01\x00", "compression mismatch: peer uses flate, we use none"},
+		{CompressionFlate, handshakeMagic + "\x00\x03\x09\x00", "compression mismatch: peer uses compression(9), we use flate"},
+	} {
+		sr, cw := io.Pipe()
+		cr, sw := io.Pipe()
+		go io.Copy(ioutil.Discard, cr)
+		sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithCompression(test.compression))
+		go func() {
+			io.WriteString(cw, test.handshake)
+			writeFrame(cw, typeData, SYN, 1, nil)
+		}()
+		_, err := sm.Accept()
+		assert.True(t, errors.Is(err, ErrCompressionMismatch), "%s", err)
+		assert.Equal(t, test.err, sm.Err().Error())
+		sm.Close()
+	}
+
+	// Ends that agree are unaffected.
+	sm, cm := newServerAndClient(WithCompression(CompressionFlate))
+	defer sm.Close()
+	defer cm.Close()
+	_, err := cm.Dial()
+	assert.NoError(t, err)
+}
+
+func TestCompressionString(t *testing.T) {
+	assert.Equal(t, "flate", CompressionFlate.String())
+	assert.Equal(t, "compression(7)", Compression(7).String())
+}
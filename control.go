@@ -0,0 +1,125 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Kinds of control packet counted by ControlStats and limited by
+// WithControlRateLimit.
+const (
+	controlOpen = iota
+	controlReset
+	controlWindowUpdate
+	controlPing
+	controlSettings
+	controlGoAway
+	numControlKinds
+)
+
+var controlNames = [numControlKinds]string{"open", "reset", "window update", "ping", "settings", "go away"}
+
+// By default, peers may send up to this many control packets of each kind a
+// second, other than opens and resets.
+const defaultControlRate = 50000
+
+// ControlStats counts the control packets received from the peer, by kind.
+type ControlStats struct {
+	Opens         uint64 // Data packets with SYN.
+	Resets        uint64 // Data packets with RST.
+	WindowUpdates uint64
+	Pings         uint64 // Including replies to our pings.
+	Settings      uint64
+	GoAways       uint64
+}
+
+// ControlStats returns the number of control packets received from the peer
+// so far, by kind.
+func (m *MultiplexedStream) ControlStats() ControlStats {
+	return ControlStats{
+		Opens:         atomic.LoadUint64(&m.controls[controlOpen]),
+		Resets:        atomic.LoadUint64(&m.controls[controlReset]),
+		WindowUpdates: atomic.LoadUint64(&m.controls[controlWindowUpdate]),
+		Pings:         atomic.LoadUint64(&m.controls[controlPing]),
+		Settings:      atomic.LoadUint64(&m.controls[controlSettings]),
+		GoAways:       atomic.LoadUint64(&m.controls[controlGoAway]),
+	}
+}
+
+// The kind of control packet p is, if any.
+func controlKind(p *packet) (int, bool) {
+	switch p.typ {
+	case typeData:
+		switch {
+		case p.flags&SYN != 0:
+			return controlOpen, true
+		case p.flags&RST != 0:
+			return controlReset, true
+		}
+	case typeWindowUpdate:
+		return controlWindowUpdate, true
+	case typePing:
+		return controlPing, true
+	case typeSettings:
+		return controlSettings, true
+	case typeGoAway:
+		return controlGoAway, true
+	}
+	return 0, false
+}
+
+// Count a control packet from the peer, failing if the peer has sent more of
+// its kind than WithControlRateLimit allows. Each kind has a bucket of a
+// second's worth of packets, refilled at the limit, so that a steady rate up
+// to the limit is always allowed. Only called by the reader.
+func (m *MultiplexedStream) countControl(p *packet) error {
+	kind, ok := controlKind(p)
+	if !ok {
+		return nil
+	}
+	atomic.AddUint64(&m.controls[kind], 1)
+	limit := m.config.controlRate
+	if limit <= 0 {
+		return nil
+	}
+	// Opening channels is already limited by WithOpenRateLimit and
+	// WithMaxChannels, and each reset closes one.
+	if (kind == controlOpen || kind == controlReset) && !m.config.limitOpens {
+		return nil
+	}
+	bucket := m.controlRates[kind]
+	if bucket == nil {
+		bucket = newTokenBucket(m.config.clock, float64(limit), limit)
+		m.controlRates[kind] = bucket
+	}
+	if !bucket.Allow() {
+		return fmt.Errorf("%w: control flood: more than %d %s packets in a second", ErrProtocol, limit, controlNames[kind])
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestControlStats(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+	_, err = cm.Ping(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, c.Reset())
+	waitFor(t, func() bool { return sm.ControlStats().Resets == 1 })
+
+	assert.Equal(t, ControlStats{Opens: 1, Resets: 1, Pings: 1, Settings: 1}, sm.ControlStats())
+	// Including the reply to its ping.
+	assert.Equal(t, ControlStats{Pings: 1, Settings: 1}, cm.ControlStats())
+}
+
+func TestControlFlood(t *testing.T) {
+	for _, test := range []struct {
+		typ   uint8
+		flags uint8
+		err   string
+	}{
+		{typePing, 0, "protocol error: control flood: more than 100 ping packets in a second"},
+		{typeWindowUpdate, 0, "protocol error: control flood: more than 100 window update packets in a second"},
+		{typeData, RST, "protocol error: control flood: more than 100 reset packets in a second"},
+	} {
+		clock := newFakeClock()
+		sr, cw := io.Pipe()
+		cr, sw := io.Pipe()
+		go io.Copy(ioutil.Discard, cr)
+		sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithControlRateLimit(100), WithClock(clock))
+
+		payload := make([]byte, 4)
+		if test.typ == typePing {
+			payload = make([]byte, 8)
+		}
+		assert.NoError(t, sendHandshake(cw))
+		// Up to the limit each second is allowed.
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, writeFrame(cw, test.typ, test.flags, 1, payload))
+		}
+		clock.Advance(time.Second)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, writeFrame(cw, test.typ, test.flags, 1, payload))
+		}
+		assert.NoError(t, sm.Err())
+
+		go writeFrame(cw, test.typ, test.flags, 1, payload)
+		waitFor(t, func() bool { return sm.Err() != nil })
+		assert.True(t, errors.Is(sm.Err(), ErrProtocol))
+		assert.Equal(t, test.err, sm.Err().Error())
+		sm.Close()
+	}
+}
+
+func TestControlFloodAcrossSeconds(t *testing.T) {
+	// A steady rate up to the limit is allowed, but a burst can't be doubled
+	// by straddling the end of a second.
+	clock := newFakeClock()
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithControlRateLimit(100), WithClock(clock))
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, writeFrame(cw, typePing, 0, 0, make([]byte, 8)))
+		clock.Advance(time.Second / 100)
+	}
+	assert.NoError(t, sm.Err())
+
+	clock.Advance(time.Second - time.Millisecond)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, writeFrame(cw, typePing, 0, 0, make([]byte, 8)))
+	}
+	clock.Advance(time.Millisecond)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if writeFrame(cw, typePing, 0, 0, make([]byte, 8)) != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol))
+}
+
+func TestControlRateDefaultOpens(t *testing.T) {
+	// By default, opens and resets are left to the limits on channels.
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	for i := 0; i < defaultControlRate+1; i++ {
+		assert.NoError(t, writeFrame(cw, typeData, RST, uint32(i*2+1), nil))
+	}
+	waitFor(t, func() bool { return sm.ControlStats().Resets == defaultControlRate+1 })
+	assert.NoError(t, sm.Err())
+}
+
+func TestControlRateUnlimited(t *testing.T) {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithControlRateLimit(0))
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	for i := 0; i < defaultControlRate+1; i++ {
+		assert.NoError(t, writeFrame(cw, typePing, 0, 0, make([]byte, 8)))
+	}
+	waitFor(t, func() bool { return sm.ControlStats().Pings == defaultControlRate+1 })
+	assert.NoError(t, sm.Err())
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"io"
+)
+
+var _ io.ReaderFrom = &Channel{}
+
+// ReadFrom writes data read from r to the channel until r returns io.EOF or
+// an error, which is returned unless it is io.EOF.
+//
+// Data is read straight into packet buffers of up to the maximum frame size,
+// rather than through an intermediate buffer as with Write. As with Write,
+// this blocks while the peer's receive window is exhausted, and the window
+// is reserved before reading from r.
+func (c *Channel) ReadFrom(r io.Reader) (int64, error) {
+	if err := useMode(&c.writeMode, modeStream); err != nil {
+		return 0, err
+	}
+	// Keep data already held by write coalescing ahead of ours.
+	c.Flush()
+	var n int64
+	for {
+		l, err := c.reserve(int(c.m.MaxFrameSize()))
+		if err != nil {
+			return n, err
+		}
+		buf := getBuffer(l)
+		read, rerr := r.Read((*buf)[:l])
+		n += int64(read)
+		if read < l {
+			c.grow(uint32(l - read))
+		}
+		if read > 0 {
+			if err := c.send(newBufferPacket(c, buf, read)); err != nil {
+				return n, err
+			}
+		} else {
+			putBuffer(buf)
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+var _ io.WriterTo = &Channel{}
+
+// WriteTo writes data received on the channel to w until the peer closes
+// the channel, returning the number of bytes written. Received frames are
+// written straight to w, without an intermediate buffer as with Read.
+//
+// Reaching the end of the channel is not an error, but the errors Read
+// returns when it is reset, or when the stream fails, are returned as is.
+func (c *Channel) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for {
+		_, s, _, err := c.read(nil, readBorrow)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		b := s.bytes()
+		written, err := w.Write(b)
+		putBuffer(s.buf)
+		n += int64(written)
+		if err == nil && written < len(b) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Hides any io.WriterTo implementation, so that io.Copy uses ReadFrom.
+type onlyReader struct {
+	io.Reader
+}
+
+// Returns err once the underlying reader is exhausted.
+type failingReader struct {
+	io.Reader
+	err error
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	n, err := f.Reader.Read(b)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestChannelReadFrom(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	data := make([]byte, 4*1024*1024+17)
+	rand.Read(data)
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(s)
+		done <- b
+	}()
+
+	n, err := io.Copy(c, onlyReader{bytes.NewReader(data)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	c.Close()
+	assert.Equal(t, data, <-done)
+}
+
+func TestChannelReadFromError(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	go io.Copy(ioutil.Discard, s)
+
+	failure := errors.New("failed")
+	n, err := c.ReadFrom(&failingReader{bytes.NewReader(make([]byte, 3000)), failure})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, int64(3000), n)
+
+	// The channel is still usable.
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+}
+
+func benchmarkCopy(b *testing.B, readFrom bool) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+	go io.Copy(ioutil.Discard, s)
+
+	data := make([]byte, 64*1024)
+	r := bytes.NewReader(data)
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if readFrom {
+			_, err = c.ReadFrom(r)
+		} else {
+			// What io.Copy does without ReaderFrom.
+			_, err = io.CopyBuffer(struct{ io.Writer }{c}, onlyReader{r}, buf)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChannelCopy(b *testing.B) {
+	benchmarkCopy(b, false)
+}
+
+func BenchmarkChannelReadFrom(b *testing.B) {
+	benchmarkCopy(b, true)
+}
+
+func TestChannelWriteTo(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	data := make([]byte, 1024*1024+17)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+		c.Close()
+	}()
+
+	out := &bytes.Buffer{}
+	n, err := io.Copy(struct{ io.Writer }{out}, s)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, out.Bytes())
+}
+
+func TestChannelWriteToReset(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return sm.Buffered() == 5 })
+	c.Reset()
+
+	_, err = s.WriteTo(ioutil.Discard)
+	assert.True(t, errors.Is(err, ErrChannelReset), "%s", err)
+}
+
+func benchmarkDrain(b *testing.B, writeTo bool) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+
+	data := make([]byte, 64*1024)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(data); err != nil {
+				return
+			}
+		}
+		c.Close()
+	}()
+	if writeTo {
+		_, err = s.WriteTo(ioutil.Discard)
+	} else {
+		// What io.Copy does without WriterTo.
+		_, err = io.CopyBuffer(struct{ io.Writer }{ioutil.Discard}, onlyReader{s}, make([]byte, 32*1024))
+	}
+	assert.NoError(b, err)
+}
+
+func BenchmarkChannelDrain(b *testing.B) {
+	benchmarkDrain(b, false)
+}
+
+func BenchmarkChannelWriteTo(b *testing.B) {
+	benchmarkDrain(b, true)
+}
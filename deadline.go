@@ -0,0 +1,107 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// errTimeout is returned by every blocking call when a deadline expires.
+//
+// It implements net.Error, and satisfies errors.Is(err,
+// os.ErrDeadlineExceeded), as the errors returned by net.Conn do.
+var errTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+var _ net.Error = timeoutError{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+func (timeoutError) Unwrap() error   { return os.ErrDeadlineExceeded }
+
+// deadline is a resettable deadline that can interrupt blocked operations.
+// The zero value has no deadline set.
+type deadline struct {
+	lock    sync.Mutex
+	timer   Timer
+	expired chan struct{} // Closed when the deadline passes, created on first use.
+}
+
+// set the deadline, as told by clock. A zero value for t clears the deadline.
+func (d *deadline) set(clock Clock, t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // Wait for the timer callback to finish closing.
+	}
+	d.timer = nil
+
+	closed := isClosed(d.expired)
+	if t.IsZero() {
+		if closed {
+			d.expired = nil
+		}
+		return
+	}
+
+	if closed || d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	dur := t.Sub(clock.Now())
+	if dur <= 0 {
+		close(d.expired)
+		return
+	}
+
+	expired := d.expired
+	d.timer = clock.AfterFunc(dur, func() { close(expired) })
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *deadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	return d.expired
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
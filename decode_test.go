@@ -0,0 +1,163 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Encode a packet as the peer would, including flags in the top byte of the
+// length, and with a length that may not match the payload.
+func rawFrame(typ uint8, flags uint16, id, length uint32, payload string) string {
+	hdr := header{Type: typ, Flags: uint8(flags), ID: id, Length: length | uint32(flags>>8)<<24}
+	var b [headerSize]byte
+	hdr.encode(b[:])
+	return string(b[:]) + payload
+}
+
+func frame(typ uint8, flags uint16, id uint32, payload string) string {
+	return rawFrame(typ, flags, id, uint32(len(payload)), payload)
+}
+
+func setting(id uint16, value uint32) string {
+	var b [settingSize]byte
+	binary.BigEndian.PutUint16(b[:], id)
+	binary.BigEndian.PutUint32(b[2:], value)
+	return string(b[:])
+}
+
+var validStream = handshakeMagic + "\x00\x03\x00\x00" +
+	frame(typeSettings, 0, 0, setting(settingMaxFrameSize, FragmentSize)+setting(settingChannelIDParity, 1)+setting(settingFeatures, uint32(allFeatures))) +
+	frame(typeData, SYN|SERVICE|META, 1, "\x03svcmetadata") +
+	frame(typeData, EOM, 1, "message") +
+	frame(typeWindowUpdate, 0, 1, "\x00\x00\x10\x00") +
+	frame(typePing, 0, 0, "12345678") +
+	frame(typeData, FIN, 1, "") +
+	frame(typeData, SYN, 3, "hello") +
+	frame(typeData, RST, 3, "\x00\x00\x00\x01reason") +
+	frame(typeGoAway, 0, 0, "\x00\x00\x00\x03") +
+	frame(0x42, 0, 0, "unknown")
+
+var malformedStreams = []struct {
+	name    string
+	stream  string
+	options []Option
+	err     string
+}{
+	{"Oversized", rawFrame(typeData, SYN, 1, maxPayloadSize, ""), nil,
+		"protocol error: packet of 16777215 bytes on channel 1 exceeds the maximum of 1024"},
+	{"DuplicateSYN", frame(typeData, SYN, 1, "") + frame(typeData, SYN, 1, ""), nil,
+		"protocol error: SYN for channel 1, which is already open"},
+	{"WrongParity", frame(typeSettings, 0, 0, setting(settingChannelIDParity, 1)) + frame(typeData, SYN, 2, ""), nil,
+		"protocol error: peer opened channel 2, which has our parity"},
+	{"UnknownFlags", frame(typeData, SYN|1<<12, 1, ""), nil,
+		"protocol error: unknown flags 0x1000 on channel 1"},
+	{"MetadataWithoutSYN", frame(typeData, SYN, 1, "") + frame(typeData, META, 1, "metadata"), nil,
+		"protocol error: metadata or service without SYN on channel 1"},
+	{"EOMWithSYN", frame(typeData, SYN|EOM, 1, ""), nil,
+		"protocol error: EOM with SYN or RST on channel 1"},
+	{"DisabledFeature", frame(typeData, SYN|META, 1, "metadata"), []Option{WithoutFeatures(FeatureMetadata)},
+		"protocol error: flags 0x41 on channel 1 need a disabled feature"},
+	{"ShortRSTReason", frame(typeData, SYN, 1, "") + frame(typeData, RST, 1, "\x00\x01"), nil,
+		"protocol error: RST reason of 2 bytes on channel 1"},
+	{"CompressedWithoutCodec", frame(typeData, SYN, 1, "") + frame(typeData, COMPRESS, 1, "data"), nil,
+		"protocol error: channel 1: compressed data without a codec"},
+	{"CorruptCompressedData", frame(typeData, SYN|COMPRESS, 1, "\x05flate") + frame(typeData, COMPRESS, 1, "\xff\xff\xff\xff"), nil,
+		"protocol error: channel 1: flate: corrupt input before offset 1"},
+	{"ExceedsWindow", frame(typeData, SYN, 1, "") + string(bytes.Repeat([]byte(frame(typeData, 0, 1, string(make([]byte, FragmentSize)))), initialWindow/FragmentSize+1)), nil,
+		"protocol error: 1024 bytes on channel 1 exceed its window of 0"},
+	{"ShortWindowUpdate", frame(typeWindowUpdate, 0, 1, "\x00\x01\x00"), nil,
+		"protocol error: window update of 3 bytes"},
+	{"WindowOverflow", frame(typeData, SYN, 1, "") + frame(typeWindowUpdate, 0, 1, "\xff\xff\xff\xff"), nil,
+		"protocol error: window of channel 1 grown past 4GB"},
+	{"ShortGoAway", frame(typeGoAway, 0, 0, "\x00\x01"), nil,
+		"protocol error: go away of 2 bytes"},
+	{"ShortPing", frame(typePing, 0, 0, "1234"), nil,
+		"protocol error: ping of 4 bytes"},
+	{"PartialSetting", frame(typeSettings, 0, 0, "\x00\x01\x00\x00\x04"), nil,
+		"protocol error: settings of 5 bytes"},
+	{"TinyFrameSize", frame(typeSettings, 0, 0, setting(settingMaxFrameSize, 1)), nil,
+		"protocol error: peer advertised a max frame size of 1 bytes"},
+	{"OversizedMetadata", frame(typeData, SYN|META, 1, string(make([]byte, MaxMetadataSize+1))), nil,
+		"protocol error: 752 bytes of metadata on channel 1"},
+	{"MalformedServiceName", frame(typeData, SYN|SERVICE, 1, "\x05svc"), nil,
+		"protocol error: malformed name in SYN for channel 1"},
+	{"EmptyServiceName", frame(typeData, SYN|SERVICE, 1, "\x00svc"), nil,
+		"protocol error: malformed name in SYN for channel 1"},
+	{"UnknownType", frame(0x42, 0, 0, ""), []Option{WithStrictPacketTypes()},
+		"protocol error: unknown packet type 66"},
+}
+
+// Run a server reading stream, returning the error it fails with.
+func decodeStream(stream []byte, options ...Option) (error, bool) {
+	sm := MultiplexedServer(&rwc{r: ioutil.NopCloser(bytes.NewReader(stream)), w: nopWriteCloser{ioutil.Discard}}, options...)
+	defer sm.Close()
+	select {
+	case <-sm.tomb.Dying():
+		return sm.Err(), true
+	case <-time.After(5 * time.Second):
+		return nil, false
+	}
+}
+
+func TestMalformedStreams(t *testing.T) {
+	for _, test := range malformedStreams {
+		t.Run(test.name, func(t *testing.T) {
+			err, ok := decodeStream([]byte(handshakeMagic+"\x00\x03\x00\x00"+test.stream), test.options...)
+			assert.True(t, ok, "hung")
+			assert.True(t, errors.Is(err, ErrProtocol), "%s", err)
+			assert.Equal(t, test.err, err.Error())
+		})
+	}
+}
+
+func TestValidStream(t *testing.T) {
+	// Only fails once the stream ends.
+	err, ok := decodeStream([]byte(validStream))
+	assert.True(t, ok, "hung")
+	assert.True(t, errors.Is(err, io.EOF), "%s", err)
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add([]byte(validStream))
+	for _, test := range malformedStreams {
+		f.Add([]byte(handshakeMagic + "\x00\x03\x00\x00" + test.stream))
+	}
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		if _, ok := decodeStream(stream); !ok {
+			t.Fatal("hung")
+		}
+	})
+}
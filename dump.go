@@ -0,0 +1,111 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Payload bytes dumped for each frame by WithDebugDump.
+	dumpBytes = 64
+
+	// Frames dumped each second by WithDebugDump, beyond which they are
+	// skipped.
+	maxDumpRate = 1000
+)
+
+var flagNames = []string{"SYN", "RST", "ACK", "FIN", "ABORT", "REFUSE", "META", "SERVICE", "EOM", "COMPRESS", "REASON"}
+
+// Names of the flags set in flags, separated by "|".
+func formatFlags(flags uint16) string {
+	var names []string
+	for i, name := range flagNames {
+		if flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if unknown := flags &^ allFlags; unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", unknown))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// A dumper writes a trace of frames (see WithDebugDump).
+type dumper struct {
+	lock    sync.Mutex
+	w       io.Writer
+	at      time.Time // Start of the second dumped counts.
+	dumped  int       // Frames dumped this second.
+	skipped int       // Frames skipped since the last was dumped.
+	buf     []byte
+}
+
+// Dump p, unless too many frames have been dumped this second.
+func (m *MultiplexedStream) dump(dir Direction, p *packet) {
+	d := m.dumper
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := m.config.clock.Now()
+	if now.Sub(d.at) >= time.Second {
+		d.at = now
+		d.dumped = 0
+	}
+	if d.dumped >= maxDumpRate {
+		d.skipped++
+		return
+	}
+	d.dumped++
+
+	b := d.buf[:0]
+	if d.skipped > 0 {
+		b = fmt.Appendf(b, "... %d frames skipped\n", d.skipped)
+		d.skipped = 0
+	}
+	b = fmt.Appendf(b, "%s %s %s channel %d flags %s length %d\n",
+		now.Format("15:04:05.000000"), dir, FrameType(p.typ), p.id, formatFlags(p.flags), len(p.payload))
+	payload := p.payload
+	if len(payload) > dumpBytes {
+		payload = payload[:dumpBytes]
+	}
+	if len(payload) > 0 {
+		b = append(b, hex.Dump(payload)...)
+	}
+	if more := len(p.payload) - len(payload); more > 0 {
+		b = fmt.Appendf(b, "... %d more bytes\n", more)
+	}
+	d.buf = b
+	d.w.Write(b)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.Write(b)
+}
+
+func (s *syncBuffer) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.String()
+}
+
+func TestFormatFlags(t *testing.T) {
+	assert.Equal(t, "none", formatFlags(0))
+	assert.Equal(t, "SYN|META|SERVICE", formatFlags(SYN|META|SERVICE))
+	assert.Equal(t, "RST|EOM|0x8000", formatFlags(RST|EOM|0x8000))
+}
+
+func TestDebugDump(t *testing.T) {
+	clock := newFakeClock()
+	trace := &syncBuffer{}
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithDebugDump(trace), WithClock(clock))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	data := []byte(strings.Repeat("0123456789abcdef", 5))
+	_, err = c.Write(data)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, data)
+	assert.NoError(t, err)
+
+	now := clock.Now().Format("15:04:05.000000")
+	assert.Contains(t, trace.String(), now+" inbound data channel 3 flags SYN length 0\n")
+	assert.Contains(t, trace.String(), now+" outbound data channel 3 flags ACK length 0\n")
+	assert.Contains(t, trace.String(), now+" inbound data channel 3 flags none length 80\n"+
+		"00000000  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|\n"+
+		"00000010  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|\n"+
+		"00000020  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|\n"+
+		"00000030  30 31 32 33 34 35 36 37  38 39 61 62 63 64 65 66  |0123456789abcdef|\n"+
+		"... 16 more bytes\n")
+}
+
+func TestDebugDumpRate(t *testing.T) {
+	clock := newFakeClock()
+	trace := &syncBuffer{}
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithDebugDump(trace), WithClock(clock))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	// Each ping is received and replied to.
+	for i := 0; i < maxDumpRate; i++ {
+		_, err := cm.Ping(context.Background())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, maxDumpRate, strings.Count(trace.String(), " channel "))
+	assert.NotContains(t, trace.String(), "skipped")
+
+	clock.Advance(time.Second)
+	_, err := cm.Ping(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, trace.String(), "frames skipped\n")
+	assert.True(t, strings.Count(trace.String(), " channel ") > maxDumpRate)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Events queued for a consumer that has fallen behind, beyond which they are
+// dropped.
+const eventBacklog = 256
+
+// EventType identifies what an Event reports.
+type EventType int
+
+// Types of Event.
+const (
+	// EventChannelOpened is a channel being opened by Dial, whether or not
+	// the peer accepts it, or returned by Accept.
+	EventChannelOpened EventType = iota
+	// EventChannelClosed is an opened channel closing, by either end. Err is
+	// why.
+	EventChannelClosed
+	// EventGoAway is the peer calling GoAway. Channel is the last of ours it
+	// will accept.
+	EventGoAway
+	// EventIdleTimeout is the stream being closed by WithIdleTimeout.
+	EventIdleTimeout
+	// EventProtocolError is the peer violating the protocol. Err is the
+	// violation.
+	EventProtocolError
+	// EventClosed is the stream closing, for whatever reason, and is always
+	// the last event. Err is why, as returned by Err.
+	EventClosed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventChannelOpened:
+		return "channel opened"
+	case EventChannelClosed:
+		return "channel closed"
+	case EventGoAway:
+		return "go away"
+	case EventIdleTimeout:
+		return "idle timeout"
+	case EventProtocolError:
+		return "protocol error"
+	case EventClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// An Event is something of note that happened to a stream (see
+// MultiplexedStream.Events).
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	SessionID string // See MultiplexedStream.ID.
+	Channel   uint32 // ID of the channel the event is about, if any.
+	Err       error
+}
+
+// Events returns a channel of events for observing the stream, which is
+// closed after EventClosed. Events are only recorded once Events has been
+// called, and are best effort: they are dropped rather than ever delaying the
+// stream, whenever more than a few hundred are waiting to be received (see
+// DroppedEvents).
+//
+// Every call returns the same channel, so events should be received by a
+// single consumer.
+func (m *MultiplexedStream) Events() <-chan Event {
+	m.eventLock.Lock()
+	defer m.eventLock.Unlock()
+	if m.events == nil {
+		m.events = make(chan Event, eventBacklog)
+		if m.eventsClosed {
+			close(m.events)
+		}
+	}
+	return m.events
+}
+
+// DroppedEvents returns the number of events dropped because the consumer of
+// Events had fallen behind.
+func (m *MultiplexedStream) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&m.droppedEvents)
+}
+
+// A channel has been opened by Dial or returned by Accept, and is counted as
+// opened or accepted. If it has already finished, it is closed straight away.
+func (m *MultiplexedStream) channelOpened(ch *Channel, counter *uint64) {
+	atomic.AddUint64(counter, 1)
+	m.emit(EventChannelOpened, ch.id, nil)
+	if m.config.onOpen != nil {
+		m.config.onOpen(ch)
+	}
+	if !atomic.CompareAndSwapUint32(&ch.counted, 0, 1) {
+		m.closed(ch)
+	}
+}
+
+// A channel has finished, which is only reported if it was opened.
+func (m *MultiplexedStream) channelClosed(ch *Channel) {
+	if atomic.SwapUint32(&ch.counted, 2) == 1 {
+		m.closed(ch)
+	}
+}
+
+func (m *MultiplexedStream) closed(ch *Channel) {
+	err := ch.tomb.Err()
+	atomic.AddUint64(&m.stats.closed, 1)
+	m.emit(EventChannelClosed, ch.id, err)
+	if m.config.onClose != nil {
+		m.config.onClose(ch, err)
+	}
+}
+
+// Record an event, if anyone is listening, without blocking.
+func (m *MultiplexedStream) emit(typ EventType, id uint32, err error) {
+	m.eventLock.Lock()
+	defer m.eventLock.Unlock()
+	if m.events == nil || m.eventsClosed {
+		return
+	}
+	select {
+	case m.events <- Event{Type: typ, Time: m.config.clock.Now(), SessionID: m.ID(), Channel: id, Err: err}:
+	default:
+		atomic.AddUint64(&m.droppedEvents, 1)
+	}
+}
+
+// Record that the stream has closed, which is the last event.
+func (m *MultiplexedStream) closeEvents() {
+	m.emit(EventClosed, 0, m.err())
+	m.eventLock.Lock()
+	defer m.eventLock.Unlock()
+	m.eventsClosed = true
+	if m.events != nil {
+		close(m.events)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	clock := newFakeClock()
+	sm, cm := newServerAndClient(WithClock(clock))
+	defer cm.Close()
+	events := sm.Events()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	<-s.tomb.Dead()
+	assert.NoError(t, cm.GoAway())
+	waitFor(t, func() bool { return sm.GoingAway() })
+	assert.NoError(t, sm.Close())
+
+	var got []Event
+	for event := range events {
+		got = append(got, event)
+	}
+	now := clock.Now()
+	id := sm.ID()
+	assert.Equal(t, []Event{
+		{Type: EventChannelOpened, Time: now, SessionID: id, Channel: s.id},
+		{Type: EventChannelClosed, Time: now, SessionID: id, Channel: s.id, Err: io.EOF},
+		{Type: EventGoAway, Time: now, SessionID: id},
+		{Type: EventClosed, Time: now, SessionID: id, Err: ErrSessionClosed},
+	}, got)
+	assert.Equal(t, uint64(0), sm.DroppedEvents())
+
+	_, ok := <-sm.Events()
+	assert.False(t, ok)
+}
+
+func TestEventsDropped(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	sm.Events()
+
+	for i := 0; i < eventBacklog; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+		<-s.tomb.Dead()
+	}
+	assert.Equal(t, uint64(eventBacklog), sm.DroppedEvents())
+	assert.NoError(t, sm.Err())
+}
+
+func TestEventsProtocolError(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	events := sm.Events()
+
+	assert.NoError(t, sendHandshake(cw))
+	go writeFrame(cw, typePing, 0, 0, nil)
+	event := <-events
+	assert.Equal(t, EventProtocolError, event.Type)
+	assert.True(t, errors.Is(event.Err, ErrProtocol))
+	event = <-events
+	assert.Equal(t, EventClosed, event.Type)
+	assert.Equal(t, event.Err, sm.Err())
+}
+
+func TestEventsNotRecorded(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	_, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+	select {
+	case event := <-sm.Events():
+		t.Fatalf("unexpected event %v", event)
+	default:
+	}
+}
+
+func TestChannelCallbacks(t *testing.T) {
+	var lock sync.Mutex
+	got := map[*MultiplexedStream][]string{}
+	record := func(event string, ch *Channel) {
+		lock.Lock()
+		got[ch.m] = append(got[ch.m], fmt.Sprintf("%s %d", event, ch.id))
+		lock.Unlock()
+	}
+	onOpen := WithOnChannelOpen(func(ch *Channel) { record("open", ch) })
+	onClose := WithOnChannelClose(func(ch *Channel, err error) { record(fmt.Sprintf("close %v", err), ch) })
+	sm, cm := newServerAndClient(onOpen, onClose, WithServices("known"), WithRejectUnknownServices())
+	defer cm.Close()
+
+	// Accepted, and closed by the peer.
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	<-s.tomb.Dead()
+	// Refused, so never opened.
+	_, err = cm.DialService("unknown")
+	assert.Equal(t, ErrUnknownService, err)
+	// Killed by the stream closing.
+	c, err = cm.Dial()
+	assert.NoError(t, err)
+	s2, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, sm.Close())
+	<-s2.tomb.Dead()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{
+		fmt.Sprintf("open %d", s.id),
+		fmt.Sprintf("close EOF %d", s.id),
+		fmt.Sprintf("open %d", s2.id),
+		fmt.Sprintf("close %v %d", ErrSessionClosed, s2.id),
+	}, got[sm])
+	// The dialling end also sees the refused channel.
+	assert.Equal(t, []string{
+		fmt.Sprintf("open %d", s.id),
+		fmt.Sprintf("close %v %d", ErrChannelClosed, s.id),
+		fmt.Sprintf("open %d", s.id+2),
+		fmt.Sprintf("close %v %d", ErrUnknownService, s.id+2),
+		fmt.Sprintf("open %d", s2.id),
+	}, got[cm][:5])
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Packet types from MinExtensionType up are reserved for applications (see
+// RegisterExtension). Lower types are used by the protocol.
+const MinExtensionType = 0x80
+
+var (
+	// ErrInvalidExtension is returned by RegisterExtension and SendExtension
+	// for packet types outside of the range reserved for extensions, and by
+	// RegisterExtension for types that already have a handler.
+	ErrInvalidExtension = errors.New("invalid extension packet type")
+	// ErrPayloadTooLarge is returned by SendExtension for payloads larger
+	// than MaxFrameSize.
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+// RegisterExtension registers a handler for packets of type typ sent by the
+// peer with SendExtension, which must be at least MinExtensionType. This
+// allows small amounts of application control traffic to share the stream
+// without opening a channel.
+//
+// The handler is called by the goroutine that reads from the connection, so
+// it must not block. The payload is only valid until the handler returns.
+// Extension packets without a handler are treated as packets of an unknown
+// type (see WithStrictPacketTypes).
+func (m *MultiplexedStream) RegisterExtension(typ uint8, handler func(payload []byte)) error {
+	if typ < MinExtensionType {
+		return fmt.Errorf("%w: %d is reserved by the protocol", ErrInvalidExtension, typ)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.extensions[typ]; ok {
+		return fmt.Errorf("%w: %d already has a handler", ErrInvalidExtension, typ)
+	}
+	if m.extensions == nil {
+		m.extensions = make(map[uint8]func([]byte))
+	}
+	m.extensions[typ] = handler
+	return nil
+}
+
+// SendExtension sends a packet of type typ, which must be at least
+// MinExtensionType, to the peer's extension handler (see RegisterExtension).
+// The packet is queued along with data written to channels, and payload is
+// copied.
+func (m *MultiplexedStream) SendExtension(typ uint8, payload []byte) error {
+	if typ < MinExtensionType {
+		return fmt.Errorf("%w: %d is reserved by the protocol", ErrInvalidExtension, typ)
+	}
+	if len(payload) > int(m.MaxFrameSize()) {
+		return ErrPayloadTooLarge
+	}
+	if err := m.err(); err != nil {
+		return err
+	}
+	p := &packet{typ: typ, payload: append([]byte(nil), payload...)}
+	if err := m.hook(Outbound, p); err != nil {
+		return err
+	}
+	select {
+	case m.out <- p:
+		return nil
+	case <-m.tomb.Dying():
+		return m.err()
+	}
+}
+
+// Pass an extension packet to its handler, returning false if it has none.
+func (m *MultiplexedStream) handleExtension(p *packet) bool {
+	if p.typ < MinExtensionType {
+		return false
+	}
+	m.lock.Lock()
+	handler := m.extensions[p.typ]
+	m.lock.Unlock()
+	if handler == nil {
+		return false
+	}
+	handler(p.payload)
+	return true
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestExtension(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	received := make(chan string, 3)
+	err := sm.RegisterExtension(MinExtensionType, func(payload []byte) {
+		received <- string(payload)
+	})
+	assert.NoError(t, err)
+
+	// Sent in order.
+	for _, msg := range []string{"one", "two", "three"} {
+		assert.NoError(t, cm.SendExtension(MinExtensionType, []byte(msg)))
+	}
+	assert.Equal(t, "one", <-received)
+	assert.Equal(t, "two", <-received)
+	assert.Equal(t, "three", <-received)
+	assert.Equal(t, uint64(0), sm.UnknownPackets())
+}
+
+func TestExtensionInvalid(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	err := sm.RegisterExtension(typeData, func([]byte) {})
+	assert.True(t, errors.Is(err, ErrInvalidExtension))
+	err = cm.SendExtension(typeSettings, nil)
+	assert.True(t, errors.Is(err, ErrInvalidExtension))
+
+	assert.NoError(t, sm.RegisterExtension(0xff, func([]byte) {}))
+	err = sm.RegisterExtension(0xff, func([]byte) {})
+	assert.True(t, errors.Is(err, ErrInvalidExtension))
+
+	err = cm.SendExtension(0xff, make([]byte, cm.MaxFrameSize()+1))
+	assert.Equal(t, ErrPayloadTooLarge, err)
+}
+
+func TestExtensionUnhandled(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	assert.NoError(t, cm.SendExtension(MinExtensionType, []byte("ignored")))
+	waitFor(t, func() bool { return sm.UnknownPackets() == 1 })
+	assert.NoError(t, sm.Err())
+
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	strict := MultiplexedServer(&rwc{r: sr, w: sw}, WithStrictPacketTypes())
+	defer strict.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	go writeFrame(cw, MinExtensionType, 0, 0, nil)
+	waitFor(t, func() bool { return strict.Err() != nil })
+	assert.True(t, errors.Is(strict.Err(), ErrProtocol))
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+// A place in the stream's code where tests can inject an error, to reach
+// paths that are hard to hit from outside, such as races with the reader and
+// writer (see withFault).
+type faultSite string
+
+// Sites at which faults can be injected.
+const (
+	// After the header of a frame has been read. An error fails the reader
+	// as if the transport had.
+	faultRead faultSite = "read"
+	// After the header of a frame has been written, before its payload. An
+	// error fails the writer, leaving a partial frame on the transport.
+	faultWrite faultSite = "write"
+	// In Dial, once the channel has been registered, before its SYN is
+	// queued.
+	faultDial faultSite = "dial"
+	// On receiving a SYN, before the channel it opens is registered.
+	faultAccept faultSite = "accept"
+)
+
+// withFault calls f whenever the stream reaches site, failing at that point
+// with any error it returns. f may also block, to hold the stream at site
+// while a test races something else against it.
+func withFault(site faultSite, f func() error) Option {
+	return func(c *config) {
+		if c.faults == nil {
+			c.faults = make(map[faultSite]func() error)
+		}
+		c.faults[site] = f
+	}
+}
+
+// Call the fault injected at site, if any.
+func (m *MultiplexedStream) fault(site faultSite) error {
+	if f := m.config.faults[site]; f != nil {
+		return f()
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alecthomas/multiplex/multiplextest"
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Like newServerAndClient, with separate options for each end.
+func newFaultyServerAndClient(server, client []Option) (s *MultiplexedStream, c *MultiplexedStream, sconn *closeCounter) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sconn = &closeCounter{ReadWriteCloser: &rwc{r: sr, w: sw}}
+	return MultiplexedServer(sconn, server...), MultiplexedClient(&rwc{r: cr, w: cw}, client...), sconn
+}
+
+func TestFaultWriteMidFrame(t *testing.T) {
+	var armed int32
+	fail := withFault(faultWrite, func() error {
+		if atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			return multiplextest.ErrInjected
+		}
+		return nil
+	})
+	sm, cm, _ := newFaultyServerAndClient(nil, []Option{fail})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Once data has arrived the writer is past any earlier frame.
+	_, err = c.Write([]byte("hi"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 2))
+	assert.NoError(t, err)
+
+	// The header of the next frame is written, but not its payload, so the
+	// server sees the transport end mid-frame.
+	atomic.StoreInt32(&armed, 1)
+	c.Write([]byte("hello"))
+	n, err := s.Read(make([]byte, 5))
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%v", err)
+	assert.True(t, errors.Is(sm.Err(), io.ErrUnexpectedEOF), "%v", sm.Err())
+
+	var terr *TransportError
+	assert.True(t, errors.As(cm.Err(), &terr))
+	assert.Equal(t, "write", terr.Op)
+	assert.Equal(t, multiplextest.ErrInjected, terr.Err)
+	_, err = c.Write([]byte("hello"))
+	assert.True(t, errors.Is(err, multiplextest.ErrInjected), "%v", err)
+}
+
+func TestFaultReadDuringDial(t *testing.T) {
+	// Once the channel is registered, the reader fails on the next frame,
+	// which is the acknowledgement of the channel.
+	dialling := make(chan struct{})
+	sm, cm, _ := newFaultyServerAndClient(nil, []Option{
+		withFault(faultDial, func() error {
+			close(dialling)
+			return nil
+		}),
+		withFault(faultRead, func() error {
+			select {
+			case <-dialling:
+				return multiplextest.ErrInjected
+			default:
+				return nil
+			}
+		}),
+	})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.Nil(t, c)
+	assert.True(t, errors.Is(err, multiplextest.ErrInjected), "%v", err)
+	var terr *TransportError
+	assert.True(t, errors.As(cm.Err(), &terr))
+	assert.Equal(t, "read", terr.Op)
+	assert.Equal(t, 0, cm.NumChannels())
+}
+
+func TestFaultCloseDuringAccept(t *testing.T) {
+	// Hold the reader before it registers the channel being opened until the
+	// stream has closed every channel it knows about.
+	opening := make(chan struct{})
+	closed := make(chan struct{})
+	hold := withFault(faultAccept, func() error {
+		close(opening)
+		<-closed
+		return nil
+	})
+	sm, cm, sconn := newFaultyServerAndClient([]Option{hold}, nil)
+	defer cm.Close()
+
+	dialled := make(chan error, 1)
+	go func() {
+		_, err := cm.Dial()
+		dialled <- err
+	}()
+	<-opening
+	assert.NoError(t, sm.Close())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&sconn.closed))
+	close(closed)
+
+	// The reader closes the transport once more as it exits, after Close and
+	// the writer, by which time the channel must have been forgotten.
+	waitFor(t, func() bool { return atomic.LoadInt32(&sconn.closed) == 3 })
+	assert.Equal(t, 0, sm.NumChannels())
+	_, err := sm.Accept()
+	assert.True(t, errors.Is(err, ErrSessionClosed), "%v", err)
+	assert.Error(t, <-dialled)
+}
+
+func TestFaultCloseDuringDial(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		// Hold Dial once the channel is registered until the stream has
+		// closed, so that the SYN is queued as it dies.
+		registered := make(chan struct{})
+		closed := make(chan struct{})
+		hold := withFault(faultDial, func() error {
+			close(registered)
+			<-closed
+			return nil
+		})
+		sm, cm, _ := newFaultyServerAndClient(nil, []Option{hold})
+		dialled := make(chan error, 1)
+		go func() {
+			c, err := cm.DialAsync(context.Background())
+			assert.Nil(t, c)
+			dialled <- err
+		}()
+		<-registered
+		assert.NoError(t, cm.Close())
+		close(closed)
+		err := <-dialled
+		assert.True(t, errors.Is(err, ErrSessionClosed), "%v", err)
+		assert.Equal(t, 0, cm.NumChannels())
+		sm.Close()
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Features is a set of optional protocol capabilities. Each end advertises the
+// features it supports when the stream starts, and a feature is only used if
+// both ends support it, so that newer peers interoperate with older ones.
+//
+// Flow control, half-closed channels and pings are part of every version of
+// the protocol, so aren't optional.
+type Features uint32
+
+const (
+	// FeatureOpenAck acknowledges channels once they are queued for Accept,
+	// so that Dial can wait for them to be accepted or refused.
+	FeatureOpenAck Features = 1 << iota
+	// FeatureMetadata carries metadata with the request to open a channel
+	// (see WithMetadata).
+	FeatureMetadata
+	// FeatureServices carries a service name with the request to open a
+	// channel (see DialService).
+	FeatureServices
+	// FeatureMessages marks the ends of messages written to channels (see
+	// WritePart).
+	FeatureMessages
+	// FeatureChannelCompression compresses the data of channels that ask for
+	// it (see WithChannelCompression).
+	FeatureChannelCompression
+	// FeatureCloseReasons tells the peer why a channel was closed, such as
+	// it being idle (see SetIdleTimeout).
+	FeatureCloseReasons
+
+	// Every feature this version supports.
+	allFeatures = FeatureOpenAck | FeatureMetadata | FeatureServices | FeatureMessages | FeatureChannelCompression | FeatureCloseReasons
+)
+
+var featureNames = []string{"open-ack", "metadata", "services", "messages", "channel-compression", "close-reasons"}
+
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Has returns true if f includes all of the features in g.
+func (f Features) Has(g Features) bool {
+	return f&g == g
+}
+
+// PeerFeatures returns the features that both ends support, and so are in
+// use. Until the peer's settings arrive, which is the first thing it sends,
+// this is empty: packets sent before then, such as by DialAsync, only use the
+// base protocol.
+func (m *MultiplexedStream) PeerFeatures() Features {
+	return Features(atomic.LoadUint32(&m.peerFeatures)) & m.config.features
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestPeerFeatures(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	waitFor(t, func() bool { return cm.PeerFeatures() == allFeatures })
+	waitFor(t, func() bool { return sm.PeerFeatures() == allFeatures })
+	assert.Equal(t, "open-ack|metadata|services|messages|channel-compression|close-reasons", cm.PeerFeatures().String())
+}
+
+func TestPeerFeaturesNegotiated(t *testing.T) {
+	// Only features both ends support are used.
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	old := MultiplexedServer(&rwc{r: sr, w: sw}, WithoutFeatures(FeatureOpenAck|FeatureServices|FeatureMessages|FeatureChannelCompression|FeatureCloseReasons))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer old.Close()
+	defer cm.Close()
+
+	waitFor(t, func() bool { return cm.PeerFeatures() == FeatureMetadata })
+	waitFor(t, func() bool { return old.PeerFeatures() == FeatureMetadata })
+
+	// Dial doesn't wait for an acknowledgement that will never come.
+	c, err := cm.Dial(WithMetadata([]byte("meta")))
+	assert.NoError(t, err)
+	go c.Write([]byte("hello"))
+	s, err := old.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("meta"), s.Metadata())
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+
+	_, err = cm.DialService("rpc")
+	assert.Equal(t, ErrServicesUnsupported, err)
+}
+
+func TestPeerFeaturesUnknown(t *testing.T) {
+	cm, _, sw := newClientWithFakePeer()
+	defer cm.Close()
+	assert.Equal(t, Features(0), cm.PeerFeatures())
+
+	// Features from the future are ignored.
+	payload := make([]byte, settingSize)
+	binary.BigEndian.PutUint16(payload, settingFeatures)
+	binary.BigEndian.PutUint32(payload[2:], uint32(FeatureServices|1<<31))
+	assert.NoError(t, writeFrame(sw, typeSettings, 0, 0, payload))
+	waitFor(t, func() bool { return cm.PeerFeatures() == FeatureServices })
+	assert.NoError(t, cm.Err())
+}
+
+func TestFeaturesString(t *testing.T) {
+	assert.Equal(t, "none", Features(0).String())
+	assert.Equal(t, "open-ack|services", (FeatureOpenAck | FeatureServices).String())
+	assert.True(t, allFeatures.Has(FeatureMetadata|FeatureServices))
+	assert.False(t, FeatureMetadata.Has(FeatureMetadata|FeatureServices))
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// ChannelFiles connects c to a pair of pipes, so that it can be handed to a
+// child process, eg. as the Stdin and Stdout of an exec.Cmd. The child reads
+// data received on the channel from r, and what it writes to w is sent on the
+// channel.
+//
+// The child sees EOF on r once the peer closes the channel or closes it for
+// writing. Once the child, and any process it shares w with, has closed w,
+// the channel is closed for writing. For that to happen the caller must close
+// its own copies of r and w once the child has been started.
+//
+// cleanup closes r and w if the caller hasn't, waits for everything the child
+// wrote to be sent, and then closes the channel and stops copying. It should
+// be called once the child has exited, and returns any error sending the
+// child's output.
+func ChannelFiles(c *Channel) (r, w *os.File, cleanup func() error, err error) {
+	r, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		r.Close()
+		stdin.Close()
+		return nil, nil, nil, err
+	}
+
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		// The child exiting without reading everything is not an error,
+		// but the peer is told not to send any more.
+		if _, err := io.Copy(stdin, c); err != nil {
+			c.CloseRead()
+		}
+		stdin.Close()
+	}()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c, stdout)
+		stdout.Close()
+		if err == nil {
+			// Everything has been sent, so the channel closing first is
+			// no loss.
+			c.CloseWrite()
+		}
+		sent <- err
+	}()
+
+	var (
+		once    sync.Once
+		sendErr error
+	)
+	cleanup = func() error {
+		once.Do(func() {
+			r.Close()
+			w.Close()
+			sendErr = <-sent
+			c.Close()
+			<-received
+		})
+		return sendErr
+	}
+	return r, w, cleanup, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Run name with its stdin and stdout connected to the server's end of a
+// channel, returning the client's end.
+func runOverChannel(t *testing.T, sm, cm *MultiplexedStream, name string, args ...string) (c *Channel, wait func() error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skipf("%s not found: %s", name, err)
+	}
+	c, err = cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	r, w, cleanup, err := ChannelFiles(s)
+	assert.NoError(t, err)
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	assert.NoError(t, cmd.Start())
+	r.Close()
+	w.Close()
+	return c, func() error {
+		if err := cmd.Wait(); err != nil {
+			return err
+		}
+		return cleanup()
+	}
+}
+
+func TestChannelFiles(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	c, wait := runOverChannel(t, sm, cm, "cat")
+
+	_, err := c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// cat exits once its input is closed, closing the channel.
+	_, err = c.Write([]byte(" world"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.CloseWrite())
+	rest, err := ioutil.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, " world", string(rest))
+	assert.NoError(t, wait())
+	<-c.Done()
+}
+
+func TestChannelFilesChildExits(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	c, wait := runOverChannel(t, sm, cm, "head", "-c", "5")
+
+	_, err := c.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	assert.NoError(t, wait())
+	<-c.Done()
+}
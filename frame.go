@@ -0,0 +1,127 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+	"io"
+)
+
+// Frame is a packet as it is sent on the wire, for tools that read or write
+// the protocol directly.
+//
+// Each frame is a 10 byte header followed by the payload. The header is the
+// frame's type in 1 byte, the low 8 bits of its flags in 1 byte, its channel
+// ID in 4 bytes, and the length of the payload in 4 bytes, of which the top
+// byte holds the flags from EOM up. All integers are big-endian.
+type Frame struct {
+	Type      FrameType
+	ChannelID uint32
+	Flags     uint16
+	Payload   []byte
+}
+
+// Make the header of a packet.
+func newHeader(typ uint8, id uint32, flags uint16, length int) header {
+	return header{Type: typ, Flags: uint8(flags), ID: id, Length: uint32(length) | uint32(flags>>8)<<24}
+}
+
+// Encode writes the frame to w, returning ErrPayloadTooLarge if the payload
+// is larger than the 16MB the header can describe.
+func (f *Frame) Encode(w io.Writer) error {
+	if len(f.Payload) > maxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	var b [headerSize]byte
+	h := newHeader(uint8(f.Type), f.ChannelID, f.Flags, len(f.Payload))
+	h.encode(b[:])
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+// The frame with header h and the given payload.
+func (h *header) frame(payload []byte) Frame {
+	return Frame{
+		Type:      FrameType(h.Type),
+		ChannelID: h.ID,
+		Flags:     h.flags(),
+		Payload:   payload,
+	}
+}
+
+// Decode the frame from b, which holds its header, and at least its payload.
+func decodeFrame(b []byte) (Frame, error) {
+	var h header
+	h.decode(b)
+	if length := h.length(); uint32(len(b)-headerSize) < length {
+		return Frame{}, fmt.Errorf("%w: payload of %d bytes in a frame of %d", ErrProtocol, length, len(b))
+	}
+	return h.frame(b[headerSize : headerSize+h.length()]), nil
+}
+
+// DecodeFrames reads frames from r until it ends, calling fn with each in
+// turn. It stops at the first error returned by fn, and returns it. The
+// payload passed to fn is only valid until fn returns.
+//
+// r must start at a frame, so the handshake (see WithoutHandshake) must
+// already have been read, and frames must not be followed by checksums (see
+// WithChecksums). Payloads are at most 16MB, as the header can describe no
+// more. The end of r is expected between frames, and otherwise
+// io.ErrUnexpectedEOF is returned.
+func DecodeFrames(r io.Reader, fn func(Frame) error) error {
+	var (
+		raw     [headerSize]byte
+		hdr     header
+		payload []byte
+	)
+	for {
+		if _, err := io.ReadFull(r, raw[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		hdr.decode(raw[:])
+		length := int(hdr.length())
+		if cap(payload) < length {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := fn(hdr.frame(payload)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+var goldenFrames = []struct {
+	frame Frame
+	wire  string
+}{
+	{Frame{Type: FrameData, ChannelID: 3, Flags: SYN}, "\x00\x01\x00\x00\x00\x03\x00\x00\x00\x00"},
+	{Frame{Type: FrameData, ChannelID: 0x01020304, Payload: []byte("hello")}, "\x00\x00\x01\x02\x03\x04\x00\x00\x00\x05hello"},
+	{Frame{Type: FrameData, ChannelID: 3, Flags: FIN | EOM | COMPRESS, Payload: []byte("x")}, "\x00\x08\x00\x00\x00\x03\x03\x00\x00\x01x"},
+	{Frame{Type: FrameWindowUpdate, ChannelID: 2, Payload: []byte("\x00\x01\x00\x00")}, "\x01\x00\x00\x00\x00\x02\x00\x00\x00\x04\x00\x01\x00\x00"},
+	{Frame{Type: FramePing, Flags: ACK, Payload: []byte("12345678")}, "\x02\x04\x00\x00\x00\x00\x00\x00\x00\x0812345678"},
+	{Frame{Type: FrameGoAway, Payload: []byte("\x00\x00\x00\x07")}, "\x03\x00\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x07"},
+	{Frame{Type: MinExtensionType, Payload: []byte("ext")}, "\x80\x00\x00\x00\x00\x00\x00\x00\x00\x03ext"},
+}
+
+func TestFrameEncode(t *testing.T) {
+	for _, test := range goldenFrames {
+		b := &bytes.Buffer{}
+		assert.NoError(t, test.frame.Encode(b))
+		assert.Equal(t, test.wire, b.String(), "%+v", test.frame)
+	}
+
+	f := Frame{Payload: make([]byte, maxPayloadSize+1)}
+	assert.Equal(t, ErrPayloadTooLarge, f.Encode(io.Discard))
+}
+
+func TestDecodeFrames(t *testing.T) {
+	var wire string
+	for _, test := range goldenFrames {
+		wire += test.wire
+	}
+	var got []Frame
+	err := DecodeFrames(bytes.NewReader([]byte(wire)), func(f Frame) error {
+		f.Payload = append([]byte{}, f.Payload...)
+		got = append(got, f)
+		return nil
+	})
+	assert.NoError(t, err)
+	for i, test := range goldenFrames {
+		if test.frame.Payload == nil {
+			test.frame.Payload = []byte{}
+		}
+		assert.Equal(t, test.frame, got[i])
+	}
+
+	// Truncated in the header and in the payload.
+	for _, n := range []int{len(wire) - 12, len(wire) - 1} {
+		err = DecodeFrames(bytes.NewReader([]byte(wire[:n])), func(Frame) error { return nil })
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+}
+
+// The frames a stream writes can be decoded.
+func TestDecodeFramesFromStream(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	recorder := &recordingWriter{WriteCloser: cw}
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithoutHandshake())
+	cm := MultiplexedClient(&rwc{r: cr, w: recorder}, WithoutHandshake())
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+	cm.Close()
+
+	recorder.lock.Lock()
+	wire := recorder.buf.Bytes()
+	recorder.lock.Unlock()
+	var got []Frame
+	err = DecodeFrames(bytes.NewReader(wire), func(f Frame) error {
+		if f.Type == FrameData {
+			f.Payload = append([]byte{}, f.Payload...)
+			got = append(got, f)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Frame{
+		{Type: FrameData, ChannelID: c.id, Flags: SYN, Payload: []byte{}},
+		{Type: FrameData, ChannelID: c.id, Payload: []byte("hello")},
+	}, got[:2])
+}
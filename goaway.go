@@ -0,0 +1,87 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// GoAway tells the peer to stop opening new channels.
+//
+// Channels the peer has already opened, including any still in flight when
+// the peer receives the notification, are unaffected. Channels opened by the
+// peer afterwards are refused, and the peer's Dial returns ErrGoAway.
+//
+// Calling GoAway more than once has no further effect.
+func (m *MultiplexedStream) GoAway() error {
+	m.lock.Lock()
+	if m.goneAway {
+		m.lock.Unlock()
+		return nil
+	}
+	m.goneAway = true
+	last := m.lastPeerID
+	m.lock.Unlock()
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, last)
+	p := &packet{typ: typeGoAway, payload: payload}
+	if err := m.hook(Outbound, p); err != nil {
+		m.lock.Lock()
+		m.goneAway = false
+		m.lock.Unlock()
+		return err
+	}
+	select {
+	case m.control <- p:
+		return nil
+	case <-m.tomb.Dying():
+		return m.err()
+	}
+}
+
+// GoingAway returns true if the peer has called GoAway, after which new
+// channels can no longer be opened with Dial.
+func (m *MultiplexedStream) GoingAway() bool {
+	return atomic.LoadUint32(&m.goingAway) != 0
+}
+
+// The peer has stopped servicing new channels. Any we opened after the last
+// one it saw will be refused, so fail them now rather than waiting for the
+// RST.
+func (m *MultiplexedStream) handleGoAway(last uint32) {
+	parity := m.parity()
+	atomic.StoreUint32(&m.goingAway, 1)
+	m.emit(EventGoAway, last, nil)
+	m.log(levelInfo, "peer is going away", "last_channel_id", last)
+	for _, ch := range m.channels.all() {
+		if ch.id%2 == parity && ch.id > last {
+			ch.reset(ErrGoAway)
+		}
+	}
+}
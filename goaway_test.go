@@ -0,0 +1,94 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestGoAway(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	assert.NoError(t, sm.GoAway())
+	waitFor(t, cm.GoingAway)
+	assert.False(t, sm.GoingAway())
+
+	// The client can no longer open channels.
+	_, err = cm.Dial()
+	assert.Equal(t, ErrGoAway, err)
+
+	// But existing channels still work in both directions.
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = s.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, err = s.Write([]byte("world"))
+	assert.NoError(t, err)
+	_, err = c.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+
+	// As does opening channels from the side that sent the GoAway.
+	d, err := sm.Dial()
+	assert.NoError(t, err)
+	_, err = d.Write([]byte("ok"))
+	assert.NoError(t, err)
+	a, err := cm.Accept()
+	assert.NoError(t, err)
+	b = make([]byte, 2)
+	_, err = a.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(b))
+}
+
+func TestGoAwayInFlight(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+
+	// Simulate a GoAway sent before the server saw the channel.
+	cm.handleGoAway(0)
+	_, err = ioutil.ReadAll(c)
+	assert.True(t, errors.Is(err, ErrGoAway), "%s", err)
+	assert.True(t, cm.GoingAway())
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Sent by each end before anything else (see WithoutHandshake): the magic
+// bytes, the protocol version, the compression the end uses and flags.
+const (
+	handshakeMagic  = "MPLX"
+	protocolVersion = 3
+	handshakeSize   = len(handshakeMagic) + 4
+)
+
+// Handshake flags.
+const (
+	// Each packet is followed by a checksum (see WithChecksums).
+	handshakeChecksums = 1 << iota
+)
+
+func (m *MultiplexedStream) writeHandshake() error {
+	var b [handshakeSize]byte
+	copy(b[:], handshakeMagic)
+	binary.BigEndian.PutUint16(b[len(handshakeMagic):], protocolVersion)
+	b[handshakeSize-2] = byte(m.config.compression)
+	if m.config.checksums {
+		b[handshakeSize-1] |= handshakeChecksums
+	}
+	return writeFull(m.conn, b[:])
+}
+
+// Check that the peer speaks the same protocol, and version, as us, and
+// frames packets as we do. Compression and checksums are properties of the
+// whole stream, so the ends must agree before the first packet.
+func (m *MultiplexedStream) readHandshake() error {
+	var b [handshakeSize]byte
+	if _, err := io.ReadFull(m.conn, b[:]); err != nil {
+		return transportError("read", err)
+	}
+	if string(b[:len(handshakeMagic)]) != handshakeMagic {
+		return ErrBadHandshake
+	}
+	if version := binary.BigEndian.Uint16(b[len(handshakeMagic):]); version != protocolVersion {
+		return fmt.Errorf("%w: peer speaks version %d, we speak %d", ErrVersionMismatch, version, protocolVersion)
+	}
+	if compression := Compression(b[handshakeSize-2]); compression != m.config.compression {
+		return fmt.Errorf("%w: peer uses %s, we use %s", ErrCompressionMismatch, compression, m.config.compression)
+	}
+	if checksums := b[handshakeSize-1]&handshakeChecksums != 0; checksums != m.config.checksums {
+		if checksums {
+			return fmt.Errorf("%w: peer uses checksums, we don't", ErrChecksumsMismatch)
+		}
+		return fmt.Errorf("%w: we use checksums, peer doesn't", ErrChecksumsMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestHandshake(t *testing.T) {
+	for _, test := range []struct {
+		handshake string
+		err       error
+	}{
+		{"GET / HTTP/1.1\r\n", ErrBadHandshake},
+		{handshakeMagic + "\x00\x01\x00\x00", ErrVersionMismatch},
+		{handshakeMagic + "\x00\x00\x00\x00", ErrVersionMismatch},
+		{handshakeMagic + "\x00\x03\x01\x00", ErrCompressionMismatch},
+		{handshakeMagic + "\x00\x03\x00\x01", ErrChecksumsMismatch},
+	} {
+		sr, cw := io.Pipe()
+		cr, sw := io.Pipe()
+		go io.Copy(ioutil.Discard, cr)
+		sm := MultiplexedServer(&rwc{r: sr, w: sw})
+		go io.WriteString(cw, test.handshake)
+		waitFor(t, func() bool { return sm.Err() != nil })
+		assert.True(t, errors.Is(sm.Err(), test.err), "%q: %s", test.handshake, sm.Err())
+		sm.Close()
+	}
+}
+
+func TestHandshakeVersionInError(t *testing.T) {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	go io.WriteString(cw, handshakeMagic+"\x00\x07\x00\x00")
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.Equal(t, "protocol version mismatch: peer speaks version 7, we speak 3", sm.Err().Error())
+}
+
+func TestWithoutHandshake(t *testing.T) {
+	sm, cm := newServerAndClient(WithoutHandshake())
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	go c.Write([]byte("hello"))
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+}
+
+func TestHandshakeMissing(t *testing.T) {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	// A peer that predates the handshake starts with its settings.
+	go writeFrame(cw, typeSettings, 0, 0, settingsPayload(FragmentSize))
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.Equal(t, ErrBadHandshake, sm.Err())
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+)
+
+// Direction is whether a frame was sent or received (see WithFrameHook).
+type Direction uint8
+
+// Directions of frames.
+const (
+	Inbound  Direction = iota // Received from the peer.
+	Outbound                  // Sent to the peer.
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// FrameType is the type of a frame.
+type FrameType uint8
+
+// Types of frames used by the protocol. Types from MinExtensionType up are
+// extensions (see RegisterExtension).
+const (
+	FrameData         FrameType = typeData
+	FrameWindowUpdate FrameType = typeWindowUpdate
+	FramePing         FrameType = typePing
+	FrameGoAway       FrameType = typeGoAway
+	FrameSettings     FrameType = typeSettings
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "data"
+	case FrameWindowUpdate:
+		return "window update"
+	case FramePing:
+		return "ping"
+	case FrameGoAway:
+		return "go away"
+	case FrameSettings:
+		return "settings"
+	default:
+		return fmt.Sprintf("type %d", uint8(t))
+	}
+}
+
+// FrameInfo describes a frame passed to the hook of WithFrameHook.
+type FrameInfo struct {
+	Type    FrameType
+	Channel uint32 // ID of the channel, for data and window update frames.
+	Flags   uint16 // Packet flags, such as SYN.
+	Length  int    // Size of the payload, before compression.
+}
+
+// Pass p to the frame hook, if any. If the hook returns an error and p can be
+// vetoed, the error is returned: a frame being sent must then be dropped and
+// the error returned unchanged to the call that sent it, and a frame received
+// is handled as vetoed. Otherwise the frame goes ahead, and nil is returned.
+func (m *MultiplexedStream) hook(dir Direction, p *packet) error {
+	if m.config.frameHook == nil {
+		return nil
+	}
+	err := m.config.frameHook(dir, FrameInfo{
+		Type:    FrameType(p.typ),
+		Channel: p.id,
+		Flags:   p.flags,
+		Length:  len(p.payload),
+	})
+	if err != nil && vetoable(dir, p) {
+		return err
+	}
+	return nil
+}
+
+// Whether the frame hook may veto p. Frames that the other end waits for, or
+// that keep the ends' views of a channel and its window in step, can't be:
+// acknowledgements, refusals, FINs and RSTs, replies to pings, window updates
+// and settings. Received data frames are vetoed by refusing the channel they
+// open, or dropping their payload while still charging it to the window and
+// granting it back, so they can always be vetoed.
+func vetoable(dir Direction, p *packet) bool {
+	switch {
+	case p.typ == typeData && dir == Inbound:
+		return true
+	case p.typ == typeData:
+		return p.flags&(ACK|FIN|RST) == 0
+	case p.typ == typePing:
+		// The peer waits for replies to its pings.
+		return dir == Outbound && p.flags&ACK == 0
+	case p.typ == typeGoAway, p.typ >= MinExtensionType:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+type frameRecorder struct {
+	lock   sync.Mutex
+	frames map[Direction][]FrameInfo
+}
+
+func (r *frameRecorder) hook(dir Direction, f FrameInfo) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if f.Type == FrameData {
+		r.frames[dir] = append(r.frames[dir], f)
+	}
+	return nil
+}
+
+func (r *frameRecorder) get(dir Direction) []FrameInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]FrameInfo(nil), r.frames[dir]...)
+}
+
+func TestFrameHook(t *testing.T) {
+	r := &frameRecorder{frames: map[Direction][]FrameInfo{}}
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithFrameHook(r.hook))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = s.Write([]byte("world!"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 6))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+
+	id := c.id
+	assert.Equal(t, []FrameInfo{
+		{Type: FrameData, Channel: id, Flags: SYN},
+		{Type: FrameData, Channel: id, Length: 5},
+	}, r.get(Inbound))
+	assert.Equal(t, []FrameInfo{
+		{Type: FrameData, Channel: id, Flags: ACK},
+		{Type: FrameData, Channel: id, Length: 6},
+	}, r.get(Outbound))
+}
+
+func TestFrameHookVeto(t *testing.T) {
+	errVeto := errors.New("veto")
+	var vetoed uint32 // Channel whose data is vetoed.
+	var vetoPings, vetoSYNs int32
+	hook := WithFrameHook(func(d Direction, f FrameInfo) error {
+		switch {
+		case d == Outbound && f.Type == FramePing && f.Flags&ACK == 0 && atomic.LoadInt32(&vetoPings) != 0,
+			d == Outbound && f.Type == FrameData && f.Flags&SYN != 0 && atomic.LoadInt32(&vetoSYNs) != 0,
+			f.Type == FrameData && f.Length > 0 && f.Channel == atomic.LoadUint32(&vetoed):
+			return errVeto
+		}
+		return nil
+	})
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, hook)
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	// The hook's error is returned by the call that sent the frame.
+	atomic.StoreInt32(&vetoSYNs, 1)
+	_, err := sm.Dial()
+	assert.Equal(t, errVeto, err)
+	atomic.StoreInt32(&vetoSYNs, 0)
+	atomic.StoreInt32(&vetoPings, 1)
+	_, err = sm.Ping(context.Background())
+	assert.Equal(t, errVeto, err)
+	atomic.StoreInt32(&vetoPings, 0)
+
+	c1, err := cm.Dial()
+	assert.NoError(t, err)
+	s1, err := sm.Accept()
+	assert.NoError(t, err)
+	c2, err := cm.Dial()
+	assert.NoError(t, err)
+	s2, err := sm.Accept()
+	assert.NoError(t, err)
+
+	atomic.StoreUint32(&vetoed, s1.ID())
+	// Outbound data is dropped, failing the write.
+	_, err = s1.Write([]byte("hello"))
+	assert.Equal(t, errVeto, err)
+	// Inbound data is dropped.
+	_, err = c1.Write([]byte("dropped"))
+	assert.NoError(t, err)
+
+	// Other channels, and the stream, are unaffected.
+	_, err = s2.Write([]byte("world"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(c2, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+	_, err = sm.Ping(context.Background())
+	assert.NoError(t, err)
+
+	// As is the vetoed channel, once the hook relents.
+	atomic.StoreUint32(&vetoed, 0)
+	_, err = s1.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(c1, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, err = c1.Write([]byte("kept"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s1, b[:4])
+	assert.NoError(t, err)
+	assert.Equal(t, "kept", string(b[:4]))
+	assert.NoError(t, sm.Err())
+	assert.NoError(t, cm.Err())
+}
+
+func TestFrameHookVetoWindow(t *testing.T) {
+	// Vetoed data still uses, and is granted back, window. Window updates
+	// can't be vetoed.
+	var veto int32 = 1
+	hook := WithFrameHook(func(d Direction, f FrameInfo) error {
+		if f.Type == FrameWindowUpdate || d == Inbound && f.Type == FrameData && f.Length > 0 && atomic.LoadInt32(&veto) != 0 {
+			return errors.New("veto")
+		}
+		return nil
+	})
+	sm, cm := newServerAndClient(hook)
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	_, err = c.Write(make([]byte, initialWindow*4))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return s.Stats().BytesReceived == initialWindow*4 })
+	atomic.StoreInt32(&veto, 0)
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestFrameHookVetoControl(t *testing.T) {
+	// Frames the ends wait for, or that keep them in step, go ahead anyway.
+	errVeto := errors.New("veto")
+	var veto int32
+	hook := WithFrameHook(func(d Direction, f FrameInfo) error {
+		if atomic.LoadInt32(&veto) != 0 {
+			return errVeto
+		}
+		return nil
+	})
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, hook)
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	c1, err := cm.Dial()
+	assert.NoError(t, err)
+	s1, err := sm.Accept()
+	assert.NoError(t, err)
+	c2, err := cm.Dial()
+	assert.NoError(t, err)
+	s2, err := sm.Accept()
+	assert.NoError(t, err)
+	atomic.StoreInt32(&veto, 1)
+
+	// Channels opened by the peer are refused, rather than left waiting.
+	_, err = cm.Dial()
+	assert.Equal(t, ErrChannelRefused, err)
+	// The peer's pings are answered.
+	_, err = cm.Ping(context.Background())
+	assert.NoError(t, err)
+	// Closing a channel reaches the peer.
+	assert.NoError(t, s1.CloseWrite())
+	_, err = c1.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, s2.Reset())
+	_, err = c2.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrChannelReset), "%s", err)
+	assert.NoError(t, s1.Close())
+	waitFor(t, func() bool { return cm.NumChannels() == 0 && sm.NumChannels() == 0 })
+
+	// Vetoes of frames that can be vetoed are returned.
+	assert.Equal(t, errVeto, sm.GoAway())
+	assert.False(t, cm.GoingAway())
+	_, err = sm.Ping(context.Background())
+	assert.Equal(t, errVeto, err)
+	_, err = sm.Dial()
+	assert.Equal(t, errVeto, err)
+	assert.NoError(t, sm.Err())
+	assert.NoError(t, cm.Err())
+}
+
+func TestSlowFrameHook(t *testing.T) {
+	// A hook stuck on one channel's frames doesn't hold up another's.
+	var stalled uint32
+	release := make(chan struct{})
+	hook := WithFrameHook(func(d Direction, f FrameInfo) error {
+		if d == Outbound && f.Type == FrameData && f.Length > 0 && f.Channel == atomic.LoadUint32(&stalled) {
+			<-release
+		}
+		return nil
+	})
+	sm, cm := newServerAndClient(hook)
+	defer sm.Close()
+	defer cm.Close()
+
+	c1, err := cm.Dial()
+	assert.NoError(t, err)
+	c2, err := cm.Dial()
+	assert.NoError(t, err)
+	s1, err := sm.Accept()
+	assert.NoError(t, err)
+	s2, err := sm.Accept()
+	assert.NoError(t, err)
+
+	atomic.StoreUint32(&stalled, c1.ID())
+	written := make(chan error, 1)
+	go func() {
+		_, err := c1.Write([]byte("slow"))
+		written <- err
+	}()
+
+	_, err = c2.Write([]byte("fast"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(s2, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", string(b))
+
+	close(release)
+	assert.NoError(t, <-written)
+	_, err = io.ReadFull(s1, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "slow", string(b))
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/tomb.v1"
+)
+
+// Record that a packet has been sent or received.
+func (m *MultiplexedStream) touch() {
+	if m.config.idleTimeout > 0 {
+		atomic.StoreInt64(&m.active, m.config.clock.Now().UnixNano())
+	}
+}
+
+// Granularity of LastActivity. The time is only stored once it has moved on
+// this far, sparing the reader and writer from contending to store it for
+// every frame.
+const activityResolution = time.Millisecond
+
+// LastActivity returns when channel data, including the opening and closing
+// of channels, or a ping, was last sent or received, to within a millisecond.
+// If there has been none, it is when the stream was created. Window updates
+// and other control frames aren't activity.
+//
+// Pings are excluded by WithoutPingActivity.
+func (m *MultiplexedStream) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&m.activity))
+}
+
+// Record that a packet of type typ has been sent or received, for
+// LastActivity.
+func (m *MultiplexedStream) recordActivity(typ uint8) {
+	if typ != typeData && (typ != typePing || m.config.ignorePings) {
+		return
+	}
+	now := m.config.clock.Now().UnixNano()
+	if now-atomic.LoadInt64(&m.activity) >= int64(activityResolution) {
+		atomic.StoreInt64(&m.activity, now)
+	}
+}
+
+// Close the stream once no packets have been sent or received for the idle
+// timeout.
+func (m *MultiplexedStream) idle() {
+	defer m.workers.Done()
+	for {
+		active := time.Unix(0, atomic.LoadInt64(&m.active))
+		wait := active.Add(m.config.idleTimeout).Sub(m.config.clock.Now())
+		if wait <= 0 {
+			m.emit(EventIdleTimeout, 0, ErrIdleTimeout)
+			m.log(levelWarn, "idle timeout", "timeout", m.config.idleTimeout)
+			m.kill(ErrIdleTimeout)
+			return
+		}
+		select {
+		case <-m.config.clock.After(wait):
+		case <-m.tomb.Dying():
+			return
+		}
+	}
+}
+
+// SetIdleTimeout closes the channel with ErrIdleTimeout if it is neither read
+// from nor written to for the duration d. Operations on the peer's end of the
+// channel then fail with ErrIdleTimeout too, after any data already received
+// has been read, unless the peer is too old to be told why the channel closed
+// (see FeatureCloseReasons) and sees it closed as usual. A zero duration
+// disables the timeout.
+//
+// This overrides the timeout configured for the stream with
+// WithChannelIdleTimeout.
+func (c *Channel) SetIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.idleTimeout, int64(d))
+	c.touch()
+	c.armIdleTimer()
+}
+
+// Record that the channel has been read from or written to.
+func (c *Channel) touch() {
+	if atomic.LoadInt64(&c.idleTimeout) > 0 {
+		atomic.StoreInt64(&c.active, c.m.config.clock.Now().UnixNano())
+	}
+}
+
+// Start a timer that fires when the channel's idle timeout may have expired,
+// replacing any existing timer. Channels without a timeout have no timer.
+func (c *Channel) armIdleTimer() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopIdleTimer()
+	timeout := time.Duration(atomic.LoadInt64(&c.idleTimeout))
+	if timeout <= 0 || c.tomb.Err() != tomb.ErrStillAlive {
+		return
+	}
+	active := time.Unix(0, atomic.LoadInt64(&c.active))
+	c.idleTimer = c.m.config.clock.AfterFunc(active.Add(timeout).Sub(c.m.config.clock.Now()), c.checkIdle)
+}
+
+// Must be called with the lock held.
+func (c *Channel) stopIdleTimer() {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+}
+
+// Close the channel if it has been idle for too long, otherwise wait until it
+// may have been.
+func (c *Channel) checkIdle() {
+	if c.isIdle() {
+		c.closeWithReason(closeIdleTimeout)
+		c.kill(ErrIdleTimeout)
+		return
+	}
+	c.armIdleTimer()
+}
+
+// Reasons for closing a channel, sent as the payload of an RST with the
+// REASON flag.
+const (
+	closeIdleTimeout = iota + 1
+)
+
+// Tell the peer why the channel is being closed, if it understands, and no
+// other reason has been given.
+func (c *Channel) closeWithReason(reason uint32) {
+	if !c.m.PeerFeatures().Has(FeatureCloseReasons) {
+		return
+	}
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, reason)
+	c.lock.Lock()
+	if c.reason == nil {
+		c.reason = payload
+		c.resetFlags = REASON
+	}
+	c.lock.Unlock()
+}
+
+// The error a channel closed by the peer for a reason fails with. Reasons
+// added by newer peers are treated as an ordinary close.
+func closeReasonError(payload []byte) error {
+	if len(payload) >= 4 && binary.BigEndian.Uint32(payload) == closeIdleTimeout {
+		return ErrIdleTimeout
+	}
+	return io.EOF
+}
+
+func (c *Channel) isIdle() bool {
+	timeout := time.Duration(atomic.LoadInt64(&c.idleTimeout))
+	if timeout <= 0 {
+		return false
+	}
+	active := time.Unix(0, atomic.LoadInt64(&c.active))
+	return c.m.config.clock.Now().Sub(active) >= timeout
+}
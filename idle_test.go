@@ -0,0 +1,197 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/multiplex/multiplextest"
+	"github.com/stretchrcom/testify/assert"
+	"gopkg.in/tomb.v1"
+)
+
+var _ Clock = (*multiplextest.Clock)(nil)
+
+func newFakeClock() *multiplextest.Clock {
+	return multiplextest.NewClock(time.Unix(1000000000, 0))
+}
+
+// Advance the clock a second at a time until condition is true. Stepping avoids
+// racing with goroutines that compute a timer duration just before the clock
+// moves.
+func advanceUntil(t *testing.T, clock *multiplextest.Clock, condition func() bool) {
+	for i := 0; i < 1000; i++ {
+		if condition() {
+			return
+		}
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithIdleTimeout(time.Minute), WithClock(clock))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer cm.Close()
+
+	_, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Traffic resets the timer.
+	clock.Advance(time.Second * 30)
+	_, err = cm.Ping(context.Background())
+	assert.NoError(t, err)
+	clock.Advance(time.Second * 45)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, tomb.ErrStillAlive, sm.tomb.Err())
+
+	advanceUntil(t, clock, func() bool { return sm.tomb.Err() != tomb.ErrStillAlive })
+	_, err = sm.Accept()
+	assert.Equal(t, ErrIdleTimeout, err)
+	_, err = s.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrIdleTimeout), "%s", err)
+	_, err = sm.Dial()
+	assert.Equal(t, ErrIdleTimeout, err)
+}
+
+func TestChannelIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithChannelIdleTimeout(time.Minute), WithClock(clock))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer cm.Close()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+	forever, err := sm.Accept()
+	assert.NoError(t, err)
+	forever.SetIdleTimeout(0)
+
+	// Activity resets the timer.
+	clock.Advance(time.Second * 30)
+	_, err = s.Write([]byte("PING"))
+	assert.NoError(t, err)
+	clock.Advance(time.Second * 45)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, tomb.ErrStillAlive, s.tomb.Err())
+
+	advanceUntil(t, clock, func() bool { return s.tomb.Err() != tomb.ErrStillAlive })
+	_, err = s.Read(make([]byte, 4))
+	assert.True(t, errors.Is(err, ErrIdleTimeout), "%s", err)
+
+	// The peer is told why, after any data sent before it.
+	b, err := ioutil.ReadAll(c)
+	assert.True(t, errors.Is(err, ErrIdleTimeout), "%s", err)
+	assert.Equal(t, "PING", string(b))
+	_, err = c.Write([]byte("PONG"))
+	assert.True(t, errors.Is(err, ErrIdleTimeout), "%s", err)
+
+	// Overridden channels and the stream itself are unaffected.
+	assert.Equal(t, tomb.ErrStillAlive, forever.tomb.Err())
+	assert.Equal(t, tomb.ErrStillAlive, sm.tomb.Err())
+}
+
+func TestChannelIdleTimeoutOldPeer(t *testing.T) {
+	// A peer that can't be told why sees an ordinary close.
+	clock := newFakeClock()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithChannelIdleTimeout(time.Minute), WithClock(clock))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithoutFeatures(FeatureCloseReasons))
+	defer cm.Close()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	advanceUntil(t, clock, func() bool { return s.tomb.Err() != tomb.ErrStillAlive })
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLastActivity(t *testing.T) {
+	for _, ignorePings := range []bool{false, true} {
+		clock := newFakeClock()
+		options := []Option{WithClock(clock)}
+		if ignorePings {
+			options = append(options, WithoutPingActivity())
+		}
+		sm, cm := newServerAndClient(options...)
+		created := clock.Now()
+		_, err := cm.Ping(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, created, sm.LastActivity())
+
+		clock.Advance(time.Second)
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, created.Add(time.Second), cm.LastActivity())
+		assert.Equal(t, created.Add(time.Second), sm.LastActivity())
+
+		clock.Advance(time.Second)
+		_, err = cm.Ping(context.Background())
+		assert.NoError(t, err)
+		if ignorePings {
+			assert.Equal(t, created.Add(time.Second), cm.LastActivity())
+			assert.Equal(t, created.Add(time.Second), sm.LastActivity())
+		} else {
+			assert.Equal(t, created.Add(2*time.Second), cm.LastActivity())
+			assert.Equal(t, created.Add(2*time.Second), sm.LastActivity())
+		}
+
+		clock.Advance(time.Second)
+		go c.Write([]byte("hello"))
+		_, err = io.ReadFull(s, make([]byte, 5))
+		assert.NoError(t, err)
+		assert.Equal(t, created.Add(3*time.Second), sm.LastActivity())
+		waitFor(t, func() bool { return cm.LastActivity().Equal(created.Add(3 * time.Second)) })
+
+		sm.Close()
+		cm.Close()
+	}
+}
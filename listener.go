@@ -0,0 +1,103 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"net"
+
+	"gopkg.in/tomb.v1"
+)
+
+// Listener returns a net.Listener that accepts channels from the stream.
+//
+// Closing the listener closes the stream.
+func (m *MultiplexedStream) Listener() net.Listener {
+	return &listener{m}
+}
+
+type listener struct {
+	m *MultiplexedStream
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	ch, err := l.m.Accept()
+	if err != nil {
+		if l.m.tomb.Err() != tomb.ErrStillAlive {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (l *listener) Close() error {
+	l.m.Close()
+	return nil
+}
+
+// Addr returns the local address of the underlying transport, if it has one.
+func (l *listener) Addr() net.Addr {
+	if addr := l.m.localAddr(); addr != nil {
+		return addr
+	}
+	return &Addr{}
+}
+
+// NetDialer returns a function suitable for use as http.Transport.DialContext
+// (and similar), that dials a new channel on the stream.
+//
+// The network and address arguments are ignored.
+func (m *MultiplexedStream) NetDialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ch, err := m.DialContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return ch, nil
+	}
+}
+
+// Local address of the underlying transport, or nil.
+func (m *MultiplexedStream) localAddr() net.Addr {
+	if conn, ok := m.conn.(interface {
+		LocalAddr() net.Addr
+	}); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// Remote address of the underlying transport, or nil.
+func (m *MultiplexedStream) remoteAddr() net.Addr {
+	if conn, ok := m.conn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
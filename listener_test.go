@@ -0,0 +1,104 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestListenerHTTP(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+
+	served := make(chan error)
+	go func() {
+		served <- http.Serve(sm.Listener(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello %s", r.URL.Path)
+		}))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return cm.Dial()
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(fmt.Sprintf("http://multiplex/%d", i))
+		assert.NoError(t, err)
+		if err != nil {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("hello /%d", i), string(body))
+	}
+
+	sm.Close()
+	err := <-served
+	assert.True(t, errors.Is(err, net.ErrClosed))
+}
+
+func TestNetDialerHTTP(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+	defer sm.Close()
+
+	go http.Serve(sm.Listener(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Host, body)
+	}))
+
+	client := &http.Client{Transport: &http.Transport{DialContext: cm.NetDialer()}}
+	resp, err := client.Post("http://backend/", "text/plain", strings.NewReader("ping"))
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "backend ping", string(body))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cm.NetDialer()(ctx, "tcp", "backend:80")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestListenerAddr(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+	defer sm.Close()
+	assert.Equal(t, "multiplex", sm.Listener().Addr().Network())
+}
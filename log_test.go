@@ -0,0 +1,98 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// A Logger that records messages as strings.
+type recordingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (r *recordingLogger) record(level, msg string, args []interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := level + " " + msg
+	for i := 0; i+1 < len(args); i += 2 {
+		s += fmt.Sprintf(" %s=%v", args[i], args[i+1])
+	}
+	r.messages = append(r.messages, s)
+}
+
+func (r *recordingLogger) Debug(msg string, args ...interface{}) { r.record("DEBUG", msg, args) }
+func (r *recordingLogger) Info(msg string, args ...interface{})  { r.record("INFO", msg, args) }
+func (r *recordingLogger) Warn(msg string, args ...interface{})  { r.record("WARN", msg, args) }
+func (r *recordingLogger) Error(msg string, args ...interface{}) { r.record("ERROR", msg, args) }
+
+func (r *recordingLogger) get() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithLogger(logger), WithRejectUnknownServices(), WithSessionID("abc"))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer cm.Close()
+
+	_, err := cm.DialService("unknown")
+	assert.Equal(t, ErrUnknownService, err)
+	assert.NoError(t, sm.Close())
+
+	assert.Equal(t, []string{
+		"INFO session started session_id=abc role=server",
+		"INFO channel refused session_id=abc channel_id=3 error=unknown service",
+		"INFO session closed session_id=abc",
+	}, logger.get())
+}
+
+func TestLoggerProtocolError(t *testing.T) {
+	logger := &recordingLogger{}
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithLogger(logger), WithSessionID("abc"))
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	go writeFrame(cw, typePing, 0, 0, nil)
+	waitFor(t, func() bool { return len(logger.get()) == 2 })
+	messages := logger.get()
+	assert.True(t, strings.HasPrefix(messages[0], "ERROR protocol error session_id=abc error="+ErrProtocol.Error()), messages[0])
+	assert.True(t, strings.HasPrefix(messages[1], "WARN session failed session_id=abc error="+ErrProtocol.Error()), messages[1])
+}
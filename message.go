@@ -0,0 +1,173 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+const defaultMaxMessageSize = 1024 * 1024
+
+// Whether a direction of a channel is used as a stream or for messages.
+const (
+	modeUnset = iota
+	modeStream
+	modeMessage
+)
+
+// Fix the mode of a direction of a channel on first use.
+func useMode(mode *uint32, want uint32) error {
+	if atomic.LoadUint32(mode) == want || atomic.CompareAndSwapUint32(mode, modeUnset, want) || atomic.LoadUint32(mode) == want {
+		return nil
+	}
+	return ErrMixedMessages
+}
+
+// WritePart writes b as Write does, and if end is true also marks the end of
+// a message, so that the peer's ReadPart stops there. A message may be written
+// with any number of calls, and is split into packets as any other data, so
+// its boundaries survive fragmentation. The end of a message may be marked
+// with no data, such as after writing a message with Write.
+//
+// Ending a message fails with ErrMessagesUnsupported if the peer doesn't
+// support FeatureMessages.
+func (c *Channel) WritePart(b []byte, end bool) (int, error) {
+	if end {
+		if err := c.m.awaitSettings(context.Background()); err != nil {
+			return 0, err
+		}
+		if !c.m.PeerFeatures().Has(FeatureMessages) {
+			return 0, ErrMessagesUnsupported
+		}
+	}
+	return c.write(b, end)
+}
+
+// WriteMessage writes b as a single message, to be read whole by the peer's
+// ReadMessage. The message is split into packets on the wire as any other
+// data, and concurrent calls don't interleave their messages.
+//
+// A channel written to with WriteMessage can't be written to with Write, and
+// vice versa: the second to be used fails with ErrMixedMessages. Messages
+// larger than the limit set with WithMaxMessageSize fail with
+// ErrMessageTooLarge.
+func (c *Channel) WriteMessage(b []byte) error {
+	if err := useMode(&c.writeMode, modeMessage); err != nil {
+		return err
+	}
+	if len(b) > c.m.config.maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	c.messageLock.Lock()
+	defer c.messageLock.Unlock()
+	_, err := c.WritePart(b, true)
+	return err
+}
+
+// ReadMessage returns the next message written by the peer with WriteMessage,
+// or ended with WritePart. It must not be called concurrently.
+//
+// A channel read from with ReadMessage can't be read from with Read, and vice
+// versa: the second to be used fails with ErrMixedMessages. Messages larger
+// than the limit set with WithMaxMessageSize are discarded without being
+// buffered, and ReadMessage returns ErrMessageTooLarge; the next call returns
+// the following message. If the read deadline expires part way through a
+// message, the next call resumes where it left off. A message left incomplete
+// by the peer closing the channel fails with io.ErrUnexpectedEOF.
+func (c *Channel) ReadMessage() ([]byte, error) {
+	if err := useMode(&c.readMode, modeMessage); err != nil {
+		return nil, err
+	}
+	if err := c.m.awaitSettings(context.Background()); err != nil {
+		return nil, err
+	}
+	if !c.m.PeerFeatures().Has(FeatureMessages) {
+		return nil, ErrMessagesUnsupported
+	}
+
+	max := c.m.config.maxMessageSize
+	msg := c.message
+	c.message = nil
+	var scratch []byte
+	for {
+		var b []byte
+		if c.skipping {
+			if scratch == nil {
+				scratch = make([]byte, FragmentSize)
+			}
+			b = scratch
+		} else {
+			if len(msg) == cap(msg) {
+				size := 2*cap(msg) + FragmentSize
+				if size > max+1 {
+					size = max + 1
+				}
+				grown := make([]byte, len(msg), size)
+				copy(grown, msg)
+				msg = grown
+			}
+			b = msg[len(msg):cap(msg)]
+		}
+
+		n, _, end, err := c.read(b, readPart)
+		if !c.skipping {
+			msg = msg[:len(msg)+n]
+			if len(msg) > max {
+				c.skipping = true
+				msg = nil
+			}
+		}
+		if end {
+			if c.skipping {
+				c.skipping = false
+				return nil, ErrMessageTooLarge
+			}
+			return msg, nil
+		}
+		if err != nil {
+			c.message = msg
+			if err == io.EOF && (len(msg) > 0 || c.skipping) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// ReadPart reads data as Read does, but stops at the end of each message
+// marked by the peer's WritePart, and reports whether the data read completes
+// a message. A message of zero bytes is read as 0 bytes with end true.
+//
+// Read ignores the ends of messages, so the two can be mixed if boundaries
+// within data read with Read don't matter. ReadPart and WritePart may be used
+// along with both stream and message IO.
+func (c *Channel) ReadPart(b []byte) (n int, end bool, err error) {
+	n, _, end, err = c.read(b, readPart)
+	return n, end, err
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestReadQueueMessages(t *testing.T) {
+	q := &readQueue{}
+	for _, m := range []string{"hello", "", "world"} {
+		buf := getBuffer(len(m))
+		if !q.write(buf, (*buf)[:copy(*buf, m)], true) {
+			putBuffer(buf)
+		}
+	}
+
+	b := make([]byte, 3)
+	n, end := q.readPart(b)
+	assert.Equal(t, "hel", string(b[:n]))
+	assert.False(t, end)
+	n, end = q.readPart(b)
+	assert.Equal(t, "lo", string(b[:n]))
+	assert.True(t, end)
+	n, end = q.readPart(b)
+	assert.Equal(t, 0, n)
+	assert.True(t, end)
+
+	// Read skips the ends it passes.
+	assert.Equal(t, 3, q.read(b))
+	assert.Equal(t, 1, len(q.ends))
+	assert.Equal(t, 2, q.read(b))
+	assert.Equal(t, 0, len(q.ends))
+}
+
+func TestHeaderFlags(t *testing.T) {
+	var b [headerSize]byte
+	hdr := header{Type: typeData, Flags: FIN, ID: 1, Length: uint32(EOM>>8)<<24 | 5}
+	hdr.encode(b[:])
+	var decoded header
+	decoded.decode(b[:])
+	assert.Equal(t, uint16(FIN|EOM), decoded.flags())
+	assert.Equal(t, uint32(5), decoded.length())
+}
+
+func TestWritePart(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Larger than a frame, so the end survives fragmentation.
+	big := make([]byte, FragmentSize*3+1)
+	go func() {
+		c.WritePart([]byte("hel"), false)
+		c.WritePart([]byte("lo"), true)
+		c.WritePart(nil, true)
+		c.WritePart(big, true)
+		c.Close()
+	}()
+
+	read := func() (string, error) {
+		var msg []byte
+		b := make([]byte, 256)
+		for {
+			n, end, err := s.ReadPart(b)
+			msg = append(msg, b[:n]...)
+			if end || err != nil {
+				return string(msg), err
+			}
+		}
+	}
+	msg, err := read()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg)
+	msg, err = read()
+	assert.NoError(t, err)
+	assert.Equal(t, "", msg)
+	msg, err = read()
+	assert.NoError(t, err)
+	assert.Equal(t, string(big), msg)
+	_, err = read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWritePartCoalesced(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Coalesced data is sent before the end of the message.
+	c.SetNoDelay(false)
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = c.WritePart([]byte(" world"), true)
+	assert.NoError(t, err)
+
+	b := make([]byte, 64)
+	var msg []byte
+	for {
+		n, end, err := s.ReadPart(b)
+		assert.NoError(t, err)
+		msg = append(msg, b[:n]...)
+		if end {
+			break
+		}
+	}
+	assert.Equal(t, "hello world", string(msg))
+}
+
+func TestWritePartUnsupported(t *testing.T) {
+	sm, cm := newServerAndClient(WithoutFeatures(FeatureMessages))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.WritePart([]byte("hello"), true)
+	assert.Equal(t, ErrMessagesUnsupported, err)
+	_, err = c.WritePart([]byte("hello"), false)
+	assert.NoError(t, err)
+}
+
+func TestMessages(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	big := make([]byte, FragmentSize*5+3)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	messages := [][]byte{[]byte("hello"), {}, big, []byte("world")}
+	go func() {
+		for _, msg := range messages {
+			c.WriteMessage(msg)
+		}
+		c.Close()
+	}()
+
+	for _, expected := range messages {
+		msg, err := s.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, msg)
+	}
+	_, err = s.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMessagesConcurrent(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Each message spans several packets, and is received whole.
+	const writers = 4
+	for i := 0; i < writers; i++ {
+		go c.WriteMessage(bytes.Repeat([]byte{byte(i)}, FragmentSize*3))
+	}
+	for i := 0; i < writers; i++ {
+		msg, err := s.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat(msg[:1], len(msg)), msg)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	sm, cm := newServerAndClient(WithMaxMessageSize(FragmentSize * 2))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrMessageTooLarge, c.WriteMessage(make([]byte, FragmentSize*2+1)))
+
+	// Too large for the reader, which skips to the next message.
+	go func() {
+		c.WritePart(make([]byte, FragmentSize*3), true)
+		c.WriteMessage([]byte("hello"))
+	}()
+	_, err = s.ReadMessage()
+	assert.Equal(t, ErrMessageTooLarge, err)
+	msg, err := s.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestMessageResumedAfterTimeout(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	_, err = c.WritePart([]byte("hel"), false)
+	assert.NoError(t, err)
+	waitFor(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.rbuf.Len() == 3
+	})
+	s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = s.ReadMessage()
+	assert.Equal(t, errTimeout, err)
+
+	s.SetReadDeadline(time.Time{})
+	_, err = c.WritePart([]byte("lo"), true)
+	assert.NoError(t, err)
+	msg, err := s.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestMessageIncomplete(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	c.WritePart([]byte("hel"), false)
+	c.Close()
+	_, err = s.ReadMessage()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestMessagesReadAfterSessionClosed(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, c.WriteMessage(bytes.Repeat([]byte{byte(i)}, 100+i)))
+	}
+	waitFor(t, func() bool { return sm.Buffered() == 10*100+45 })
+	cm.Close()
+	waitFor(t, func() bool { return sm.Err() != nil })
+
+	for i := 0; i < 10; i++ {
+		msg, err := s.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 100+i), msg)
+	}
+	_, err = s.ReadMessage()
+	assert.True(t, errors.Is(err, ErrSessionClosed), "%v", err)
+}
+
+func TestMixedMessages(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.WriteMessage([]byte("hello")))
+	_, err = c.Write([]byte("hello"))
+	assert.Equal(t, ErrMixedMessages, err)
+	_, err = c.ReadFrom(bytes.NewReader(nil))
+	assert.Equal(t, ErrMixedMessages, err)
+
+	_, err = s.Read(make([]byte, 5))
+	assert.NoError(t, err)
+	_, err = s.ReadMessage()
+	assert.Equal(t, ErrMixedMessages, err)
+}
@@ -36,9 +36,11 @@
 // An interesting side-effect of this multiplexing is that once the underlying
 // connection has been established, each end of the connection can both
 // `Accept()` and `Dial()`. This allows for elegant push notifications and
-// other interesting approaches.
+// other interesting approaches. The server and client roles only decide which
+// IDs each end gives the channels it opens, so that channels opened by both
+// ends at once can't collide.
 //
-// Documentation
+// # Documentation
 //
 // Can be found  on [godoc.org](http://godoc.org/github.com/alecthomas/multiplex) or below.
 //
@@ -56,7 +58,7 @@
 //	    }()
 //	}
 //
-// Example Client
+// # Example Client
 //
 // Connect to a server with a single TCP connection, then create 10K channels
 // over it and write "hello" to each.
@@ -71,14 +73,76 @@
 //	        c.Close()
 //	    }()
 //	}
+//
+// # Protocol
+//
+// Each end first sends an 8 byte handshake: the magic bytes "MPLX", the
+// protocol version as a big-endian 16 bit integer, currently 3, the
+// Compression it uses, and a flags byte whose lowest bit says whether it uses
+// checksums. The stream fails if the peer's handshake is missing or its
+// version, compression or flags differ. With compression, the payloads of data
+// packets are compressed as a single stream, each flushed so that it can be
+// decompressed on arrival. They are then transformed, such as encrypted, if
+// the ends are configured to (see WithTransform).
+//
+// Each packet on the wire is a 10 byte big-endian header (type, flags,
+// channel ID, payload length) followed by the payload and, with checksums, a
+// big-endian CRC-32C of both. Each end next sends a settings packet, a list of
+// 2 byte setting IDs each followed by a 4 byte value, which carries:
+//
+//   - the largest payload it accepts,
+//   - the parity of the IDs of the channels it opens, even for servers and
+//     odd for clients,
+//   - the optional Features it supports,
+//   - the largest metadata it accepts with a SYN, and
+//   - its session ID (see ID).
+//
+// Neither end ever sends the other a payload larger than it advertised.
+//
+// A channel is opened with SYN. With the SERVICE flag its payload starts with
+// the length of the service name as a single byte, followed by the name (see
+// DialService), with the COMPRESS flag the name of a codec follows in the same
+// form (see WithChannelCompression), and with the META flag the rest of the
+// payload is metadata (see WithMetadata). The peer accepts the codec with
+// ACK|COMPRESS, after which data packets flagged COMPRESS are compressed. A
+// channel is closed either abruptly with RST, or one direction at a time with
+// FIN. Once a channel has been queued for Accept, its end acknowledges it with
+// ACK, if its settings say that it does. An RST may carry a 4 byte error code
+// followed by a message as its payload, and with the ABORT flag also tells the
+// peer to discard unread data. With the REFUSE flag it instead tells the peer
+// that a channel it opened was never created, with a 4 byte reason code as its
+// payload, followed by an application-defined code and message if the channel
+// was rejected by an accept filter. With the REASON flag its payload is
+// instead a 4 byte code saying why an open channel was closed, if the peer
+// supports FeatureCloseReasons.
+//
+// Payloads are at most 24 bits long, so the top byte of the length holds
+// further flags. EOM marks the last packet of a message, if the peer supports
+// FeatureMessages.
+//
+// Packet types from 0x80 up are reserved for applications (see
+// RegisterExtension). Packets of unknown types are skipped.
+//
+// Channels are flow controlled: a peer may only send as much data as the
+// receiving end has granted it, initially 64KB per channel, and more is granted
+// with window update packets as the application reads. A slow reader thus only
+// stalls writers on its own channel. Each end advertises its full receive
+// window (see WithDefaultWindow) once the channel is dialled or accepted.
+//
+// The introduction of flow control changed the wire format incompatibly, so
+// both ends of a connection must be upgraded together.
 package multiplex
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"gopkg.in/tomb.v1"
 )
@@ -87,288 +151,2004 @@ import (
 const (
 	SYN = 1 << iota
 	RST = 1 << iota
+	ACK = 1 << iota
+	FIN = 1 << iota
+	// ABORT accompanies RST when the peer should discard data it has
+	// already received.
+	ABORT = 1 << iota
+	// REFUSE accompanies RST when a channel the peer opened was never
+	// created. The payload is the reason.
+	REFUSE = 1 << iota
+	// META accompanies SYN when the payload is the channel's metadata rather
+	// than data.
+	META = 1 << iota
+	// SERVICE accompanies SYN when the payload starts with the name of the
+	// service the channel is for.
+	SERVICE = 1 << iota
+	// EOM marks the last packet of a message (see WritePart). It is sent in
+	// the top byte of the length, which payloads are too small to need.
+	EOM = 1 << iota
+	// COMPRESS accompanies SYN when the payload names a codec to compress
+	// the channel with, ACK when the peer accepts the codec, and data whose
+	// payload the codec has compressed.
+	COMPRESS = 1 << iota
+	// REASON accompanies RST when the payload is a 4 byte code saying why
+	// the channel was closed, such as it being idle.
+	REASON = 1 << iota
+
+	// All flags this end understands.
+	allFlags = REASON<<1 - 1
+)
+
+// Packet types.
+const (
+	typeData = iota
+	typeWindowUpdate
+	typePing
+	typeGoAway
+	typeSettings
 )
 
 const (
-	// FragmentSize (in bytes) of packet fragments.
+	// FragmentSize (in bytes) of packet fragments, unless configured with
+	// WithMaxFrameSize.
 	FragmentSize = 1024
+
+	// Size of each channel's receive window when it is opened.
+	initialWindow = 64 * 1024
+
+	// Upper bound on the configurable size of a packet payload.
+	maxPayloadSize = 0xffffff
+
+	// Size of the header preceding each packet on the wire.
+	headerSize = 10
+
+	// Packets with payloads up to this size are copied so that the header and
+	// payload can be written together, if vectored writes are unsupported.
+	maxCopyWrite = 32 * 1024
 )
 
 var (
 	// ErrInvalidChannel is returned when an attempt is made to write to an invalid channel.
 	ErrInvalidChannel = errors.New("invalid channel")
+	// ErrProtocol is returned when the peer violates the protocol.
+	ErrProtocol = errors.New("protocol error")
+	// ErrIdleTimeout is returned when a stream or channel is closed due to inactivity.
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrShutdown is returned by Accept and Dial once Shutdown has been called.
+	ErrShutdown = errors.New("stream is shutting down")
+	// ErrInvalidConfig is wrapped by the errors New returns for options that
+	// are incomplete or contradict one another.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrChannelClosed is returned by operations on a channel after it has
+	// been closed locally.
+	ErrChannelClosed error = eofError("channel closed")
+	// ErrSessionClosed is returned by operations on a stream, and its
+	// channels, after the stream has been closed. A *TransportError is
+	// returned instead if the transport failed, which is also
+	// ErrSessionClosed.
+	ErrSessionClosed error = eofError("session closed")
+	// ErrChannelReset is returned by operations on a channel after the peer
+	// called Reset.
+	ErrChannelReset = errors.New("channel reset by peer")
+	// ErrGoAway is returned by Dial once the peer has called GoAway.
+	ErrGoAway = errors.New("peer is going away")
+	// ErrChannelIDsExhausted is returned by Dial once every channel ID has
+	// been used. IDs are never reused, so a new stream is needed.
+	ErrChannelIDsExhausted = errors.New("channel IDs exhausted")
+	// ErrTooManyChannels is returned by Dial when the limit set with
+	// WithMaxChannels has been reached, and by operations on a channel the
+	// peer refused because it had reached its own limit.
+	ErrTooManyChannels = errors.New("too many channels")
+	// ErrBusy is returned by operations on a channel the peer refused because
+	// its accept backlog was full (see WithAcceptBacklog).
+	ErrBusy = errors.New("peer is busy")
+	// ErrRateLimited is returned by operations on a channel the peer refused
+	// because channels were being opened faster than it allows (see
+	// WithOpenRateLimit). As with ErrBusy, the channel can be opened again
+	// after backing off.
+	ErrRateLimited = errors.New("peer is rate limiting channels")
+	// ErrChannelRefused is returned by operations on a channel the peer
+	// refused to create, for a reason not covered by a more specific error.
+	ErrChannelRefused = errors.New("channel refused by peer")
+	// ErrMetadataTooLarge is returned by Dial when the metadata passed with
+	// WithMetadata is larger than MaxMetadataSize, or than the peer accepts.
+	// Older peers accept no metadata at all.
+	ErrMetadataTooLarge = errors.New("channel metadata too large")
+	// ErrServicesUnsupported is returned by Dial when a service is named,
+	// and the peer is too old to understand service names.
+	ErrServicesUnsupported = errors.New("peer does not support named services")
+	// ErrMessagesUnsupported is returned when ending a message, and the peer
+	// is too old to understand message boundaries.
+	ErrMessagesUnsupported = errors.New("peer does not support messages")
+	// ErrMessageTooLarge is returned by WriteMessage and ReadMessage for
+	// messages larger than the limit set with WithMaxMessageSize.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrMixedMessages is returned when a direction of a channel that has
+	// been used with ReadMessage or WriteMessage is used as a stream, or vice
+	// versa.
+	ErrMixedMessages = errors.New("stream and message IO mixed on channel")
+	// ErrBadHandshake is returned by operations on a stream whose peer didn't
+	// start with the handshake, and so is not speaking this protocol.
+	ErrBadHandshake = errors.New("bad handshake")
+	// ErrCompressionMismatch is returned by operations on a stream whose
+	// peer compresses data differently (see WithCompression).
+	ErrCompressionMismatch = errors.New("compression mismatch")
+	// ErrChecksumsMismatch is returned by operations on a stream whose
+	// peer disagrees about whether to use checksums (see WithChecksums).
+	ErrChecksumsMismatch = errors.New("checksums mismatch")
+	// ErrChecksum is returned by operations on a stream, or a channel with
+	// WithChecksumRecovery, when a packet from the peer was corrupted.
+	ErrChecksum = errors.New("packet checksum mismatch")
+	// ErrVersionMismatch is returned by operations on a stream whose peer
+	// speaks a different version of the protocol.
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+	// ErrServiceNameTooLong is returned by Dial for service names longer
+	// than MaxServiceNameLength.
+	ErrServiceNameTooLong = errors.New("service name too long")
+	// ErrUnknownService is returned by AcceptService for services that were
+	// not registered with WithServices or Handle, and by Dial when the peer
+	// refused a channel for such a service (see WithRejectUnknownServices).
+	ErrUnknownService = errors.New("unknown service")
 )
 
+// An error that is also io.EOF, so that callers checking for the end of a
+// channel with errors.Is continue to work.
+type eofError string
+
+func (e eofError) Error() string { return string(e) }
+func (e eofError) Unwrap() error { return io.EOF }
+
+// TransportError is returned by operations on a stream, and its channels, after
+// the underlying transport failed. The stream is closed as a result, so it is
+// also ErrSessionClosed, as reported by errors.Is.
+type TransportError struct {
+	Op  string // "read" or "write".
+	Err error
+}
+
+func (e *TransportError) Error() string        { return "transport " + e.Op + ": " + e.Err.Error() }
+func (e *TransportError) Unwrap() error        { return e.Err }
+func (e *TransportError) Is(target error) bool { return target == ErrSessionClosed }
+
+// Wrap an error from the transport, other than it being closed cleanly.
+func transportError(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &TransportError{Op: op, Err: err}
+}
+
+// ChannelError is returned by operations on a channel after the peer closed it
+// with CloseWithError.
+type ChannelError struct {
+	code    uint32
+	message string
+}
+
+// Code returns the application-defined error code passed to CloseWithError.
+func (e *ChannelError) Code() uint32 { return e.code }
+
+// Message returns the message passed to CloseWithError.
+func (e *ChannelError) Message() string { return e.message }
+
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("channel closed by peer: %s (code %d)", e.message, e.code)
+}
+
+// The error operations on a channel fail with once it is closed, naming the
+// channel.
+type channelErr struct {
+	id  uint32
+	err error
+}
+
+func (e *channelErr) Error() string { return fmt.Sprintf("channel %d: %s", e.id, e.err) }
+
+func (e *channelErr) Unwrap() error { return e.err }
+
+// Wire header preceding each packet payload. The top byte of Length holds
+// flags from EOM up.
+type header struct {
+	Type   uint8
+	Flags  uint8
+	ID     uint32
+	Length uint32
+}
+
+// Encode the header into the first headerSize bytes of b.
+func (h *header) encode(b []byte) {
+	_ = b[headerSize-1]
+	b[0] = h.Type
+	b[1] = h.Flags
+	binary.BigEndian.PutUint32(b[2:], h.ID)
+	binary.BigEndian.PutUint32(b[6:], h.Length)
+}
+
+// Decode the header from the first headerSize bytes of b.
+func (h *header) decode(b []byte) {
+	_ = b[headerSize-1]
+	h.Type = b[0]
+	h.Flags = b[1]
+	h.ID = binary.BigEndian.Uint32(b[2:])
+	h.Length = binary.BigEndian.Uint32(b[6:])
+}
+
+func (h *header) flags() uint16 {
+	return uint16(h.Flags) | uint16(h.Length>>24)<<8
+}
+
+func (h *header) length() uint32 {
+	return h.Length & maxPayloadSize
+}
+
 type packet struct {
+	typ     uint8
 	id      uint32
-	flags   uint8
+	flags   uint16
 	payload []byte
+	ch      *Channel // Local channel that wrote the data, if any.
+	buf     *[]byte  // Pooled buffer backing payload, see newDataPacket.
+	vetoed  bool     // Received, and vetoed by the frame hook (see vetoable).
 }
 
 type MultiplexedStream struct {
+	// 64-bit atomics must come first for alignment on 32-bit platforms.
+	rtt      int64  // Last measured round-trip time, in nanoseconds.
+	nonce    uint64 // Source of ping nonces.
+	buffered int64  // Bytes received on all channels but not yet read.
+	active   int64  // When a packet was last sent or received, in Unix nanoseconds.
+	activity int64  // When channel data or a ping was last sent or received, see LastActivity.
+	unknown  uint64 // Packets of unknown types received, see UnknownPackets.
+	corrupt  uint64 // Packets dropped by WithChecksumRecovery, see CorruptPackets.
+	stray    uint64 // Packets for channels that aren't open, see StrayPackets.
+	stats    streamCounters
+
+	droppedEvents uint64 // See DroppedEvents, atomic.
+	tapDropped    uint64 // See TapDropped, atomic.
+
+	controls [numControlKinds]uint64 // See ControlStats, atomic.
+
 	id       uint32
 	conn     io.ReadWriteCloser
 	tomb     tomb.Tomb
-	channels map[uint32]*Channel
+	workers  sync.WaitGroup // Goroutines other than the writer, see Wait.
+	channels *registry
 	lock     sync.Mutex
-	in       chan *packet
 	out      chan *packet
+	control  chan *packet // Stream control packets, sent ahead of out.
+	sched    *scheduler   // Packets taken from out, awaiting the writer.
 	accept   chan *Channel
+	services map[string]chan *Channel // Accept queues of services, guarded by lock.
+	deadline deadline
+	config   config
+	draining chan struct{} // Closed when Shutdown is called.
+	drain    sync.Once
+
+	frameSize  uint32 // See MaxFrameSize, zero until the peer's settings arrive, atomic.
+	peerParity uint32 // One more than the parity of the peer's channel IDs, zero if unknown, atomic.
+
+	// Buffers only accessed by the writer.
+	hdr  [headerSize]byte
+	iov  [3][]byte   // Header, payload and checksum for vectored writes.
+	bufs net.Buffers // Consumed by vectored writes, points into iov.
+	wbuf []byte      // Small packets are copied here to be written in one go.
+	cbuf []byte      // Payloads compressed by channel codecs.
+	tbuf []byte      // Payloads sealed by the transform.
+	sum  [checksumSize]byte
+
+	compressor   *compressor   // Compresses data we send, only used by the writer.
+	decompressor *decompressor // Decompresses data we receive, only used by the reader.
+
+	strayAt     time.Time // Start of the second strayResets counts, only used by the reader.
+	strayResets int       // RSTs sent for stray packets, only used by the reader.
+
+	controlRates [numControlKinds]*tokenBucket // Limits control packets by kind, only used by the reader.
+
+	lastPeerID uint32 // Highest channel ID opened by the peer, guarded by lock.
+	goneAway   bool   // GoAway has been called, guarded by lock.
+	goingAway  uint32 // The peer has called GoAway, atomic.
+
+	rttAt time.Time        // When rtt was measured, guarded by lock.
+	pings map[uint64]*ping // Outstanding pings, guarded by lock.
+
+	handlers   map[string]func(*Channel) // See Handle, guarded by lock.
+	serving    bool                      // Serve has been called, guarded by lock.
+	extensions map[uint8]func([]byte)    // See RegisterExtension, guarded by lock.
+
+	starveLock sync.Mutex
+	starved    map[*Channel]struct{} // Channels withholding window, guarded by starveLock.
+
+	replyLock sync.Mutex
+	replies   []*packet     // Replies to packets from the peer, guarded by replyLock.
+	replied   chan struct{} // Signalled when replies are queued.
+
+	settled         chan struct{} // Closed when the peer's settings arrive.
+	settle          sync.Once
+	peerFeatures    uint32 // Features the peer supports, atomic.
+	peerMaxMetadata uint32 // Largest metadata the peer accepts, atomic.
+
+	eventLock    sync.Mutex
+	events       chan Event // See Events, nil until it is called, guarded by eventLock.
+	eventsClosed bool       // EventClosed has been sent, guarded by eventLock.
+
+	tapLock sync.Mutex
+	tap     *tap   // See Tap, guarded by tapLock.
+	tapping uint32 // Whether tap is set, atomic.
+
+	dumper    *dumper   // See WithDebugDump, nil if disabled.
+	closeFunc sync.Once // Calls the function of WithCloseFunc.
+
+	sessionID atomic.Value // See ID, a string.
 }
 
-func newMultiplexer(id uint32, conn io.ReadWriteCloser) *MultiplexedStream {
+func newMultiplexer(conn io.ReadWriteCloser, config config) *MultiplexedStream {
+	// Servers open channels with even IDs, and clients with odd IDs.
+	id := uint32(0)
+	if config.role == roleClient {
+		id = 1
+	}
+	if config.noHandshake {
+		config.compression = CompressionNone
+		config.checksums = false
+	}
+	if config.openLimiter == nil && config.openRate > 0 {
+		config.openLimiter = newTokenBucket(config.clock, config.openRate, config.openBurst)
+	}
+	if config.maxRecvSize == 0 {
+		config.maxRecvSize = config.maxFrameSize
+	}
+	if config.compression != CompressionNone || config.features.Has(FeatureChannelCompression) || config.transform != nil {
+		// Leave room for compression and transforms to grow payloads.
+		limit := uint32(maxCompressibleFrameSize)
+		if config.transform != nil {
+			limit -= uint32(config.transform.Overhead())
+		}
+		if config.maxFrameSize > limit {
+			config.maxFrameSize = limit
+		}
+		if config.maxRecvSize > limit {
+			config.maxRecvSize = limit
+		}
+	}
 	m := &MultiplexedStream{
 		id:       id,
 		conn:     conn,
-		channels: make(map[uint32]*Channel),
-		in:       make(chan *packet, 1024),
+		config:   config,
+		channels: newRegistry(),
 		out:      make(chan *packet, 1024),
-		accept:   make(chan *Channel, 64),
+		control:  make(chan *packet, 64),
+		sched:    newScheduler(),
+		pings:    make(map[uint64]*ping),
+		starved:  make(map[*Channel]struct{}),
+		accept:   make(chan *Channel, config.acceptBacklog),
+		services: make(map[string]chan *Channel),
+		draining: make(chan struct{}),
+		replied:  make(chan struct{}, 1),
+		settled:  make(chan struct{}),
+	}
+	for _, service := range config.services {
+		m.services[service] = make(chan *Channel, config.acceptBacklog)
+	}
+	if config.debugDump != nil {
+		m.dumper = &dumper{w: config.debugDump}
+	}
+	if config.compression == CompressionFlate {
+		m.compressor = newCompressor()
+		m.decompressor = newDecompressor()
 	}
+	sessionID := config.sessionID
+	if sessionID == "" {
+		sessionID = newSessionID()
+	}
+	m.sessionID.Store(sessionID)
+	m.activity = config.clock.Now().UnixNano()
+	m.sendSettings()
+	m.workers.Add(1)
 	go m.reader()
 	go m.run()
+	if m.config.idleTimeout > 0 {
+		m.touch()
+		m.workers.Add(1)
+		go m.idle()
+	}
+	if m.config.maxWindow > 0 {
+		m.measureRTT()
+	}
 	return m
 }
 
-// MultiplexedServer creates a new multiplexed server-side stream.
-func MultiplexedServer(conn io.ReadWriteCloser) *MultiplexedStream {
-	return newMultiplexer(0, conn)
+// New creates a multiplexed stream over conn, configured by options. One end
+// of a stream must be a server and the other a client, so options must
+// include WithServer or WithClient.
+//
+// Options are applied in order, so later options override earlier ones. An
+// error wrapping ErrInvalidConfig, naming the option at fault and the values
+// it accepts, is returned if conn is nil, an option is given a value outside
+// of its range, or options contradict one another.
+func New(conn io.ReadWriteCloser, options ...Option) (*MultiplexedStream, error) {
+	if conn == nil {
+		return nil, errNilConn
+	}
+	config := newConfig(options)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return newMultiplexer(conn, config), nil
+}
+
+// MultiplexedServer creates a new multiplexed server-side stream. It is New
+// with WithServer, except that it can't fail: values outside of an option's
+// range are replaced by the nearest valid value, contradictory options are
+// resolved as documented for each, and a nil conn fails the stream.
+//
+// Either end of a stream may Dial: the server opens channels with even IDs and
+// the client with odd IDs, so one end must be a server and the other a client.
+func MultiplexedServer(conn io.ReadWriteCloser, options ...Option) *MultiplexedStream {
+	if conn == nil {
+		conn = nilConn{}
+	}
+	config := newConfig(options)
+	config.role = roleServer
+	return newMultiplexer(conn, config)
 }
 
-// MultiplexedClient creates a new multiplexed client-side stream.
-func MultiplexedClient(conn io.ReadWriteCloser) *MultiplexedStream {
-	return newMultiplexer(1, conn)
+// MultiplexedClient creates a new multiplexed client-side stream. It is New
+// with WithClient, except that options are not validated.
+func MultiplexedClient(conn io.ReadWriteCloser, options ...Option) *MultiplexedStream {
+	if conn == nil {
+		conn = nilConn{}
+	}
+	config := newConfig(options)
+	config.role = roleClient
+	return newMultiplexer(conn, config)
 }
 
-// Read packets from the connection and feed them into the in channel.
+var errNilConn = fmt.Errorf("%w: conn is nil", ErrInvalidConfig)
+
+// Stands in for a nil conn passed to the legacy constructors, failing the
+// stream rather than panicking.
+type nilConn struct{}
+
+func (nilConn) Read([]byte) (int, error)  { return 0, errNilConn }
+func (nilConn) Write([]byte) (int, error) { return 0, errNilConn }
+func (nilConn) Close() error              { return nil }
+
+// Read packets from the connection and dispatch them to channels.
 func (m *MultiplexedStream) reader() {
-	var err error
+	defer m.workers.Done()
+	var (
+		err error
+		p   packet
+		hdr header
+		raw [headerSize]byte
+		sum [checksumSize]byte
+	)
 
-	for m.tomb.Err() == tomb.ErrStillAlive {
-		var flags uint8
-		var id, size uint32
-		if err = binary.Read(m.conn, binary.BigEndian, &id); err != nil {
+	if !m.config.noHandshake {
+		err = m.readHandshake()
+	}
+	transform := m.config.transform
+	for err == nil && m.tomb.Err() == tomb.ErrStillAlive {
+		if _, err = io.ReadFull(m.conn, raw[:]); err == nil {
+			err = m.fault(faultRead)
+		}
+		if err != nil {
+			err = transportError("read", err)
 			break
 		}
-		if err = binary.Read(m.conn, binary.BigEndian, &size); err != nil {
+		hdr.decode(raw[:])
+		length := hdr.length()
+		// Compression and transforms may grow payloads a little.
+		limit := m.config.maxRecvSize
+		if hdr.flags()&COMPRESS != 0 {
+			limit = compressedSize(limit)
+		}
+		compressedLimit := limit
+		if m.decompressor != nil {
+			compressedLimit = compressedSize(limit)
+		}
+		wireLimit := compressedLimit
+		if transform != nil {
+			wireLimit += uint32(transform.Overhead())
+		}
+		if length > wireLimit {
+			err = fmt.Errorf("%w: packet of %d bytes on channel %d exceeds the maximum of %d", ErrProtocol, length, hdr.ID, wireLimit)
 			break
 		}
-		flags = uint8(size >> 24)
-		size = size & 0xffffff
 
-		payload := make([]byte, size)
-		_, err = io.ReadFull(m.conn, payload)
-		if err != nil {
+		// Channels may keep the buffer of data they receive. Nothing else is
+		// retained once it has been dispatched, so the buffer is reused.
+		var buf *[]byte
+		var payload []byte
+		if length > 0 {
+			buf = getBuffer(int(length))
+			payload = (*buf)[:length]
+		}
+		if err = readRest(m.conn, payload); err != nil {
+			err = transportError("read", err)
 			break
 		}
+		var trailer []byte
+		if m.config.checksums {
+			if err = readRest(m.conn, sum[:]); err != nil {
+				err = transportError("read", err)
+				break
+			}
+			trailer = sum[:]
+		}
+		m.tapFrame(Inbound, raw[:], payload, trailer)
+		if trailer != nil && binary.BigEndian.Uint32(sum[:]) != checksum(raw[:], payload) {
+			if !m.config.checksumRecovery {
+				err = fmt.Errorf("%w: packet of type %d for channel %d", ErrChecksum, hdr.Type, hdr.ID)
+				break
+			}
+			if buf != nil {
+				putBuffer(buf)
+			}
+			m.dropCorrupt(hdr.ID)
+			continue
+		}
+		if transform != nil && hdr.Type == typeData && len(payload) > 0 {
+			sealed := buf
+			buf, payload, err = openPayload(transform, payload)
+			putBuffer(sealed)
+			if err == nil && uint32(len(payload)) > compressedLimit {
+				putBuffer(buf)
+				err = errors.New("opened payload too large")
+			}
+			if err != nil {
+				err = fmt.Errorf("%w: %s", ErrProtocol, err)
+				break
+			}
+		}
+		if m.decompressor != nil && isCompressed(hdr.Type, hdr.flags(), len(payload)) {
+			compressed := buf
+			buf = getBuffer(int(limit))
+			payload, err = m.decompressor.decompress((*buf)[:0], payload, int(limit))
+			putBuffer(compressed)
+			if err != nil {
+				putBuffer(buf)
+				err = fmt.Errorf("%w: %s", ErrProtocol, err)
+				break
+			}
+		}
 
-		p := &packet{
-			id:      id,
-			flags:   flags,
+		p = packet{
+			typ:     hdr.Type,
+			id:      hdr.ID,
+			flags:   hdr.flags(),
 			payload: payload,
+			buf:     buf,
 		}
-		m.in <- p
+		m.touch()
+		m.recordActivity(p.typ)
+		if m.dumper != nil {
+			m.dump(Inbound, &p)
+		}
+		p.vetoed = m.hook(Inbound, &p) != nil
+		err = m.dispatch(&p)
+		if p.buf != nil {
+			putBuffer(p.buf)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if errors.Is(err, ErrProtocol) {
+		atomic.AddUint64(&m.stats.protocolErrors, 1)
+		m.emit(EventProtocolError, 0, err)
+		m.log(levelError, "protocol error", "error", err)
 	}
+	m.kill(err)
+}
 
+// Terminate the stream with err. The writer may be stuck on a stalled
+// transport, so rather than leaving it to clean up, the transport is closed to
+// unblock it and the channels are closed so that their operations fail now.
+func (m *MultiplexedStream) kill(err error) {
 	m.tomb.Kill(err)
+	m.closeConn()
+	m.closeChannels()
 }
 
-func (m *MultiplexedStream) run() {
-	defer m.tomb.Done()
-	var err error
+// Read the rest of a frame whose header has been read. The transport ending
+// here is a failure, not it being closed cleanly.
+func readRest(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
 
-loop:
-	for m.tomb.Err() == tomb.ErrStillAlive {
-		select {
-		// Received packet from peer.
-		case p := <-m.in:
+// Dispatch a packet received from the peer.
+func (m *MultiplexedStream) dispatch(p *packet) error {
+	m.countReceived(p)
+	if err := m.countControl(p); err != nil {
+		return err
+	}
+	// Data frames vetoed by the hook still affect their channels (see
+	// vetoable).
+	if p.vetoed && p.typ != typeData {
+		return nil
+	}
+	ch, ok := m.channels.get(p.id)
+
+	switch p.typ {
+	case typeData:
+		// IDs are never reused, so this is either a confused peer or one
+		// that has wrapped around. Either way the data can't be trusted.
+		if ok && p.flags&SYN != 0 {
+			return fmt.Errorf("%w: SYN for channel %d, which is already open", ErrProtocol, p.id)
+		}
+		// Each end opens channels with IDs of its own parity, so that they
+		// can't collide. Older peers don't say which they use.
+		if parity := atomic.LoadUint32(&m.peerParity); p.flags&SYN != 0 && parity != 0 && p.id%2 != parity-1 {
+			return fmt.Errorf("%w: peer opened channel %d, which has our parity", ErrProtocol, p.id)
+		}
+		// Flags are only added along with a feature, which the peer
+		// wouldn't use unless we had advertised it.
+		if p.flags&^allFlags != 0 {
+			return fmt.Errorf("%w: unknown flags %#x on channel %d", ErrProtocol, p.flags&^allFlags, p.id)
+		}
+		if p.flags&(META|SERVICE) != 0 && p.flags&SYN == 0 {
+			return fmt.Errorf("%w: metadata or service without SYN on channel %d", ErrProtocol, p.id)
+		}
+		if p.flags&EOM != 0 && p.flags&(SYN|RST) != 0 {
+			return fmt.Errorf("%w: EOM with SYN or RST on channel %d", ErrProtocol, p.id)
+		}
+		if p.flags&META != 0 && !m.config.features.Has(FeatureMetadata) ||
+			p.flags&SERVICE != 0 && !m.config.features.Has(FeatureServices) ||
+			p.flags&EOM != 0 && !m.config.features.Has(FeatureMessages) ||
+			p.flags&COMPRESS != 0 && !m.config.features.Has(FeatureChannelCompression) ||
+			p.flags&REASON != 0 && !m.config.features.Has(FeatureCloseReasons) {
+			return fmt.Errorf("%w: flags %#x on channel %d need a disabled feature", ErrProtocol, p.flags, p.id)
+		}
+
+		// No existing channel registered, create a new one.
+		if !ok {
+			if p.flags&SYN == 0 {
+				m.handleStray(p)
+				return nil
+			}
+			service, codec, metadata, err := splitOpen(p)
+			if err != nil {
+				return err
+			}
+			if err := m.fault(faultAccept); err != nil {
+				return err
+			}
+			if p.vetoed {
+				m.refuse(p.id, refuseVetoed)
+				return nil
+			}
 			m.lock.Lock()
-			ch, ok := m.channels[p.id]
+			if m.goneAway {
+				m.lock.Unlock()
+				m.refuse(p.id, refuseGoingAway)
+				return nil
+			}
+			if p.id > m.lastPeerID {
+				m.lastPeerID = p.id
+			}
+			if limiter := m.config.openLimiter; limiter != nil && !limiter.Allow() {
+				m.lock.Unlock()
+				m.refuse(p.id, refuseRateLimited)
+				return nil
+			}
+			ch = newChannel(m, p.id)
+			ch.service = service
+			ch.metadata = metadata
+			// Unknown codecs are declined, leaving the channel uncompressed.
+			if codec != "" && m.useCodec(ch, codec) {
+				ch.compressing = 1
+			}
+			if !m.channels.add(ch, m.config.maxChannels) {
+				m.lock.Unlock()
+				ch.reset(io.EOF)
+				m.refuse(p.id, refuseTooManyChannels)
+				return nil
+			}
 			m.lock.Unlock()
+			// Channels registered after the stream dies would never be
+			// closed.
+			if m.tomb.Err() != tomb.ErrStillAlive {
+				ch.reset(io.EOF)
+				return nil
+			}
 
-			// No existing channel registered, create a new one.
-			// TODO: Handle expired channels correctly.
-			if !ok {
-				if p.flags&SYN == 0 {
-					err = ErrInvalidChannel
-					break loop
+			if filter := m.config.acceptFilter; filter != nil {
+				if err := filter(ch); err != nil {
+					ch.reset(io.EOF)
+					m.reject(p.id, err)
+					return nil
 				}
-				ch = newChannel(p.id, m.out, &m.tomb)
-				m.lock.Lock()
-				m.channels[p.id] = ch
-				m.lock.Unlock()
-
-				m.accept <- ch
 			}
 
-			// Received a RST, close the channel.
-			if p.flags&RST != 0 {
-				m.lock.Lock()
-				delete(m.channels, p.id)
-				m.lock.Unlock()
-				ch.Close()
-				ch = nil
+			queue := m.acceptQueue(service)
+			if queue == nil {
+				ch.reset(io.EOF)
+				m.refuse(p.id, refuseUnknownService)
+				return nil
 			}
 
-			if len(p.payload) != 0 {
-				if _, err = ch.mw.Write(p.payload); err != nil {
-					break loop
+			// The channel is either queued or refused, never both: a
+			// concurrent Accept that frees a slot either happens before the
+			// send, or the peer is told to try again later.
+			select {
+			case queue <- ch:
+				// Peers that don't acknowledge channels still tell the
+				// dialler that they accepted its codec.
+				if ch.compressing != 0 {
+					m.reply(&packet{id: p.id, flags: ACK | COMPRESS})
+				} else if m.config.features.Has(FeatureOpenAck) {
+					m.reply(&packet{id: p.id, flags: ACK})
 				}
+			default:
+				ch.reset(io.EOF)
+				m.refuse(p.id, refuseBusy)
+				return nil
 			}
+		}
 
-		// Send packet from local channel to peer.
-		case p := <-m.out:
-			if err = binary.Write(m.conn, binary.BigEndian, p.id); err != nil {
+		// The peer has queued a channel we opened.
+		if p.flags&ACK != 0 {
+			ch.acknowledge(p.flags&COMPRESS != 0)
+		}
+
+		// Received a RST, close the channel. Any payload is the reason the
+		// peer closed it, not data.
+		if p.flags&RST != 0 {
+			if p.flags&REFUSE != 0 {
+				ch.reset(refusalError(p.payload))
+				return nil
+			}
+			if p.flags&REASON != 0 {
+				ch.reset(closeReasonError(p.payload))
+				return nil
+			}
+			if p.flags&ABORT != 0 {
+				ch.discard()
+				ch.reset(ErrChannelReset)
+				return nil
+			}
+			if len(p.payload) == 0 {
+				ch.reset(io.EOF)
+				return nil
+			}
+			if len(p.payload) < 4 {
+				return fmt.Errorf("%w: RST reason of %d bytes on channel %d", ErrProtocol, len(p.payload), p.id)
+			}
+			ch.reset(&ChannelError{
+				code:    binary.BigEndian.Uint32(p.payload),
+				message: string(p.payload[4:]),
+			})
+			return nil
+		}
+
+		if len(p.payload) != 0 && p.flags&COMPRESS != 0 {
+			if err := ch.decompress(p); err != nil {
+				return fmt.Errorf("%w: channel %d: %s", ErrProtocol, p.id, err)
+			}
+		}
+		if len(p.payload) != 0 || p.flags&EOM != 0 {
+			atomic.AddUint64(&m.stats.bytesReceived, uint64(len(p.payload)))
+			ch.stats.received(len(p.payload))
+			if err := ch.deliver(p); err != nil {
+				return err
+			}
+		}
+
+		// The peer will send no more data.
+		if p.flags&FIN != 0 {
+			ch.fin()
+		}
+
+	case typeWindowUpdate:
+		if len(p.payload) != 4 {
+			return fmt.Errorf("%w: window update of %d bytes", ErrProtocol, len(p.payload))
+		}
+		if ok {
+			return ch.grow(binary.BigEndian.Uint32(p.payload))
+		}
+
+	case typePing:
+		return m.handlePing(p)
+
+	case typeGoAway:
+		if len(p.payload) != 4 {
+			return fmt.Errorf("%w: go away of %d bytes", ErrProtocol, len(p.payload))
+		}
+		m.handleGoAway(binary.BigEndian.Uint32(p.payload))
+
+	case typeSettings:
+		return m.handleSettings(p)
+
+	default:
+		if m.handleExtension(p) {
+			return nil
+		}
+		if m.config.strictPacketTypes {
+			return fmt.Errorf("%w: unknown packet type %d", ErrProtocol, p.typ)
+		}
+		// Most likely from a newer peer. The payload has already been read,
+		// so the packet can be skipped.
+		atomic.AddUint64(&m.unknown, 1)
+		m.log(levelDebug, "unknown packet skipped", "type", p.typ)
+	}
+	return nil
+}
+
+// UnknownPackets returns the number of packets received with types this end
+// doesn't understand, which have been skipped (see WithStrictPacketTypes).
+func (m *MultiplexedStream) UnknownPackets() uint64 {
+	return atomic.LoadUint64(&m.unknown)
+}
+
+// Write packets from local channels to the connection.
+func (m *MultiplexedStream) run() {
+	defer m.tomb.Done()
+	var err error
+	if !m.config.noHandshake {
+		err = m.writeHandshake()
+	}
+
+loop:
+	for err == nil && m.tomb.Err() == tomb.ErrStillAlive {
+		// Control packets and replies take priority.
+		select {
+		case p := <-m.control:
+			if err = m.write(p); err != nil {
+				break loop
+			}
+			continue
+		case <-m.replied:
+			if err = m.writeReplies(); err != nil {
+				break loop
+			}
+			continue
+		default:
+		}
+
+		// Send the most important packet from local channels to the peer,
+		// choosing from everything queued so far.
+		m.schedule()
+		if p := m.sched.pop(); p != nil {
+			if p.ch == nil || !p.ch.isAborted() {
+				if err = m.shape(p); err == nil {
+					err = m.write(p)
+				}
+			}
+			p.release()
+			if err != nil {
 				break loop
 			}
-			packed := (uint32(len(p.payload)) & 0xffffff) | (uint32(p.flags) << 24)
-			if err = binary.Write(m.conn, binary.BigEndian, packed); err != nil {
+			continue
+		}
+
+		select {
+		case p := <-m.control:
+			if err = m.write(p); err != nil {
 				break loop
 			}
-			if _, err = m.conn.Write(p.payload); err != nil {
+
+		case <-m.replied:
+			if err = m.writeReplies(); err != nil {
 				break loop
 			}
 
+		case p := <-m.out:
+			m.sched.push(p)
+
 			// MultiplexedStream has been killed.
 		case <-m.tomb.Dying():
 			break loop
 		}
 	}
 
-	m.tomb.Kill(err)
-	m.conn.Close()
+	m.kill(transportError("write", err))
+	m.closeEvents()
+	if err := m.err(); err == ErrSessionClosed {
+		m.log(levelInfo, "session closed")
+	} else {
+		m.log(levelWarn, "session failed", "error", err)
+	}
+}
+
+// Terminate every channel once the stream has died.
+func (m *MultiplexedStream) closeChannels() {
+	err := m.err()
+	for _, ch := range m.channels.all() {
+		ch.kill(err)
+	}
+}
+
+// Move packets queued by channels to the scheduler.
+func (m *MultiplexedStream) schedule() {
+	for {
+		select {
+		case p := <-m.out:
+			m.sched.push(p)
+		default:
+			return
+		}
+	}
+}
+
+// Write a single packet to the connection.
+//
+// The header and payload are written with a single call to the transport,
+// either as a vectored write when it supports them, or by copying small
+// packets into a contiguous buffer.
+func (m *MultiplexedStream) write(p *packet) error {
+	if m.dumper != nil {
+		m.dump(Outbound, p)
+	}
+	// Before the write, which may not return until the peer has replied.
+	m.recordActivity(p.typ)
+	payload := p.payload
+	flags := p.flags
+	if p.ch != nil && p.typ == typeData && flags&(SYN|RST) == 0 && len(payload) > 0 && atomic.LoadUint32(&p.ch.compressing) != 0 {
+		var err error
+		if m.cbuf, err = p.ch.encoder.Compress(m.cbuf[:0], payload); err != nil {
+			return err
+		}
+		if len(m.cbuf) > int(compressedSize(uint32(len(payload)))) {
+			return fmt.Errorf("codec %s grew %d bytes of data to %d", p.ch.codec, len(payload), len(m.cbuf))
+		}
+		payload = m.cbuf
+		flags |= COMPRESS
+	}
+	if m.compressor != nil && isCompressed(p.typ, flags, len(payload)) {
+		var err error
+		if payload, err = m.compressor.compress(payload); err != nil {
+			return err
+		}
+	}
+	if t := m.config.transform; t != nil && p.typ == typeData && len(payload) > 0 {
+		var err error
+		if m.tbuf, err = t.Seal(m.tbuf[:0], payload); err != nil {
+			return err
+		}
+		payload = m.tbuf
+	}
+	h := newHeader(p.typ, p.id, flags, len(payload))
+	h.encode(m.hdr[:])
+	hdr := m.hdr[:]
+	var sum []byte
+	if m.config.checksums {
+		binary.BigEndian.PutUint32(m.sum[:], checksum(hdr, payload))
+		sum = m.sum[:]
+	}
+	m.tapFrame(Outbound, hdr, payload, sum)
+
+	var err error
+	switch {
+	// Faults are injected between the header and the payload.
+	case m.config.faults[faultWrite] != nil:
+		err = m.writeParts(hdr, payload, sum)
+
+	case isVectored(m.conn):
+		m.iov = [3][]byte{hdr, payload, sum}
+		m.bufs = m.iov[:]
+		_, err = m.bufs.WriteTo(m.conn)
+		m.iov = [3][]byte{}
+
+	case len(payload) <= maxCopyWrite:
+		m.wbuf = append(append(append(m.wbuf[:0], hdr...), payload...), sum...)
+		err = writeFull(m.conn, m.wbuf)
+
+	default:
+		err = m.writeParts(hdr, payload, sum)
+	}
+	if err != nil {
+		return err
+	}
+	m.countSent(p)
+	m.touch()
+	return nil
+}
+
+// Write the header, payload and trailer of a frame with separate writes.
+func (m *MultiplexedStream) writeParts(hdr, payload, sum []byte) error {
+	if err := writeFull(m.conn, hdr); err != nil {
+		return err
+	}
+	if err := m.fault(faultWrite); err != nil {
+		return err
+	}
+	if err := writeFull(m.conn, payload); err != nil {
+		return err
+	}
+	return writeFull(m.conn, sum)
+}
+
+// Whether a net.Buffers is written to w with a single vectored write.
+func isVectored(w io.Writer) bool {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// Write all of b, even if w returns short writes without an error.
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
 }
 
+// Close the stream and all of its channels. If the stream had already failed,
+// eg. with a *TransportError, that error is returned. Close doesn't wait for
+// the goroutine reading from the transport to exit; use Wait for that.
 func (m *MultiplexedStream) Close() error {
-	m.tomb.Kill(io.EOF)
-	return m.tomb.Wait()
+	m.kill(ErrSessionClosed)
+	m.tomb.Wait()
+	if err := m.err(); err != ErrSessionClosed {
+		return err
+	}
+	return nil
+}
+
+// Err returns nil while the stream is healthy, and the error that terminated
+// it once it has failed or been closed: ErrSessionClosed after Close, or when
+// the peer closed the transport, and otherwise eg. a *TransportError or
+// ErrIdleTimeout. The error does not change once set.
+func (m *MultiplexedStream) Err() error {
+	return m.err()
+}
+
+// Don't expose tomb internals. The transport reaching EOF is reported the
+// same way as a local Close.
+func (m *MultiplexedStream) err() error {
+	switch err := m.tomb.Err(); err {
+	case tomb.ErrStillAlive:
+		return nil
+
+	case tomb.ErrDying, nil, io.EOF:
+		return ErrSessionClosed
+
+	default:
+		return err
+	}
 }
 
+// Accept a new multiplexed channel opened by the remote end.
 func (m *MultiplexedStream) Accept() (*Channel, error) {
+	return m.AcceptContext(context.Background())
+}
+
+// AcceptContext accepts a new multiplexed channel opened by the remote end.
+//
+// If ctx is done first, ctx.Err() is returned and the stream is left open. Any
+// channel that arrives concurrently remains queued for the next Accept.
+//
+// Channels opened for a service registered with WithServices are returned by
+// AcceptService instead.
+func (m *MultiplexedStream) AcceptContext(ctx context.Context) (*Channel, error) {
+	return m.acceptFrom(ctx, m.accept)
+}
+
+func (m *MultiplexedStream) acceptFrom(ctx context.Context, queue chan *Channel) (*Channel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if isClosed(m.deadline.wait()) {
+		return nil, errTimeout
+	}
+	if isClosed(m.draining) {
+		return nil, ErrShutdown
+	}
 	select {
-	case ch := <-m.accept:
+	case ch := <-queue:
+		m.channelOpened(ch, &m.stats.accepted)
+		ch.advertise()
 		return ch, nil
+	case <-m.draining:
+		return nil, ErrShutdown
+	case <-m.deadline.wait():
+		return nil, errTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-m.tomb.Dying():
-		return nil, m.tomb.Err()
+		return nil, m.err()
 	}
 }
 
+// AcceptBacklog returns the number of channels opened by the peer that are
+// waiting to be returned by Accept.
+func (m *MultiplexedStream) AcceptBacklog() int {
+	return len(m.accept)
+}
+
 // Dial the remote end, creating a new multiplexed channel.
-func (m *MultiplexedStream) Dial() (*Channel, error) {
-	if err := m.tomb.Err(); err != tomb.ErrStillAlive {
+func (m *MultiplexedStream) Dial(options ...DialOption) (*Channel, error) {
+	return m.DialContext(context.Background(), options...)
+}
+
+// DialContext dials the remote end, creating a new multiplexed channel.
+//
+// DialContext waits for the peer to acknowledge the channel, which it does once
+// the channel is queued for Accept, and returns the reason if the peer refuses
+// it instead (see DialAsync to avoid waiting). Peers that don't acknowledge
+// channels are not waited for.
+//
+// If ctx is done before the channel is opened, the channel is discarded and
+// ctx.Err() is returned.
+//
+// Channel IDs are never reused, so that a late packet can't be mistaken for
+// one belonging to a newer channel. After about two billion channels have
+// been opened by one end the IDs run out, and Dial fails with
+// ErrChannelIDsExhausted and tells the peer to go away (see GoAway).
+func (m *MultiplexedStream) DialContext(ctx context.Context, options ...DialOption) (*Channel, error) {
+	return m.dial(ctx, m.config.asyncDial, options)
+}
+
+func (m *MultiplexedStream) dial(ctx context.Context, async bool, options []DialOption) (*Channel, error) {
+	var config dialConfig
+	for _, option := range options {
+		option(&config)
+	}
+	if len(config.metadata) > MaxMetadataSize {
+		return nil, ErrMetadataTooLarge
+	}
+	if len(config.service) > MaxServiceNameLength {
+		return nil, ErrServiceNameTooLong
+	}
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	if err := m.err(); err != nil {
+		return nil, err
+	}
+	if isClosed(m.deadline.wait()) {
+		return nil, errTimeout
+	}
+	if isClosed(m.draining) {
+		return nil, ErrShutdown
+	}
+	if len(config.codec) > MaxCodecNameLength {
+		return nil, ErrUnknownCodec
+	}
+	if _, ok := m.config.codecs[config.codec]; config.codec != "" && !ok {
+		return nil, ErrUnknownCodec
+	}
+	if !async || len(config.metadata) > 0 || config.service != "" || config.codec != "" {
+		if err := m.awaitSettings(ctx); err != nil {
+			return nil, err
+		}
+		features := m.PeerFeatures()
+		async = async || !features.Has(FeatureOpenAck)
+		if len(config.metadata) > 0 && (!features.Has(FeatureMetadata) || len(config.metadata) > int(atomic.LoadUint32(&m.peerMaxMetadata))) {
+			return nil, ErrMetadataTooLarge
+		}
+		if config.service != "" && !features.Has(FeatureServices) {
+			return nil, ErrServicesUnsupported
+		}
+		// Peers that can't compress channels decline to.
+		if !features.Has(FeatureChannelCompression) {
+			config.codec = ""
+		}
+	}
 
-	id := atomic.AddUint32(&m.id, 2)
-	ch := newChannel(id, m.out, &m.tomb)
-	ch.out <- &packet{id: ch.id, flags: SYN}
+	// Register before sending the SYN so that an immediate response from the
+	// peer can't race the channel into existence. The stream is checked
+	// afterwards, so that a channel is either seen by closeChannels or
+	// handleGoAway, or sees that they have run.
+	id, ok := m.nextID()
+	if !ok {
+		// Ask the peer to move to a new stream too.
+		m.GoAway()
+		return nil, ErrChannelIDsExhausted
+	}
+	ch := newChannel(m, id)
+	ch.service = config.service
+	ch.metadata = config.metadata
+	if config.codec != "" {
+		m.useCodec(ch, config.codec)
+	}
+	syn := openPacket(ch)
+	var opened chan struct{}
+	if !async {
+		opened = make(chan struct{})
+		ch.opened = opened
+	}
+	if !m.channels.add(ch, m.config.maxChannels) {
+		ch.reset(io.EOF)
+		return nil, ErrTooManyChannels
+	}
+	err := m.err()
+	if err == nil && m.GoingAway() {
+		err = ErrGoAway
+	}
+	if err == nil {
+		err = m.fault(faultDial)
+	}
+	if err == nil {
+		err = m.hook(Outbound, syn)
+	}
+	if err != nil {
+		ch.reset(io.EOF)
+		return nil, err
+	}
 
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	m.channels[id] = ch
-	return ch, nil
+	m.channelOpened(ch, &m.stats.opened)
+	select {
+	case ch.out <- syn:
+		// Queued as the stream died, so it will never be sent, and the
+		// channel has already been, or is about to be, closed.
+		if err = m.err(); err != nil {
+			break
+		}
+		ch.advertise()
+		if async {
+			return ch, nil
+		}
+		return m.awaitOpen(ctx, ch, opened)
+
+	case <-m.deadline.wait():
+		err = errTimeout
+
+	case <-ctx.Done():
+		err = ctx.Err()
+
+	case <-m.tomb.Dying():
+		err = m.err()
+	}
+
+	// The peer never heard about the channel, so discard it quietly.
+	ch.reset(io.EOF)
+	return nil, err
+}
+
+// Allocate the next ID for a channel opened by this end, or return false if
+// they have been exhausted.
+func (m *MultiplexedStream) nextID() (uint32, bool) {
+	for {
+		id := atomic.LoadUint32(&m.id)
+		next := id + 2
+		if next < id {
+			return 0, false
+		}
+		if atomic.CompareAndSwapUint32(&m.id, id, next) {
+			return next, true
+		}
+	}
+}
+
+// Parity of the IDs of channels opened by this end.
+func (m *MultiplexedStream) parity() uint32 {
+	return atomic.LoadUint32(&m.id) % 2
+}
+
+// SetDeadline sets a deadline for Accept, Dial, and IO on all channels in the
+// stream. Expiry does not close the stream; a new deadline may be set, or a
+// zero value for t clears the deadline.
+func (m *MultiplexedStream) SetDeadline(t time.Time) error {
+	m.deadline.set(m.config.clock, t)
+	return nil
 }
 
 // A Channel managed by the multiplexer.
+//
+// Channel implements net.Conn.
 type Channel struct {
-	id   uint32
-	cr   *io.PipeReader // Channel reads from here (mw).
-	mw   *io.PipeWriter // MultiplexedStream writes to here (cr).
-	out  chan *packet   // Channel writes packets to here.
-	tomb tomb.Tomb
+	// 64-bit atomics must come first for alignment on 32-bit platforms.
+	active      int64           // When the channel was last read or written, in Unix nanoseconds.
+	idleTimeout int64           // Close the channel after this long without activity.
+	stats       channelCounters // See Stats.
+	closed      int64           // When the channel finished, in Unix nanoseconds, atomic.
+
+	id       uint32
+	m        *MultiplexedStream
+	out      chan *packet // Channel writes packets to here.
+	tomb     tomb.Tomb
+	priority int32 // See SetPriority, atomic.
+	weight   int32 // See SetWeight, atomic.
+
+	release   sync.Once // Releases the channel's resources once it is killed.
+	idleTimer Timer     // Checks whether the channel is idle, guarded by lock.
+
+	lock       sync.Mutex
+	rbuf       readQueue     // Data received from the peer, not yet read.
+	readable   chan struct{} // Signalled when buf is written to.
+	remote     bool          // Closed by the peer.
+	service    string        // See Service, immutable.
+	metadata   []byte        // See Metadata, immutable.
+	opened     chan struct{} // Closed when the peer acknowledges a channel we are dialling, guarded by lock.
+	reason     []byte        // Payload of the RST sent when the channel is closed.
+	resetFlags uint16        // Flags of that RST besides RST itself.
+	aborted    uint32        // Reset has been called, atomic.
+	window     uint32        // Size of the receive window.
+	epoch      time.Time     // When the receive window was last grown.
+	recvWindow uint32        // Bytes the peer may send before we grant more, atomic.
+	consumed   uint32        // Bytes read since the receive window was last grown.
+	paused     bool          // Don't grant the peer more receive window.
+	sendWindow uint32        // Bytes we may send before the peer grants more, atomic.
+	writable   chan struct{} // Signalled when sendWindow grows.
+
+	flushLock     sync.Mutex    // Held while sending coalesced writes, to keep them in order.
+	pending       []byte        // Coalesced writes not yet sent, guarded by lock.
+	coalescing    bool          // See SetNoDelay, guarded by lock.
+	coalesceSize  int           // See SetWriteCoalescing, guarded by lock.
+	coalesceDelay time.Duration // See SetWriteCoalescing, guarded by lock.
+	flushTimer    Timer         // Flushes pending writes, guarded by lock.
+	flushErr      error         // Why the timer failed to flush, for the next Write or Flush, guarded by lock.
+
+	readClosed      bool // CloseRead has been called.
+	writeClosed     bool // CloseWrite has been called.
+	peerWriteClosed bool // The peer has called CloseWrite.
+
+	readMode    uint32     // Whether reads are of a stream or messages, atomic.
+	writeMode   uint32     // Whether writes are of a stream or messages, atomic.
+	messageLock sync.Mutex // Held by WriteMessage, to keep the packets of each message together.
+	message     []byte     // Start of a message ReadMessage failed part way through.
+	skipping    bool       // Discarding the rest of a message too large for ReadMessage.
+
+	codec       string // Name of the codec, see Codec, immutable.
+	encoder     Codec  // Compresses data we send, only used by the writer.
+	decoder     Codec  // Decompresses data we receive, only used by the reader.
+	compressing uint32 // The peer has accepted the codec, atomic.
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	rate    *tokenBucket // Limits writes, see SetRateLimit, guarded by lock.
+	counted uint32       // Whether reported as opened, and then closed, atomic.
+	value   interface{}  // See SetValue, guarded by lock.
+	created time.Time    // See Stats, immutable.
 }
 
-func newChannel(id uint32, out chan *packet, tomb *tomb.Tomb) *Channel {
-	cr, mw := io.Pipe()
+var _ net.Conn = &Channel{}
+
+func newChannel(m *MultiplexedStream, id uint32) *Channel {
 	ch := &Channel{
-		id:  id,
-		cr:  cr,
-		mw:  mw,
-		out: out,
+		id:          id,
+		m:           m,
+		out:         m.out,
+		readable:    make(chan struct{}, 1),
+		window:      m.config.window,
+		recvWindow:  m.config.window,
+		epoch:       m.config.clock.Now(),
+		sendWindow:  initialWindow,
+		writable:    make(chan struct{}, 1),
+		idleTimeout: int64(m.config.channelIdleTimeout),
 	}
-	go ch.link(tomb)
+	ch.created = m.config.clock.Now()
+	ch.touch()
+	ch.armIdleTimer()
 	return ch
 }
 
-// Link this channel's Tomb to the MultiplexedStream's Tomb.
-func (c *Channel) link(tomb *tomb.Tomb) {
+// Terminate the channel with err. The first call releases the channel's
+// resources, and sends the peer an RST unless it already knows the channel is
+// finished.
+//
+// Channels have no goroutine of their own, so this is done by whichever
+// goroutine kills the channel first. It must not block the reader, so the
+// reader only kills channels it has already marked as remote.
+func (c *Channel) kill(err error) {
+	c.tomb.Kill(err)
+	c.release.Do(c.finish)
+}
+
+func (c *Channel) finish() {
 	defer c.tomb.Done()
 
-	err := io.EOF
+	c.lock.Lock()
+	c.stopIdleTimer()
+	remote := c.remote
+	reason := c.reason
+	flags := RST | c.resetFlags
+	c.lock.Unlock()
 
-	select {
-	case <-tomb.Dying():
-		// MultiplexedStream died, not much we can do from here so we just propagate the error.
-		err = tomb.Err()
+	c.m.starveLock.Lock()
+	delete(c.m.starved, c)
+	c.m.starveLock.Unlock()
 
-	case <-c.tomb.Dying():
-		// MultiplexedStream is still alive (?) send RST packet.
+	// Queued before the channel is forgotten, so that it is sent ahead of
+	// the RST for any packet the peer sends before it arrives.
+	if !remote && c.m.tomb.Err() == tomb.ErrStillAlive {
 		p := &packet{
-			id:    c.id,
-			flags: RST,
+			id:      c.id,
+			flags:   flags,
+			payload: reason,
+		}
+		c.m.hook(Outbound, p)
+		select {
+		case c.out <- p:
+		case <-c.m.tomb.Dying():
 		}
-		c.out <- p
+	}
+	c.m.channels.remove(c)
+	c.m.channelClosed(c)
+	atomic.StoreInt64(&c.closed, c.m.config.clock.Now().UnixNano())
+
+	// Seen by WithOnChannelClose, but not pinned by the closed channel.
+	c.lock.Lock()
+	c.value = nil
+	c.lock.Unlock()
+}
 
+// Append data received from the peer to the read buffer. The packet's pooled
+// buffer is taken over, rather than copied, if possible.
+func (c *Channel) deliver(p *packet) error {
+	b := p.payload
+	if c.tomb.Err() != tomb.ErrStillAlive {
+		// Closed locally, so nobody will read it.
+		return nil
 	}
+	c.lock.Lock()
+	if window := atomic.LoadUint32(&c.recvWindow); uint32(len(b)) > window {
+		c.lock.Unlock()
+		return fmt.Errorf("%w: %d bytes on channel %d exceed its window of %d", ErrProtocol, len(b), c.id, window)
+	}
+	if c.peerWriteClosed {
+		// Raced with the peer's CloseWrite.
+		c.lock.Unlock()
+		return nil
+	}
+	atomic.AddUint32(&c.recvWindow, -uint32(len(b)))
+	if c.readClosed || p.vetoed {
+		c.lock.Unlock()
+		// Nobody will read the data, but keep granting window so that the
+		// peer's writes don't stall. This is called from the reader, which
+		// must never block on the writer.
+		c.m.workers.Add(1)
+		go func() {
+			defer c.m.workers.Done()
+			c.updateWindow(len(b))
+		}()
+		return nil
+	}
+	atomic.AddInt64(&c.m.buffered, int64(len(b)))
+	if c.rbuf.write(p.buf, b, p.flags&EOM != 0) {
+		p.buf = nil
+	}
+	c.lock.Unlock()
+	signal(c.readable)
+	return nil
+}
 
-	err = c.maybePipeError(err)
-	c.cr.CloseWithError(err)
-	c.mw.CloseWithError(err)
+// The peer has granted us more send window.
+func (c *Channel) grow(n uint32) error {
+	c.lock.Lock()
+	if window := atomic.LoadUint32(&c.sendWindow); window+n < window {
+		c.lock.Unlock()
+		return fmt.Errorf("%w: window of channel %d grown past 4GB", ErrProtocol, c.id)
+	}
+	atomic.AddUint32(&c.sendWindow, n)
+	c.lock.Unlock()
+	signal(c.writable)
+	return nil
+}
+
+// Grant the peer more receive window once the application has read at least
+// half of it.
+func (c *Channel) updateWindow(n int) {
+	c.lock.Lock()
+	c.consumed += uint32(n)
+	if c.paused || c.consumed < c.window/2 {
+		c.lock.Unlock()
+		return
+	}
+	// A channel with nothing left to read is always granted window, so that
+	// data buffered on other channels can't deadlock its reader.
+	if c.rbuf.Len() > 0 && c.m.overBudget() {
+		c.lock.Unlock()
+		c.m.starve(c)
+		return
+	}
+	grant := c.tune(c.consumed)
+	atomic.AddUint32(&c.recvWindow, grant)
+	c.consumed = 0
+	c.lock.Unlock()
+
+	c.sendWindowUpdate(grant)
+}
+
+// If auto-tuning is enabled, resize the receive window based on how quickly
+// the application is reading relative to the round-trip time. Returns how much
+// window to grant the peer now that the application has consumed n bytes.
+// Must be called with the lock held.
+//
+// The window is doubled, up to the configured maximum, while half of it is
+// consumed in less than two round trips; ie. while the window rather than the
+// reader is what limits throughput. If instead the reader is slow, the window
+// is halved back towards its default size to bound buffered memory.
+func (c *Channel) tune(n uint32) uint32 {
+	max := c.m.config.maxWindow
+	now := c.m.config.clock.Now()
+	elapsed := now.Sub(c.epoch)
+	c.epoch = now
+	if max == 0 {
+		return n
+	}
+	rtt := c.m.RTT()
+	if rtt == 0 {
+		return n
+	}
+	c.m.refreshRTT()
+
+	switch {
+	case elapsed < rtt*2 && c.window < max:
+		grow := c.window
+		if c.window+grow > max {
+			grow = max - c.window
+		}
+		c.window += grow
+		return n + grow
+
+	case elapsed > rtt*16 && c.window > c.m.config.window:
+		shrink := c.window / 2
+		if c.window-shrink < c.m.config.window {
+			shrink = c.window - c.m.config.window
+		}
+		c.window -= shrink
+		return n - shrink
+	}
+	return n
+}
+
+// SendWindow returns the number of bytes that can currently be written to the
+// channel without blocking for the peer to grant more window.
+func (c *Channel) SendWindow() uint32 {
+	return atomic.LoadUint32(&c.sendWindow)
+}
+
+// RecvWindow returns the number of bytes the peer has been granted to send,
+// but has not yet sent.
+func (c *Channel) RecvWindow() uint32 {
+	return atomic.LoadUint32(&c.recvWindow)
+}
+
+// Pause stops granting the peer receive window, so that it stops sending once
+// the window it has already been granted is exhausted. Data already received
+// can still be Read. Other channels are unaffected.
+func (c *Channel) Pause() {
+	c.lock.Lock()
+	c.paused = true
+	c.lock.Unlock()
+}
+
+// Resume granting the peer receive window after Pause, allowing it to send
+// again.
+func (c *Channel) Resume() {
+	c.lock.Lock()
+	c.paused = false
+	grant := c.consumed
+	atomic.AddUint32(&c.recvWindow, grant)
+	c.consumed = 0
+	// Time spent paused says nothing about how fast the application reads.
+	c.epoch = c.m.config.clock.Now()
+	c.lock.Unlock()
+	if grant > 0 {
+		c.sendWindowUpdate(grant)
+	}
+}
+
+// WindowSize returns the current size of the channel's receive window.
+//
+// This is fixed unless window auto-tuning is enabled (see
+// WithWindowAutoTuning).
+func (c *Channel) WindowSize() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.window
+}
+
+// Both ends of a channel start out assuming the initial window, so grant the
+// peer any extra window we have been configured with.
+func (c *Channel) advertise() {
+	if c.window > initialWindow {
+		c.sendWindowUpdate(c.window - initialWindow)
+	}
+}
+
+func (c *Channel) sendWindowUpdate(n uint32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, n)
+	p := &packet{typ: typeWindowUpdate, id: c.id, payload: payload}
+	c.m.hook(Outbound, p)
+	select {
+	case c.out <- p:
+	case <-c.tomb.Dying():
+	}
+}
+
+// Non-blocking notification on a channel with a buffer of one.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// The channel was closed by the peer, or never opened, so the peer does not
+// need to be notified.
+func (c *Channel) reset(err error) {
+	c.lock.Lock()
+	c.remote = true
+	c.lock.Unlock()
+	c.kill(err)
+}
+
+// The peer has called CloseWrite. Once both directions are closed the channel
+// is released, without an RST as both ends already know it is finished.
+func (c *Channel) fin() {
+	c.lock.Lock()
+	c.peerWriteClosed = true
+	done := c.writeClosed
+	c.lock.Unlock()
+	signal(c.readable)
+	if done {
+		c.reset(io.EOF)
+	}
 }
 
 // Read bytes from a multiplexed channel.
+//
+// Data already received from the peer is returned before any error caused by
+// the peer closing the channel. Once the peer has called CloseWrite and all
+// of its data has been read, or once CloseRead has been called, Read returns
+// io.EOF.
+//
+// Read and Write return io.EOF once the peer has closed the channel,
+// ErrChannelClosed once it has been closed locally, and ErrSessionClosed once
+// the stream has been closed. All three satisfy errors.Is(err, io.EOF).
+//
+// Errors other than io.EOF name the channel, so should be compared with
+// errors.Is.
 func (c *Channel) Read(b []byte) (int, error) {
-	if err := c.tomb.Err(); err != tomb.ErrStillAlive {
-		return 0, err
-	}
-	n, err := c.cr.Read(b)
-	return n, c.maybePipeError(err)
+	n, _, _, err := c.read(b, readAll)
+	return n, err
 }
 
 // Write bytes to a multiplexed channel. The underlying implementation will
-// fragment the payload into FragmentSize chunks to prevent starvation of other
-// channels.
+// fragment the payload into chunks of at most the maximum frame size (see
+// WithMaxFrameSize) to prevent starvation of other channels.
+//
+// Write blocks while the peer's receive window for the channel is exhausted.
+//
+// If the write deadline expires the number of bytes queued so far is returned
+// along with a timeout error. Fragments are only ever queued whole, so a
+// timeout never leaves a partial packet on the wire.
+//
+// Write returns io.ErrClosedPipe after CloseWrite has been called.
 func (c *Channel) Write(b []byte) (int, error) {
+	if err := useMode(&c.writeMode, modeStream); err != nil {
+		return 0, err
+	}
+	return c.write(b, false)
+}
+
+// Write b, marking the end of a message with its last packet if eom is true.
+// Coalesced writes are flushed first, so that the end isn't delayed.
+func (c *Channel) write(b []byte, eom bool) (int, error) {
+	if eom {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
+		if len(b) == 0 {
+			if _, err := c.reserve(0); err != nil {
+				return 0, err
+			}
+			return 0, c.send(&packet{id: c.id, flags: EOM, ch: c})
+		}
+	}
+
 	n := 0
+	for n < len(b) {
+		l := len(b) - n
+		if max := int(c.m.MaxFrameSize()); l > max {
+			l = max
+		}
+		l, err := c.reserve(l)
+		if err != nil {
+			return n, err
+		}
 
-	for i, err := 0, c.tomb.Err(); i < len(b) && err == tomb.ErrStillAlive; i, err = i+FragmentSize, c.tomb.Err() {
-		l := len(b) - i
-		if l > FragmentSize {
-			l = FragmentSize
+		if !eom && c.isCoalescing() {
+			c.touch()
+			if err := c.coalesce(b[n : n+l]); err != nil {
+				return n, err
+			}
+			n += l
+			continue
 		}
 
-		p := &packet{id: c.id, payload: b[i:l]}
-		c.out <- p
-		n += len(p.payload)
+		// The payload is written to the transport asynchronously, so it must
+		// not share memory with the caller.
+		p := newDataPacket(c, b[n:n+l])
+		if eom && n+l == len(b) {
+			p.flags = EOM
+		}
+		if err := c.send(p); err != nil {
+			return n, err
+		}
+		n += l
 	}
 
-	return n, c.maybePipeError(c.tomb.Err())
+	return n, c.err()
+}
+
+// Wait until the peer's receive window is open, then reserve as much of it as
+// we can use, up to max bytes. With a max of zero this only checks that the
+// channel is writable.
+func (c *Channel) reserve(max int) (int, error) {
+	for {
+		c.lock.Lock()
+		closed := c.writeClosed
+		c.lock.Unlock()
+		if closed {
+			return 0, io.ErrClosedPipe
+		}
+		if err := c.err(); err != nil {
+			return 0, err
+		}
+		if isClosed(c.writeDeadline.wait()) || isClosed(c.m.deadline.wait()) {
+			return 0, errTimeout
+		}
+
+		l := max
+		c.lock.Lock()
+		if window := atomic.LoadUint32(&c.sendWindow); uint32(l) > window {
+			l = int(window)
+		}
+		more := atomic.AddUint32(&c.sendWindow, -uint32(l)) > 0
+		c.lock.Unlock()
+		if more {
+			// Pass any remaining window on to concurrent writers.
+			signal(c.writable)
+		}
+		if l > 0 {
+			if err := c.throttle(l); err != nil {
+				c.grow(uint32(l))
+				return 0, err
+			}
+		}
+		if l > 0 || max == 0 {
+			return l, nil
+		}
+
+		select {
+		case <-c.writable:
+		case <-c.writeDeadline.wait():
+			return 0, errTimeout
+		case <-c.m.deadline.wait():
+			return 0, errTimeout
+		case <-c.tomb.Dying():
+			return 0, c.err()
+		}
+	}
 }
 
-// Don't expose io.ErrClosedPipe.
-func (c *Channel) maybePipeError(err error) error {
-	switch err {
-	case io.ErrClosedPipe:
-		err = c.tomb.Err()
-		if err == tomb.ErrStillAlive || err == tomb.ErrDying {
-			err = io.EOF
+// Queue a data packet whose payload has been reserved from the send window.
+// If it can't be queued the packet is released and the window returned.
+func (c *Channel) send(p *packet) error {
+	err := c.m.hook(Outbound, p)
+	if err == nil {
+		select {
+		case c.out <- p:
+		case <-c.writeDeadline.wait():
+			err = errTimeout
+		case <-c.m.deadline.wait():
+			err = errTimeout
+		case <-c.tomb.Dying():
+			err = c.err()
 		}
+	}
+	if err != nil {
+		// Return the unused window.
+		c.grow(uint32(len(p.payload)))
+		p.release()
+		return err
+	}
+	c.touch()
+	return nil
+}
+
+// Done returns a channel that is closed once the channel is closed, for any
+// reason: by either end, by a reset, or by the stream terminating. Each call
+// returns the same channel.
+func (c *Channel) Done() <-chan struct{} {
+	return c.tomb.Dead()
+}
 
+// Err returns nil while the channel is open, and why it was closed once it
+// has been: io.EOF if the peer closed it, or both ends closed it for writing,
+// and otherwise eg. ErrChannelClosed after Close, or ErrChannelReset. The
+// error does not change once set.
+func (c *Channel) Err() error {
+	return c.err()
+}
+
+// Don't expose tomb internals.
+func (c *Channel) err() error {
+	switch err := c.tomb.Err(); err {
 	case tomb.ErrStillAlive:
-		err = nil
+		return nil
 
-	case tomb.ErrDying:
-		err = io.EOF
+	case tomb.ErrDying, nil, io.EOF:
+		return io.EOF
+
+	default:
+		return &channelErr{id: c.id, err: err}
 	}
-	return err
 }
 
-// Close a multiplexed channel.
+// CloseWrite closes the writing side of the channel. Subsequent writes return
+// io.ErrClosedPipe, and the peer's Read returns io.EOF once it has read all
+// data written before CloseWrite. Reading from the channel is unaffected.
+//
+// Once both ends have called CloseWrite the channel is released, without
+// either end needing to call Close.
+func (c *Channel) CloseWrite() error {
+	c.lock.Lock()
+	if c.writeClosed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	done := c.peerWriteClosed
+	c.lock.Unlock()
+
+	c.Flush()
+	// Queued behind any data already written, so the peer sees it last.
+	fin := &packet{id: c.id, flags: FIN}
+	c.m.hook(Outbound, fin)
+	select {
+	case c.out <- fin:
+	case <-c.tomb.Dying():
+		return c.err()
+	}
+	if done {
+		c.reset(io.EOF)
+	}
+	return nil
+}
+
+// CloseRead closes the reading side of the channel. Unread data is discarded,
+// as is any further data from the peer, and subsequent reads return io.EOF.
+// Writing to the channel is unaffected.
+//
+// The peer is not notified, and its writes continue to succeed.
+func (c *Channel) CloseRead() error {
+	c.lock.Lock()
+	c.readClosed = true
+	n := c.rbuf.Len()
+	atomic.AddInt64(&c.m.buffered, -int64(n))
+	c.rbuf.reset()
+	c.lock.Unlock()
+	signal(c.readable)
+	c.updateWindow(n)
+	c.m.relieve()
+	return nil
+}
+
+// Close both directions of a multiplexed channel.
+//
+// Unlike CloseWrite, the peer is notified immediately: its reads return io.EOF
+// once it has read any data already received, and its writes fail.
+//
+// Closing a channel again, even concurrently, has no further effect and
+// returns the same result.
 func (c *Channel) Close() error {
-	c.tomb.Kill(io.EOF)
+	c.Flush()
+	c.discard()
+	if err := c.m.err(); err != nil {
+		c.kill(err)
+	} else {
+		c.kill(ErrChannelClosed)
+	}
 	// If the channel was terminated due to some other error, return that.
-	if err := c.tomb.Wait(); err != io.EOF {
-		return err
+	if err := c.tomb.Wait(); !errors.Is(err, io.EOF) {
+		return &channelErr{id: c.id, err: err}
+	}
+	return nil
+}
+
+// Reset abandons a multiplexed channel immediately. Unlike Close, data that has
+// been written but not yet sent is dropped, and the peer discards any data it
+// has received but not yet read. Operations on the peer's end of the channel
+// then fail with ErrChannelReset.
+//
+// Reset does not block, and resetting a closed channel has no effect.
+func (c *Channel) Reset() error {
+	c.lock.Lock()
+	if c.remote || c.tomb.Err() != tomb.ErrStillAlive {
+		c.lock.Unlock()
+		return nil
+	}
+	// The RST is sent here rather than when the channel dies.
+	c.remote = true
+	atomic.StoreUint32(&c.aborted, 1)
+	c.pending = nil
+	c.lock.Unlock()
+
+	c.discard()
+	c.kill(ErrChannelClosed)
+	// Overtakes any data still queued for the channel, which is then dropped.
+	rst := &packet{id: c.id, flags: RST | ABORT}
+	c.m.hook(Outbound, rst)
+	select {
+	case c.m.control <- rst:
+	case <-c.m.tomb.Dying():
 	}
 	return nil
 }
+
+func (c *Channel) isAborted() bool {
+	return atomic.LoadUint32(&c.aborted) != 0
+}
+
+// Discard data received but not yet read.
+func (c *Channel) discard() {
+	c.lock.Lock()
+	atomic.AddInt64(&c.m.buffered, -int64(c.rbuf.Len()))
+	c.rbuf.reset()
+	c.lock.Unlock()
+}
+
+// CloseWithError closes a multiplexed channel, as with Close, and passes an
+// application-defined code and message to the peer. Operations on the peer's
+// end of the channel then fail with a *ChannelError, after any data already
+// received has been read. Overly long messages are truncated.
+func (c *Channel) CloseWithError(code uint32, message string) error {
+	if max := int(c.m.MaxFrameSize()) - 4; len(message) > max {
+		message = message[:max]
+	}
+	reason := make([]byte, 4+len(message))
+	binary.BigEndian.PutUint32(reason, code)
+	copy(reason[4:], message)
+	c.lock.Lock()
+	if c.reason == nil {
+		c.reason = reason
+	}
+	c.lock.Unlock()
+	return c.Close()
+}
+
+// LocalAddr returns the local address of the channel, an *Addr such as
+// "10.0.0.5:443/ch/42", or "ch/42" if the transport has no address.
+func (c *Channel) LocalAddr() net.Addr {
+	return &Addr{Addr: c.m.localAddr(), ID: c.id}
+}
+
+// RemoteAddr returns the remote address of the channel, an *Addr such as
+// "10.0.0.6:51234/ch/42", or "ch/42" if the transport has no address.
+func (c *Channel) RemoteAddr() net.Addr {
+	return &Addr{Addr: c.m.remoteAddr(), ID: c.id}
+}
+
+// SetDeadline sets the read and write deadlines of the channel.
+func (c *Channel) SetDeadline(t time.Time) error {
+	c.readDeadline.set(c.m.config.clock, t)
+	c.writeDeadline.set(c.m.config.clock, t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls. A zero
+// value for t clears the deadline.
+func (c *Channel) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(c.m.config.clock, t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending and future Write calls. A
+// zero value for t clears the deadline.
+func (c *Channel) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(c.m.config.clock, t)
+	return nil
+}
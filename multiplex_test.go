@@ -27,14 +27,31 @@
 package multiplex
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
 	"net"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/alecthomas/multiplex/multiplextest"
 	"github.com/stretchrcom/testify/assert"
 )
 
@@ -56,17 +73,40 @@ func (r *rwc) Close() error {
 	return r.w.Close()
 }
 
-func newServerAndClient() (s *MultiplexedStream, c *MultiplexedStream) {
+func newServerAndClient(options ...Option) (s *MultiplexedStream, c *MultiplexedStream) {
+	return Pipe(options...)
+}
+
+// Streams connected by a link with the given latency in each direction, but
+// unlimited bandwidth.
+func newDelayedServerAndClient(delay time.Duration, options ...Option) (s *MultiplexedStream, c *MultiplexedStream) {
 	cr, sw := io.Pipe()
 	sr, cw := io.Pipe()
-	sconn := &rwc{r: sr, w: sw}
-	cconn := &rwc{r: cr, w: cw}
-
-	s = MultiplexedServer(sconn)
-	c = MultiplexedClient(cconn)
+	faults := multiplextest.Faults{Latency: delay}
+	s = MultiplexedServer(multiplextest.Wrap(&rwc{r: sr, w: sw}, faults), options...)
+	c = MultiplexedClient(multiplextest.Wrap(&rwc{r: cr, w: cw}, faults), options...)
 	return
 }
 
+// Poll until condition is true, failing the test if it takes too long.
+func waitFor(t testing.TB, condition func() bool) {
+	for i := 0; i < 1000; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+// Assert that err is the error returned when a deadline expires.
+func assertTimeout(t *testing.T, err error) {
+	t.Helper()
+	nerr, ok := err.(net.Error)
+	assert.True(t, ok && nerr.Timeout() && nerr.Temporary(), "expected a timeout, got %v", err)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "expected os.ErrDeadlineExceeded, got %v", err)
+}
+
 func writepacket(w io.Writer, msg string, id uint32) error {
 	if _, err := w.Write([]byte(msg)[:8]); err != nil {
 		return err
@@ -127,6 +167,233 @@ func BenchmarkClientServer(b *testing.B) {
 	wg.Wait()
 }
 
+func benchmarkWindow(b *testing.B, window uint32) {
+	sm, cm := newDelayedServerAndClient(time.Millisecond*5, WithDefaultWindow(window))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+
+	buf := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	_, err = io.ReadFull(s, make([]byte, len(buf)*b.N))
+	assert.NoError(b, err)
+}
+
+func BenchmarkWindow64KB(b *testing.B) {
+	benchmarkWindow(b, 64*1024)
+}
+
+func BenchmarkWindow4MB(b *testing.B) {
+	benchmarkWindow(b, 4*1024*1024)
+}
+
+func TestShortWrites(t *testing.T) {
+	// A transport that reads and writes at most a few bytes at a time.
+	faults := multiplextest.Faults{ShortWrite: 3, ShortRead: 2}
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(multiplextest.Wrap(&rwc{r: sr, w: sw}, faults))
+	cm := MultiplexedClient(multiplextest.Wrap(&rwc{r: cr, w: cw}, faults))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	data := make([]byte, maxCopyWrite*3)
+	rand.Read(data)
+	go c.Write(data)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	go io.Copy(s, s)
+	b := make([]byte, len(data))
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestTransportFailsMidFrame(t *testing.T) {
+	// Fail at points throughout the handshake, settings, the SYN, and the
+	// header and payload of a data frame.
+	for failAfter := int64(1); failAfter < 1000; failAfter += 1 + failAfter/8 {
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		faults := multiplextest.Faults{FailAfter: failAfter}
+		sm := MultiplexedServer(&rwc{r: sr, w: sw})
+		cm := MultiplexedClient(multiplextest.Wrap(&rwc{r: cr, w: cw}, faults))
+		go func() {
+			if s, err := sm.Accept(); err == nil {
+				io.Copy(ioutil.Discard, s)
+			}
+		}()
+		written := make(chan error, 1)
+		go func() {
+			c, err := cm.Dial()
+			if err == nil {
+				_, err = c.Write(make([]byte, 1000))
+				if err == nil {
+					_, err = c.Read(make([]byte, 1))
+				}
+			}
+			written <- err
+		}()
+
+		select {
+		case err := <-written:
+			assert.Error(t, err, "failing after %d bytes", failAfter)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("channel hung after the transport failed after %d bytes", failAfter)
+		}
+		waitFor(t, func() bool { return cm.Err() != nil && sm.Err() != nil })
+		assert.True(t, errors.Is(cm.Err(), multiplextest.ErrInjected), "failing after %d bytes: %s", failAfter, cm.Err())
+		sm.Close()
+		cm.Close()
+	}
+}
+
+// A transport whose writes, once stalled, block until it is released, even if
+// it is closed meanwhile.
+type stallingConn struct {
+	io.ReadWriteCloser
+	stalled  int32
+	released chan struct{}
+}
+
+func (s *stallingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&s.stalled) != 0 {
+		<-s.released
+	}
+	return s.ReadWriteCloser.Write(b)
+}
+
+func TestOperationsAfterTransportFails(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	stalling := &stallingConn{ReadWriteCloser: &rwc{r: cr, w: cw}, released: make(chan struct{})}
+	conn := multiplextest.Wrap(stalling, multiplextest.Faults{})
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	cm := MultiplexedClient(conn)
+	defer cm.Close()
+	// Before Close, which waits for the writer.
+	defer close(stalling.released)
+
+	var channels []*Channel
+	for i := 0; i < 3; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		_, err = sm.Accept()
+		assert.NoError(t, err)
+		channels = append(channels, c)
+	}
+	writing, reading, flushing := channels[0], channels[1], channels[2]
+
+	// Once the writer is stuck on the transport, block in every way.
+	atomic.StoreInt32(&stalling.stalled, 1)
+	blocked := map[string]func() error{
+		"Write": func() error {
+			_, err := writing.Write(make([]byte, 2*initialWindow))
+			return err
+		},
+		"Read": func() error {
+			_, err := reading.Read(make([]byte, 1))
+			return err
+		},
+		"Dial": func() error {
+			_, err := cm.Dial()
+			return err
+		},
+		"Accept": func() error {
+			_, err := cm.Accept()
+			return err
+		},
+	}
+	errs := make(map[string]chan error)
+	for name, op := range blocked {
+		errs[name] = make(chan error, 1)
+		go func(op func() error, errs chan error) { errs <- op() }(op, errs[name])
+	}
+	waitFor(t, func() bool { return writing.SendWindow() == 0 })
+	flushing.SetWriteCoalescing(initialWindow, time.Hour)
+	_, err := flushing.Write([]byte("pending"))
+	assert.NoError(t, err)
+
+	conn.Fail()
+	assertFailed := func(name string, err error) {
+		assert.True(t, errors.Is(err, ErrSessionClosed), "%s: %v", name, err)
+		assert.True(t, errors.Is(err, multiplextest.ErrInjected), "%s: %v", name, err)
+		var terr *TransportError
+		assert.True(t, errors.As(err, &terr), "%s: %v", name, err)
+	}
+	for name, errs := range errs {
+		select {
+		case err := <-errs:
+			assertFailed(name, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s still blocked after the transport failed", name)
+		}
+	}
+
+	// And everything fails from now on.
+	for _, c := range channels {
+		_, err = c.Write([]byte("hello"))
+		assertFailed("Write", err)
+		_, err = c.Read(make([]byte, 1))
+		assertFailed("Read", err)
+		assertFailed("Flush", c.Flush())
+		assertFailed("Close", c.Close())
+	}
+	_, err = cm.Dial()
+	assertFailed("Dial", err)
+	assertFailed("Err", cm.Err())
+}
+
+func benchmarkWritePacket(b *testing.B, conn io.ReadWriteCloser) {
+	m := &MultiplexedStream{conn: conn, config: defaultConfig()}
+	p := &packet{id: 1, payload: make([]byte, 64)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	w := &countingWriter{WriteCloser: nopWriteCloser{ioutil.Discard}}
+	benchmarkWritePacket(b, &rwc{w: w})
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWritePacketTCP(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(b, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(b, err)
+	defer conn.Close()
+	benchmarkWritePacket(b, conn)
+}
+
 func TestChannelClientClose(t *testing.T) {
 	sm, cm := newServerAndClient()
 	wg := &sync.WaitGroup{}
@@ -150,7 +417,7 @@ func TestChannelClientClose(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NoError(t, err)
 	_, err = c.Write([]byte("PING"))
-	assert.Equal(t, io.EOF, err)
+	assert.True(t, errors.Is(err, ErrChannelClosed), "%s", err)
 
 	wg.Wait()
 }
@@ -184,115 +451,1722 @@ func TestChannelServerClose(t *testing.T) {
 	wg.Wait()
 }
 
-func TestMultiplexingServerClientPingPong(t *testing.T) {
-	clients := 100
-	packets := 100
-
+func TestErrors(t *testing.T) {
 	sm, cm := newServerAndClient()
-	wg := &sync.WaitGroup{}
+	defer sm.Close()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for i := 0; i < clients; i++ {
-			c, err := sm.Accept()
-			assert.NoError(t, err)
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				for i := 0; i < packets; i++ {
-					msg, id, err := readpacket(c)
-					assert.NoError(t, err)
-					assert.Equal(t, msg, fmt.Sprintf("PING%04d", i))
-					err = writepacket(c, fmt.Sprintf("PONG%04d", i), id)
-					assert.NoError(t, err)
-				}
-			}()
-		}
-	}()
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	d, err := cm.Dial()
+	assert.NoError(t, err)
+	e, err := sm.Accept()
+	assert.NoError(t, err)
 
-	for i := 0; i < clients; i++ {
-		c, err := cm.Dial()
-		assert.NoError(t, err)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for i := uint32(0); i < uint32(packets); i++ {
-				err = writepacket(c, fmt.Sprintf("PING%04d", i), i)
-				assert.NoError(t, err)
-				msg, id, err := readpacket(c)
-				assert.NoError(t, err)
-				assert.Equal(t, fmt.Sprintf("PONG%04d", i), msg)
-				assert.Equal(t, id, i)
-			}
-		}()
-	}
+	// Closed locally.
+	assert.NoError(t, c.Close())
+	assert.NoError(t, c.Close())
+	_, err = c.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrChannelClosed), "%s", err)
+	_, err = c.Write([]byte("PING"))
+	assert.True(t, errors.Is(err, ErrChannelClosed), "%s", err)
 
-	wg.Wait()
+	// Closed by the peer.
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	_, err = s.Write([]byte("PING"))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, s.Close())
 
-	sm.Close()
+	// Session closed.
+	assert.NoError(t, cm.Close())
+	_, err = cm.Accept()
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = cm.Dial()
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = d.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrSessionClosed), "%s", err)
+	_, err = d.Write([]byte("PING"))
+	assert.True(t, errors.Is(err, ErrSessionClosed), "%s", err)
+	assert.NoError(t, d.Close())
+
+	// Peer's session closed.
+	_, err = e.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrSessionClosed), "%s", err)
+	_, err = sm.Accept()
+	assert.Equal(t, ErrSessionClosed, err)
+
+	for _, err := range []error{ErrChannelClosed, ErrSessionClosed} {
+		assert.True(t, errors.Is(err, io.EOF), "%s", err)
+	}
+	assert.False(t, errors.Is(ErrChannelReset, io.EOF))
 }
 
-func ExampleMultiplexedServer() {
-	ln, err := net.Listen("tcp", ":1234")
-	if err != nil {
-		log.Fatal(err)
+func TestTransportError(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	sw.CloseWithError(reset)
+
+	_, err = c.Read(make([]byte, 1))
+	var terr *TransportError
+	if assert.True(t, errors.As(err, &terr), "expected *TransportError, got %v", err) {
+		assert.Equal(t, "read", terr.Op)
 	}
+	var operr *net.OpError
+	assert.True(t, errors.As(err, &operr))
+	assert.Equal(t, reset, operr)
+	assert.True(t, errors.Is(err, syscall.ECONNRESET))
 
-	// Network accept loop.
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Fatal(err)
-		}
+	_, err = cm.Dial()
+	assert.True(t, errors.Is(err, syscall.ECONNRESET), "%v", err)
+	assert.Equal(t, reset, errors.Unwrap(cm.Close()))
+}
 
-		// Multiplexer accept loop.
-		go func(conn net.Conn) {
-			mx := MultiplexedServer(conn)
-			for {
-				c, err := mx.Accept()
-				if err != nil {
-					log.Fatal(err)
-				}
+func TestStreamErr(t *testing.T) {
+	sm, cm := newServerAndClient()
+	assert.NoError(t, sm.Err())
+	assert.NoError(t, cm.Err())
 
-				// Channel handler.
-				go func(c *Channel) {
-					defer c.Close()
+	// Wait for the server to finish writing, so that it sees the transport
+	// close when reading.
+	_, err := cm.Ping(context.Background())
+	assert.NoError(t, err)
 
-					// Read "hello" from client.
-					b := make([]byte, 5)
-					_, err := c.Read(b)
-					if err != nil {
-						log.Fatal(err)
-					}
+	assert.NoError(t, cm.Close())
+	assert.Equal(t, ErrSessionClosed, cm.Err())
+	// The peer sees the transport close.
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.Equal(t, ErrSessionClosed, sm.Err())
 
-					fmt.Printf("Received: %s\n", b)
-				}(c)
-			}
-		}(conn)
+	// Stable once set.
+	assert.NoError(t, sm.Close())
+	assert.Equal(t, ErrSessionClosed, sm.Err())
+}
+
+func TestChannelCloseWithError(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = s.Write([]byte("PONG"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.CloseWithError(42, "bad request"))
+
+	// Data sent before the close is still delivered.
+	b := make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG", string(b))
+
+	_, err = c.Read(b)
+	var cerr *ChannelError
+	if assert.True(t, errors.As(err, &cerr), "expected *ChannelError, got %v", err) {
+		assert.Equal(t, uint32(42), cerr.Code())
+		assert.Equal(t, "bad request", cerr.Message())
 	}
+	_, err = c.Write([]byte("PING"))
+	assert.True(t, errors.Is(err, cerr), "%s", err)
+
+	// Locally the channel was closed normally.
+	_, err = s.Read(b)
+	assert.True(t, errors.Is(err, ErrChannelClosed), "%s", err)
 }
 
-func ExampleMultiplexedClient() {
-	conn, err := net.Dial("tcp", "127.0.0.1:1234")
-	if err != nil {
-		log.Fatal(err)
+func TestChannelReset(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return sm.Buffered() > 0 })
+
+	assert.NoError(t, c.Reset())
+	assert.NoError(t, c.Reset())
+
+	// Unread data is discarded by the peer.
+	waitFor(t, func() bool { return sm.Buffered() == 0 })
+	_, err = s.Read(make([]byte, 4))
+	assert.True(t, errors.Is(err, ErrChannelReset), "%s", err)
+	_, err = s.Write([]byte("PONG"))
+	assert.True(t, errors.Is(err, ErrChannelReset), "%s", err)
+
+	_, err = c.Read(make([]byte, 4))
+	assert.True(t, errors.Is(err, ErrChannelClosed), "%s", err)
+}
+
+func TestChannelDone(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	pair := func() (*Channel, *Channel) {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		return c, s
+	}
+	done := func(c *Channel) bool {
+		select {
+		case <-c.Done():
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
 	}
-	mx := MultiplexedClient(conn)
 
-	// Create 10000 multiplexed connections over the socket and send "hello".
-	for i := 0; i < 10000; i++ {
-		go func() {
-			c, err := mx.Dial()
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer c.Close()
+	c, s := pair()
+	assert.Equal(t, c.Done(), c.Done())
+	assert.NoError(t, c.Err())
+	select {
+	case <-c.Done():
+		t.Fatal("open channel is done")
+	default:
+	}
+	assert.NoError(t, c.Close())
+	assert.True(t, done(c))
+	assert.True(t, errors.Is(c.Err(), ErrChannelClosed), "%s", c.Err())
+	assert.True(t, done(s))
+	assert.Equal(t, io.EOF, s.Err())
 
-			_, err = c.Write([]byte("hello"))
-			if err != nil {
-				log.Fatal(err)
-			}
-		}()
+	c, s = pair()
+	assert.NoError(t, s.Reset())
+	assert.True(t, done(c))
+	assert.True(t, errors.Is(c.Err(), ErrChannelReset), "%s", c.Err())
+
+	// Closed for writing by both ends.
+	c, s = pair()
+	assert.NoError(t, c.CloseWrite())
+	assert.NoError(t, s.CloseWrite())
+	assert.True(t, done(c))
+	assert.True(t, done(s))
+	assert.Equal(t, io.EOF, c.Err())
+
+	c, s = pair()
+	assert.NoError(t, cm.Close())
+	assert.True(t, done(c))
+	assert.True(t, done(s))
+	assert.True(t, errors.Is(c.Err(), ErrSessionClosed), "%s", c.Err())
+	assert.Equal(t, c.Err(), c.Err())
+}
+
+func TestChannelResetStalledTransport(t *testing.T) {
+	// The server never reads, so nothing written by the client is sent.
+	cr, _ := io.Pipe()
+	_, cw := io.Pipe()
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithAsyncDial())
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	go c.Write(make([]byte, FragmentSize*4))
+
+	done := make(chan struct{})
+	go func() {
+		c.Reset()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reset blocked")
 	}
 }
+
+func TestChannelCloseWrite(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		request, err := ioutil.ReadAll(s)
+		assert.NoError(t, err)
+		assert.Equal(t, "REQUEST", string(request))
+		_, err = s.Write([]byte("RESPONSE"))
+		assert.NoError(t, err)
+		assert.NoError(t, s.CloseWrite())
+	}()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("REQUEST"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.CloseWrite())
+	_, err = c.Write([]byte("MORE"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	response, err := ioutil.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "RESPONSE", string(response))
+	wg.Wait()
+
+	// Both directions are closed on both ends, so the channel is released.
+	for _, m := range []*MultiplexedStream{sm, cm} {
+		m := m
+		waitFor(t, func() bool { return m.channels.len() == 0 })
+	}
+}
+
+func TestChannelCloseRead(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("DISCARDED"))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return sm.Buffered() > 0 })
+
+	assert.NoError(t, s.CloseRead())
+	assert.Equal(t, 0, sm.Buffered())
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// The peer can keep writing well beyond the receive window.
+	_, err = c.Write(make([]byte, initialWindow*4))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sm.Buffered())
+
+	// And the other direction still works.
+	_, err = s.Write([]byte("PONG"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG", string(b))
+}
+
+// Counts the RSTs a stream sends for each channel.
+type resetCounter struct {
+	lock   sync.Mutex
+	resets map[uint32]int
+}
+
+func (r *resetCounter) hook(dir Direction, f FrameInfo) error {
+	if dir == Outbound && f.Type == FrameData && f.Flags&RST != 0 {
+		r.lock.Lock()
+		if r.resets == nil {
+			r.resets = make(map[uint32]int)
+		}
+		r.resets[f.Channel]++
+		r.lock.Unlock()
+	}
+	return nil
+}
+
+func (r *resetCounter) count(id uint32) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.resets[id]
+}
+
+func TestChannelCloseTwice(t *testing.T) {
+	resets := &resetCounter{}
+	sm, cm := newServerAndClient(WithFrameHook(resets.hook))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	assert.NoError(t, c.Close())
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, c.Close())
+	waitFor(t, func() bool { return sm.NumChannels() == 0 })
+
+	// Closing again returns the error the channel first failed with.
+	c, err = cm.Dial()
+	assert.NoError(t, err)
+	s, err = sm.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, s.CloseWithError(42, "no"))
+	waitFor(t, func() bool { return cm.NumChannels() == 0 })
+	err = c.Close()
+	var cerr *ChannelError
+	assert.True(t, errors.As(err, &cerr), "%v", err)
+	assert.Equal(t, err.Error(), c.Close().Error())
+
+	assert.NoError(t, cm.Err())
+	assert.NoError(t, sm.Err())
+	assert.Equal(t, 1, resets.count(3))
+	assert.Equal(t, uint64(0), sm.StrayPackets())
+}
+
+func TestChannelCloseConcurrently(t *testing.T) {
+	resets := &resetCounter{}
+	sm, cm := newServerAndClient(WithFrameHook(resets.hook))
+	defer sm.Close()
+	defer cm.Close()
+
+	for i := 0; i < 100; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		_, err = c.Write([]byte("hello"))
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+
+		errs := make(chan error, 2)
+		for j := 0; j < 2; j++ {
+			go func() { errs <- c.Close() }()
+		}
+		assert.NoError(t, <-errs)
+		assert.NoError(t, <-errs)
+		b, err := ioutil.ReadAll(s)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		assert.Equal(t, 1, resets.count(c.ID()))
+	}
+	assert.NoError(t, cm.Err())
+	assert.NoError(t, sm.Err())
+}
+
+func TestChannelCloseRacingPeer(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	for i := 0; i < 100; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+
+		errs := make(chan error, 2)
+		go func() { errs <- c.Close() }()
+		go func() { errs <- s.Close() }()
+		assert.NoError(t, <-errs)
+		assert.NoError(t, <-errs)
+
+		// Both ends forget the channel, whichever closed it first.
+		waitFor(t, func() bool { return cm.NumChannels() == 0 && sm.NumChannels() == 0 })
+		_, err = c.Read(make([]byte, 1))
+		assert.True(t, errors.Is(err, io.EOF), "%v", err)
+		_, err = s.Write([]byte("hello"))
+		assert.Error(t, err)
+		assert.NoError(t, c.Close())
+		assert.NoError(t, s.Close())
+	}
+	assert.NoError(t, cm.Err())
+	assert.NoError(t, sm.Err())
+}
+
+func TestDialRacingClose(t *testing.T) {
+	for i := 0; i < 2000; i++ {
+		sm, cm := newServerAndClient()
+		go func() {
+			for {
+				if _, err := sm.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+
+		const dials = 4
+		type dialled struct {
+			c   *Channel
+			err error
+		}
+		results := make(chan dialled, dials)
+		for j := 0; j < dials; j++ {
+			async := j%2 == 1
+			go func() {
+				var d dialled
+				if async {
+					d.c, d.err = cm.DialAsync(context.Background())
+				} else {
+					d.c, d.err = cm.Dial()
+				}
+				results <- d
+			}()
+		}
+		assert.NoError(t, cm.Close())
+
+		// Each Dial either opened a channel, which Close has since closed,
+		// or failed because the stream was closed.
+		for j := 0; j < dials; j++ {
+			d := <-results
+			if d.err != nil {
+				assert.Nil(t, d.c)
+				assert.True(t, errors.Is(d.err, ErrSessionClosed), "%v", d.err)
+				continue
+			}
+			_, err := d.c.Write([]byte("hello"))
+			assert.True(t, errors.Is(err, ErrSessionClosed), "%v", err)
+		}
+		assert.True(t, errors.Is(cm.Wait(), ErrSessionClosed))
+		assert.Equal(t, 0, cm.NumChannels())
+		sm.Close()
+	}
+}
+
+func TestMultiplexingServerClientPingPong(t *testing.T) {
+	clients := 100
+	packets := 100
+
+	sm, cm := newServerAndClient()
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < clients; i++ {
+			c, err := sm.Accept()
+			assert.NoError(t, err)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < packets; i++ {
+					msg, id, err := readpacket(c)
+					assert.NoError(t, err)
+					assert.Equal(t, msg, fmt.Sprintf("PING%04d", i))
+					err = writepacket(c, fmt.Sprintf("PONG%04d", i), id)
+					assert.NoError(t, err)
+				}
+			}()
+		}
+	}()
+
+	for i := 0; i < clients; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint32(0); i < uint32(packets); i++ {
+				err = writepacket(c, fmt.Sprintf("PING%04d", i), i)
+				assert.NoError(t, err)
+				msg, id, err := readpacket(c)
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("PONG%04d", i), msg)
+				assert.Equal(t, id, i)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	sm.Close()
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestChannelTLS(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c, err := sm.Accept()
+		assert.NoError(t, err)
+		if err != nil {
+			return
+		}
+		cfg := &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}}
+		tc := tls.Server(c, cfg)
+		defer tc.Close()
+		b := make([]byte, 4)
+		_, err = io.ReadFull(tc, b)
+		assert.NoError(t, err)
+		assert.Equal(t, "PING", string(b))
+		_, err = tc.Write([]byte("PONG"))
+		assert.NoError(t, err)
+	}()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	err = tc.Handshake()
+	assert.NoError(t, err)
+	_, err = tc.Write([]byte("PING"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(tc, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PONG", string(b))
+	tc.Close()
+
+	wg.Wait()
+}
+
+func TestChannelDeadline(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	err = c.SetDeadline(time.Now().Add(time.Millisecond * 50))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = c.Read(b)
+	assert.Error(t, err)
+	nerr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, nerr.Timeout())
+
+	// Clearing the deadline makes the channel usable again.
+	err = c.SetDeadline(time.Time{})
+	assert.NoError(t, err)
+	_, err = s.Write([]byte("PING"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+}
+
+func TestChannelReadDeadlineInterruptsRead(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 4))
+		errs <- err
+	}()
+
+	// Set the deadline while the Read is already blocked.
+	time.Sleep(time.Millisecond * 20)
+	err = c.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+	assert.NoError(t, err)
+	select {
+	case err = <-errs:
+		nerr, ok := err.(net.Error)
+		assert.True(t, ok)
+		assert.True(t, ok && nerr.Timeout())
+	case <-time.After(time.Second):
+		t.Fatal("Read was not interrupted by deadline")
+	}
+
+	// The channel is still usable once the deadline is cleared.
+	err = c.SetReadDeadline(time.Time{})
+	assert.NoError(t, err)
+	_, err = s.Write([]byte("PING"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+}
+
+func TestChannelReadDeadlineInPast(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	_, err = s.Write([]byte("PING"))
+	assert.NoError(t, err)
+
+	// An expired deadline takes precedence over buffered data.
+	err = c.SetReadDeadline(time.Now().Add(-time.Second))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = c.Read(b)
+	assertTimeout(t, err)
+
+	err = c.SetReadDeadline(time.Time{})
+	assert.NoError(t, err)
+	_, err = io.ReadFull(c, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+}
+
+func TestChannelWriteDeadline(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithAsyncDial())
+	defer cm.Close()
+
+	// Nothing is reading from the server end yet, so writes will stall once
+	// the outbound queue fills up.
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	err = c.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	assert.NoError(t, err)
+	n, err := c.Write(make([]byte, FragmentSize*4096))
+	assertTimeout(t, err)
+	assert.True(t, n > 0 && n < FragmentSize*4096)
+	assert.Equal(t, 0, n%FragmentSize)
+
+	// Once the server starts reading, exactly the bytes that were accepted by
+	// Write should arrive intact, followed by anything written afterwards.
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	err = c.SetWriteDeadline(time.Time{})
+	assert.NoError(t, err)
+	go c.Write([]byte("PING"))
+
+	b := make([]byte, n+4)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, n), b[:n])
+	assert.Equal(t, "PING", string(b[n:]))
+}
+
+func TestStreamDeadline(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	err = sm.SetDeadline(time.Now().Add(time.Millisecond * 50))
+	assert.NoError(t, err)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := s.Read(make([]byte, 4))
+		assertTimeout(t, err)
+	}()
+	_, err = sm.Accept()
+	assertTimeout(t, err)
+	wg.Wait()
+
+	_, err = sm.Dial()
+	assertTimeout(t, err)
+	_, err = s.Write([]byte("PING"))
+	assertTimeout(t, err)
+
+	// The stream survives the deadline.
+	err = sm.SetDeadline(time.Time{})
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("PING"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer cm.Close()
+
+	// Nothing is reading from the server end, so dials will eventually stall
+	// once the outbound queue fills with SYNs.
+	dialled := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		_, err := cm.DialContext(ctx)
+		cancel()
+		if err != nil {
+			assert.Equal(t, context.DeadlineExceeded, err)
+			break
+		}
+		dialled++
+	}
+
+	// The abandoned channel should not be registered locally...
+	assert.Equal(t, dialled, cm.channels.len())
+
+	// ...or visible to the peer.
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	for i := 0; i < dialled; i++ {
+		_, err := sm.Accept()
+		assert.NoError(t, err)
+	}
+	err := sm.SetDeadline(time.Now().Add(time.Millisecond * 50))
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.Equal(t, errTimeout, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cm.DialContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestAcceptContext(t *testing.T) {
+	const channels = 100
+	sm, cm := newServerAndClient(WithAcceptBacklog(channels))
+	defer sm.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := sm.AcceptContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// Race cancellation against incoming channels; none should be dropped.
+	accepted := 0
+	for i := 0; i < channels; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan *Channel)
+		go func() {
+			ch, _ := sm.AcceptContext(ctx)
+			result <- ch
+		}()
+		_, err := cm.Dial()
+		assert.NoError(t, err)
+		cancel()
+		if <-result != nil {
+			accepted++
+		}
+	}
+	err = sm.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	assert.NoError(t, err)
+	for {
+		if _, err := sm.Accept(); err != nil {
+			break
+		}
+		accepted++
+	}
+	assert.Equal(t, channels, accepted)
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	sm, cm := newServerAndClient(WithAcceptBacklog(2))
+	defer sm.Close()
+	defer cm.Close()
+
+	// Dial returns once the channel is queued.
+	for i := 0; i < 2; i++ {
+		_, err := cm.Dial()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, sm.AcceptBacklog())
+
+	// Once the backlog is full the peer is told to try again later.
+	_, err := cm.Dial()
+	assert.Equal(t, ErrBusy, err)
+	assert.Equal(t, 2, sm.AcceptBacklog())
+
+	// Accepting makes room.
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sm.AcceptBacklog())
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sm.AcceptBacklog())
+}
+
+func TestAcceptBacklogRace(t *testing.T) {
+	const channels = 200
+	sm, cm := newServerAndClient(WithAcceptBacklog(1))
+	defer sm.Close()
+	defer cm.Close()
+
+	// Accept concurrently with channels arriving, so that slots are freed
+	// while the reader is deciding whether to refuse. Every channel must
+	// end up either accepted or refused, never both or neither.
+	accepted := make(chan int)
+	go func() {
+		n := 0
+		for {
+			s, err := sm.Accept()
+			if err != nil {
+				accepted <- n
+				return
+			}
+			n++
+			s.Close()
+		}
+	}()
+
+	refused := 0
+	for i := 0; i < channels; i++ {
+		c, err := cm.Dial()
+		if err == nil {
+			_, err = c.Read(make([]byte, 1))
+		}
+		switch err {
+		case ErrBusy:
+			refused++
+		case io.EOF:
+		default:
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	err := sm.SetDeadline(time.Now().Add(time.Millisecond * 100))
+	assert.NoError(t, err)
+	assert.Equal(t, channels, refused+<-accepted)
+	waitFor(t, func() bool { return sm.channels.len() == 0 && cm.channels.len() == 0 })
+}
+
+func TestFlowControl(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	bulk, err := cm.Dial()
+	assert.NoError(t, err)
+	sbulk, err := sm.Accept()
+	assert.NoError(t, err)
+	ping, err := cm.Dial()
+	assert.NoError(t, err)
+	sping, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// The peer isn't reading, so the write stalls once the window is used up.
+	err = bulk.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	assert.NoError(t, err)
+	n, err := bulk.Write(make([]byte, initialWindow*4))
+	assert.Equal(t, errTimeout, err)
+	assert.Equal(t, initialWindow, n)
+
+	// Other channels are unaffected.
+	_, err = ping.Write([]byte("PING"))
+	assert.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(sping, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", string(b))
+
+	// Reading from the stalled channel opens the window again.
+	err = bulk.SetWriteDeadline(time.Time{})
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := bulk.Write(make([]byte, initialWindow*4))
+		done <- err
+	}()
+	_, err = io.ReadFull(sbulk, make([]byte, initialWindow*5))
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+}
+
+func TestDefaultWindow(t *testing.T) {
+	const window = 1024 * 1024
+	sm, cm := newServerAndClient(WithDefaultWindow(window))
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// Both ends advertise the larger window.
+	for _, ch := range []*Channel{c, s} {
+		err = ch.SetWriteDeadline(time.Now().Add(time.Millisecond * 200))
+		assert.NoError(t, err)
+		n, err := ch.Write(make([]byte, window*2))
+		assert.Equal(t, errTimeout, err)
+		assert.Equal(t, window, n)
+	}
+}
+
+func TestWindowAutoTuning(t *testing.T) {
+	const max = 4 * 1024 * 1024
+	sm, cm := newDelayedServerAndClient(time.Millisecond*5, WithWindowAutoTuning(max))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Reading as fast as possible grows the window.
+	_, err = io.ReadFull(s, make([]byte, 16*1024*1024))
+	assert.NoError(t, err)
+	assert.True(t, sm.RTT() > 0)
+	window := s.WindowSize()
+	assert.True(t, window > initialWindow && window <= max, "window is %d", window)
+
+	// Reading slowly shrinks it again.
+	for i := 0; i < 16 && s.WindowSize() > initialWindow; i++ {
+		time.Sleep(sm.RTT() * 20)
+		_, err = io.ReadFull(s, make([]byte, s.WindowSize()/2))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint32(initialWindow), s.WindowSize())
+}
+
+func TestChannelPauseResume(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	other, err := cm.Dial()
+	assert.NoError(t, err)
+	sother, err := sm.Accept()
+	assert.NoError(t, err)
+
+	s.Pause()
+	written := make(chan int)
+	go func() {
+		n, _ := c.Write(make([]byte, initialWindow*2))
+		written <- n
+	}()
+
+	// Everything the peer was granted before pausing can still be read, but
+	// it then stalls.
+	_, err = io.ReadFull(s, make([]byte, initialWindow))
+	assert.NoError(t, err)
+	select {
+	case <-written:
+		t.Fatal("Write should block while paused")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// Other channels keep flowing.
+	_, err = other.Write([]byte("PING"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(sother, make([]byte, 4))
+	assert.NoError(t, err)
+
+	s.Resume()
+	_, err = io.ReadFull(s, make([]byte, initialWindow))
+	assert.NoError(t, err)
+	assert.Equal(t, initialWindow*2, <-written)
+}
+
+func TestChannelWindows(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(initialWindow), c.SendWindow())
+	assert.Equal(t, uint32(initialWindow), s.RecvWindow())
+
+	_, err = c.Write(make([]byte, 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(initialWindow-1000), c.SendWindow())
+	_, err = io.ReadFull(s, make([]byte, 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(initialWindow-1000), s.RecvWindow())
+
+	// Reading half the window grants it back to the peer.
+	go c.Write(make([]byte, initialWindow/2))
+	_, err = io.ReadFull(s, make([]byte, initialWindow/2))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(initialWindow), s.RecvWindow())
+	waitFor(t, func() bool { return c.SendWindow() == initialWindow })
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	sm, cm := newServerAndClient(WithMaxBufferedBytes(100 * 1024))
+	defer sm.Close()
+
+	var clients, servers []*Channel
+	for i := 0; i < 3; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		_, err = c.Write(make([]byte, initialWindow))
+		assert.NoError(t, err)
+		clients = append(clients, c)
+		servers = append(servers, s)
+	}
+	waitFor(t, func() bool { return sm.Buffered() == initialWindow*3 })
+
+	// Over budget, so partially reading a channel doesn't grant more window.
+	_, err := io.ReadFull(servers[0], make([]byte, 40*1024))
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, uint32(0), clients[0].SendWindow())
+
+	// Draining another channel brings the stream back under budget.
+	_, err = io.ReadFull(servers[1], make([]byte, initialWindow))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return clients[0].SendWindow() == 40*1024 })
+
+	// A channel larger than its share of the budget can still be read in its
+	// entirety, as a channel with nothing buffered is always granted window.
+	_, err = io.ReadFull(servers[2], make([]byte, initialWindow))
+	assert.NoError(t, err)
+	go clients[1].Write(make([]byte, 1024*1024))
+	_, err = io.ReadFull(servers[1], make([]byte, 1024*1024))
+	assert.NoError(t, err)
+}
+
+// Write the handshake to w as the peer would.
+func sendHandshake(w io.Writer) error {
+	_, err := io.WriteString(w, handshakeMagic+"\x00\x03\x00\x00")
+	return err
+}
+
+// Write a packet to w as the peer would.
+func writeFrame(w io.Writer, typ, flags uint8, id uint32, payload []byte) error {
+	hdr := header{Type: typ, Flags: flags, ID: id, Length: uint32(len(payload))}
+	if err := binary.Write(w, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func settingsPayload(maxFrameSize uint32) []byte {
+	payload := make([]byte, settingSize)
+	binary.BigEndian.PutUint16(payload, settingMaxFrameSize)
+	binary.BigEndian.PutUint32(payload[2:], maxFrameSize)
+	return payload
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	cr, sw := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	close(w.release)
+	cm := MultiplexedClient(&rwc{r: cr, w: w}, WithMaxFrameSize(64*1024))
+	defer cm.Close()
+	assert.Equal(t, uint32(FragmentSize), cm.MaxFrameSize())
+
+	// The smaller of the two sizes is used.
+	assert.NoError(t, sendHandshake(sw))
+	err := writeFrame(sw, typeSettings, 0, 0, settingsPayload(16*1024))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return cm.MaxFrameSize() == 16*1024 })
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.Write(make([]byte, 40*1024))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(w.dataPackets()) == 3 })
+
+	var sizes []uint32
+	for _, hdr := range w.headers() {
+		if hdr.Type == typeData && hdr.Length > 0 {
+			sizes = append(sizes, hdr.Length)
+		}
+	}
+	assert.Equal(t, []uint32{16 * 1024, 16 * 1024, 8 * 1024}, sizes)
+}
+
+func TestMaxFrameSizeNegotiated(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithMaxFrameSize(16*1024))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithMaxFrameSize(256*1024))
+	defer sm.Close()
+	defer cm.Close()
+
+	waitFor(t, func() bool { return cm.MaxFrameSize() == 16*1024 })
+	assert.Equal(t, uint32(16*1024), sm.MaxFrameSize())
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	data := make([]byte, 256*1024)
+	go c.Write(data)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, data)
+	assert.NoError(t, err)
+	assert.NoError(t, sm.Err())
+}
+
+func TestMaxFrameSizeExceeded(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	// The stream fails, and closes the transport, as soon as it reads the
+	// header.
+	assert.NoError(t, sendHandshake(cw))
+	writeFrame(cw, typeData, SYN, 1, make([]byte, FragmentSize*2))
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol), "%s", sm.Err())
+}
+
+func TestOversizedLength(t *testing.T) {
+	for _, test := range []struct {
+		typ    uint8
+		id     uint32
+		length uint32
+		err    string
+	}{
+		{typeData, 1, FragmentSize + 1, "protocol error: packet of 1025 bytes on channel 1 exceeds the maximum of 1024"},
+		{typeData, 7, maxPayloadSize, "protocol error: packet of 16777215 bytes on channel 7 exceeds the maximum of 1024"},
+		{typeWindowUpdate, 3, maxPayloadSize, "protocol error: packet of 16777215 bytes on channel 3 exceeds the maximum of 1024"},
+		{200, 0, maxPayloadSize, "protocol error: packet of 16777215 bytes on channel 0 exceeds the maximum of 1024"},
+		// The top byte of the length holds flags, so this claims no payload.
+		{typeData, 1, 0x80000000, "protocol error: unknown flags 0x8000 on channel 1"},
+	} {
+		sr, cw := io.Pipe()
+		cr, sw := io.Pipe()
+		go io.Copy(ioutil.Discard, cr)
+		sm := MultiplexedServer(&rwc{r: sr, w: sw})
+
+		// Only the header is sent: the stream fails without waiting for,
+		// or allocating room for, the payload.
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		assert.NoError(t, sendHandshake(cw))
+		go io.WriteString(cw, rawFrame(test.typ, 0, test.id, test.length, ""))
+		_, err := sm.Accept()
+		runtime.ReadMemStats(&after)
+		assert.Equal(t, test.err, err.Error())
+		assert.Equal(t, err, sm.Err())
+		assert.True(t, after.TotalAlloc-before.TotalAlloc < 1<<20, "allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+		sm.Close()
+	}
+}
+
+func TestMaxReceiveFrameSize(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithMaxReceiveFrameSize(16*1024))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithMaxFrameSize(256*1024))
+	defer sm.Close()
+	defer cm.Close()
+
+	// Each end sends no more than the other receives.
+	waitFor(t, func() bool { return cm.MaxFrameSize() == 16*1024 })
+	waitFor(t, func() bool { return sm.MaxFrameSize() == FragmentSize })
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	data := make([]byte, 64*1024)
+	go c.Write(data)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, data)
+	assert.NoError(t, err)
+	go s.Write(data)
+	_, err = io.ReadFull(c, data)
+	assert.NoError(t, err)
+	assert.NoError(t, sm.Err())
+	assert.NoError(t, cm.Err())
+}
+
+func TestUnknownPacketType(t *testing.T) {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	// Skipped without losing track of where the next packet starts.
+	assert.NoError(t, sendHandshake(cw))
+	assert.NoError(t, writeFrame(cw, 200, 0, 1, []byte("from the future")))
+	assert.NoError(t, writeFrame(cw, typeData, SYN, 1, []byte("hello")))
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), sm.UnknownPackets())
+	assert.NoError(t, sm.Err())
+}
+
+func TestUnknownPacketTypeStrict(t *testing.T) {
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go io.Copy(ioutil.Discard, cr)
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithStrictPacketTypes())
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	go writeFrame(cw, 200, 0, 1, nil)
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol))
+	assert.Equal(t, "protocol error: unknown packet type 200", sm.Err().Error())
+	assert.Equal(t, uint64(0), sm.UnknownPackets())
+}
+
+func TestMaxFrameSizeInvalid(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	err := writeFrame(cw, typeSettings, 0, 0, settingsPayload(0))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol))
+	assert.Contains(t, sm.Err().Error(), "max frame size of 0 bytes")
+}
+
+func TestChannelAddr(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	assert.Equal(t, "multiplex", c.LocalAddr().Network())
+	assert.Equal(t, "ch/3", c.LocalAddr().String())
+	assert.Equal(t, "ch/3", c.RemoteAddr().String())
+}
+
+func TestChannelAddrTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	cm := MultiplexedClient(conn)
+	defer cm.Close()
+	sm := MultiplexedServer(<-accepted)
+	defer sm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, "multiplex", c.RemoteAddr().Network())
+	assert.Equal(t, fmt.Sprintf("%s/ch/%d", conn.LocalAddr(), c.ID()), c.LocalAddr().String())
+	assert.Equal(t, fmt.Sprintf("%s/ch/%d", ln.Addr(), c.ID()), c.RemoteAddr().String())
+	assert.Equal(t, c.LocalAddr().String(), s.RemoteAddr().String())
+	assert.Equal(t, c.RemoteAddr().String(), s.LocalAddr().String())
+	assert.Equal(t, conn.LocalAddr(), c.LocalAddr().(*Addr).Addr)
+}
+
+func TestAddrString(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 443}
+	assert.Equal(t, "10.0.0.5:443/ch/42", (&Addr{Addr: tcp, ID: 42}).String())
+	assert.Equal(t, "[::1]:443/ch/7", (&Addr{Addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 443}, ID: 7}).String())
+	assert.Equal(t, "/tmp/sock/ch/1", (&Addr{Addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, ID: 1}).String())
+	assert.Equal(t, "ch/42", (&Addr{ID: 42}).String())
+}
+
+func ExampleMultiplexedServer() {
+	ln, err := net.Listen("tcp", ":1234")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Network accept loop.
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Multiplexer accept loop.
+		go func(conn net.Conn) {
+			mx := MultiplexedServer(conn)
+			for {
+				c, err := mx.Accept()
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				// Channel handler.
+				go func(c *Channel) {
+					defer c.Close()
+
+					// Read "hello" from client.
+					b := make([]byte, 5)
+					_, err := c.Read(b)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					fmt.Printf("Received: %s\n", b)
+				}(c)
+			}
+		}(conn)
+	}
+}
+
+func ExampleMultiplexedClient() {
+	conn, err := net.Dial("tcp", "127.0.0.1:1234")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mx := MultiplexedClient(conn)
+
+	// Create 10000 multiplexed connections over the socket and send "hello".
+	for i := 0; i < 10000; i++ {
+		go func() {
+			c, err := mx.Dial()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer c.Close()
+
+			_, err = c.Write([]byte("hello"))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+
+	buf := make([]byte, 1024)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	_, err = io.ReadFull(s, make([]byte, len(buf)*b.N))
+	assert.NoError(b, err)
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	hdr := header{Type: typeWindowUpdate, Flags: SYN | FIN, ID: 0x01020304, Length: 0xfffffffe}
+	expected := &bytes.Buffer{}
+	err := binary.Write(expected, binary.BigEndian, &hdr)
+	assert.NoError(t, err)
+
+	var b [headerSize]byte
+	hdr.encode(b[:])
+	assert.Equal(t, expected.Bytes(), b[:])
+
+	var decoded header
+	decoded.decode(b[:])
+	assert.Equal(t, hdr, decoded)
+}
+
+var benchHeader header
+
+func BenchmarkHeaderEncode(b *testing.B) {
+	hdr := header{Type: typeData, ID: 1, Length: 1024}
+	var buf [headerSize]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hdr.encode(buf[:])
+	}
+}
+
+func BenchmarkHeaderDecode(b *testing.B) {
+	hdr := header{Type: typeData, ID: 1, Length: 1024}
+	var buf [headerSize]byte
+	hdr.encode(buf[:])
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchHeader.decode(buf[:])
+	}
+}
+
+func TestChannelsHaveNoGoroutines(t *testing.T) {
+	sm, cm := newServerAndClient(WithChannelIdleTimeout(time.Hour))
+	defer sm.Close()
+	defer cm.Close()
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		_, err := cm.Dial()
+		assert.NoError(t, err)
+		_, err = sm.Accept()
+		assert.NoError(t, err)
+	}
+	assert.True(t, runtime.NumGoroutine()-goroutines < 10, "%d goroutines", runtime.NumGoroutine()-goroutines)
+}
+
+// Memory and goroutines used by each idle channel, counting both ends.
+func BenchmarkIdleChannels(b *testing.B) {
+	const channels = 100000
+	for i := 0; i < b.N; i++ {
+		sm, cm := newServerAndClient()
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		goroutines := runtime.NumGoroutine()
+
+		accepted := make(chan []*Channel)
+		go func() {
+			var chs []*Channel
+			for len(chs) < channels {
+				ch, err := sm.Accept()
+				if err != nil {
+					break
+				}
+				chs = append(chs, ch)
+			}
+			accepted <- chs
+		}()
+		var dialed []*Channel
+		for j := 0; j < channels; j++ {
+			c, err := cm.Dial()
+			assert.NoError(b, err)
+			dialed = append(dialed, c)
+		}
+		assert.Equal(b, channels, len(<-accepted))
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapInuse-before.HeapInuse)/channels, "B/channel")
+		b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/channels, "goroutines/channel")
+		runtime.KeepAlive(dialed)
+		sm.Close()
+		cm.Close()
+	}
+}
+
+// Goroutines concurrently opening, using, and closing channels, which all
+// contend on the channel registry.
+func BenchmarkChannelsParallel(b *testing.B) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	go func() {
+		for {
+			s, err := sm.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 16)
+		for pb.Next() {
+			c, err := cm.Dial()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err = c.Write(buf); err == nil {
+				_, err = io.ReadFull(c, buf)
+			}
+			c.Close()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestChannelID(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, c.ID(), s.ID())
+		assert.Equal(t, uint32(1), c.ID()%2, "clients dial odd IDs")
+
+		// Errors name the channel, at both ends.
+		assert.NoError(t, s.Reset())
+		_, err = c.Read(make([]byte, 1))
+		assert.True(t, errors.Is(err, ErrChannelReset), "%s", err)
+		assert.Equal(t, fmt.Sprintf("channel %d: %s", c.ID(), ErrChannelReset), err.Error())
+		_, err = s.Read(make([]byte, 1))
+		assert.Equal(t, fmt.Sprintf("channel %d: %s", s.ID(), ErrChannelClosed), err.Error())
+
+		// The ID is unchanged once closed.
+		assert.Equal(t, c.ID(), s.ID())
+	}
+}
+
+func TestChannelIDsExhausted(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	// Three IDs from the end.
+	atomic.StoreUint32(&cm.id, math.MaxUint32-4)
+	for i := 0; i < 2; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, c.id, s.id)
+	}
+	_, err := cm.Dial()
+	assert.Equal(t, ErrChannelIDsExhausted, err)
+	_, err = cm.Dial()
+	assert.Equal(t, ErrChannelIDsExhausted, err)
+
+	// The peer is told to go away, but existing channels are unaffected.
+	waitFor(t, sm.GoingAway)
+	assert.Equal(t, 2, cm.channels.len())
+}
+
+func TestChannelIDReused(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	go io.Copy(ioutil.Discard, cr)
+
+	assert.NoError(t, sendHandshake(cw))
+	assert.NoError(t, writeFrame(cw, typeData, SYN, 1, nil))
+	_, err := sm.Accept()
+	assert.NoError(t, err)
+	writeFrame(cw, typeData, SYN, 1, nil)
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol), "%s", sm.Err())
+}
+
+func TestChannelIDParity(t *testing.T) {
+	for _, advertise := range []bool{true, false} {
+		cr, sw := io.Pipe()
+		sr, cw := io.Pipe()
+		sm := MultiplexedServer(&rwc{r: sr, w: sw})
+		go io.Copy(ioutil.Discard, cr)
+		assert.NoError(t, sendHandshake(cw))
+
+		if advertise {
+			payload := make([]byte, settingSize)
+			binary.BigEndian.PutUint16(payload, settingChannelIDParity)
+			binary.BigEndian.PutUint32(payload[2:], 1)
+			assert.NoError(t, writeFrame(cw, typeSettings, 0, 0, payload))
+		}
+		// A server's ID, from a client.
+		writeFrame(cw, typeData, SYN, 2, nil)
+		if advertise {
+			waitFor(t, func() bool { return sm.Err() != nil })
+			assert.True(t, errors.Is(sm.Err(), ErrProtocol), "%s", sm.Err())
+		} else {
+			// Older clients aren't held to it.
+			_, err := sm.Accept()
+			assert.NoError(t, err)
+		}
+		sm.Close()
+	}
+}
+
+func TestTwoClients(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	a := MultiplexedClient(&rwc{r: ar, w: aw})
+	b := MultiplexedClient(&rwc{r: br, w: bw})
+	defer a.Close()
+	defer b.Close()
+
+	// Whichever notices first fails with a protocol error, the other may just
+	// see the transport close.
+	waitFor(t, func() bool { return a.Err() != nil && b.Err() != nil })
+	assert.True(t, errors.Is(a.Err(), ErrProtocol) || errors.Is(b.Err(), ErrProtocol), "%s, %s", a.Err(), b.Err())
+}
+
+func TestSymmetricDial(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	// Each end concurrently dials the other, and echoes what it accepts.
+	const channels = 50
+	wg := &sync.WaitGroup{}
+	for _, m := range []*MultiplexedStream{sm, cm} {
+		m := m
+		go func() {
+			for {
+				c, err := m.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+		for i := 0; i < channels; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				c, err := m.Dial()
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer c.Close()
+				assert.Equal(t, m.parity(), c.id%2)
+				msg := []byte(fmt.Sprintf("message %d", i))
+				_, err = c.Write(msg)
+				assert.NoError(t, err)
+				c.CloseWrite()
+				response, err := ioutil.ReadAll(c)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, response)
+			}(i)
+		}
+	}
+	wg.Wait()
+}
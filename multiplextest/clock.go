@@ -0,0 +1,129 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplextest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a multiplex.Clock that only moves when it is advanced, so that
+// timeouts, deadlines and rate limits can be tested without waiting for them.
+type Clock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+	f  func() // Called instead of sending on c, if set.
+}
+
+// NewClock returns a Clock stopped at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the time the clock has been advanced to.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time once the clock has been
+// advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &waiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// AfterFunc calls f in its own goroutine once the clock has been advanced by
+// d, unless the returned timer is stopped first.
+func (c *Clock) AfterFunc(d time.Duration, f func()) interface{ Stop() bool } {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w := &waiter{at: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+	return &timer{c, w}
+}
+
+type timer struct {
+	clock  *Clock
+	waiter *waiter
+}
+
+func (t *timer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, w := range t.clock.waiters {
+		if w == t.waiter {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance the clock by d, firing any timers that are now due.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		switch {
+		case w.at.After(c.now):
+			waiters = append(waiters, w)
+		case w.f != nil:
+			go w.f()
+		default:
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
+}
+
+// Pending returns the number of timers waiting for the clock to advance.
+func (c *Clock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplextest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestClockAfter(t *testing.T) {
+	start := time.Unix(1000000000, 0)
+	clock := NewClock(start)
+	ch := clock.After(time.Second)
+	assert.Equal(t, 1, clock.Pending())
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatal("fired early")
+	default:
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), <-ch)
+	assert.Equal(t, start.Add(time.Second), clock.Now())
+	assert.Equal(t, 0, clock.Pending())
+}
+
+func TestClockAfterFunc(t *testing.T) {
+	clock := NewClock(time.Unix(1000000000, 0))
+	fired := make(chan struct{})
+	clock.AfterFunc(time.Second, func() { close(fired) })
+	stopped := clock.AfterFunc(time.Second, func() { t.Error("stopped timer fired") })
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	clock.Advance(time.Second)
+	<-fired
+	assert.Equal(t, 0, clock.Pending())
+}
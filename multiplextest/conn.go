@@ -0,0 +1,234 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package multiplextest provides a transport that injects faults, such as
+// latency, short reads and writes, and failures, into another transport, to
+// reproduce the problems of real links in tests.
+package multiplextest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by reads and writes once a Conn has been failed,
+// unless Faults.Err is set.
+var ErrInjected = errors.New("injected failure")
+
+// Faults configures the faults a Conn injects. The zero value injects none.
+//
+// Each Conn injects faults into one end of a transport, so wrapping both ends
+// with different Faults gives each direction its own.
+type Faults struct {
+	// Latency delays data written by this long before it reaches the
+	// transport, as on a link with high latency but unlimited bandwidth.
+	// Writes return without waiting for it.
+	Latency time.Duration
+	// Bandwidth limits writes to this many bytes a second, by delaying each
+	// write until the bytes before it would have been sent. Zero is no limit.
+	Bandwidth int
+	// ShortWrite limits each write to at most this many bytes. The rest is
+	// left unwritten without an error, as some transports do, so the writer
+	// must retry. Zero is no limit.
+	ShortWrite int
+	// ShortRead limits each read to at most this many bytes. Zero is no
+	// limit.
+	ShortRead int
+	// FailAfter fails the Conn once this many bytes have been written. The
+	// write that reaches it is cut short, so that the transport fails part
+	// way through whatever was being written. Zero never fails.
+	FailAfter int64
+	// FailRate is the probability with which each write fails the Conn.
+	FailRate float64
+	// Seed seeds the random numbers for FailRate, so that failures can be
+	// reproduced.
+	Seed int64
+	// Err is returned once the Conn fails, ErrInjected if nil.
+	Err error
+}
+
+// Conn is an io.ReadWriteCloser that injects faults into another.
+//
+// Failing a Conn closes the transport it wraps, so that the peer sees the
+// transport end abruptly. Reads and writes then return Faults.Err, including
+// those in progress.
+type Conn struct {
+	conn   io.ReadWriteCloser
+	faults Faults
+	rand   *rand.Rand   // Only used by Write.
+	queue  chan delayed // Writes waiting out their latency.
+	sent   time.Time    // When the bytes written so far would have been sent at Bandwidth, only used by Write.
+
+	lock    sync.Mutex
+	written int64 // Bytes written, guarded by lock.
+	err     error // Why the Conn failed or was closed, guarded by lock.
+	done    chan struct{}
+}
+
+type delayed struct {
+	due  time.Time
+	data []byte
+}
+
+// Wrap conn so that it injects faults.
+func Wrap(conn io.ReadWriteCloser, faults Faults) *Conn {
+	if faults.Err == nil {
+		faults.Err = ErrInjected
+	}
+	c := &Conn{
+		conn:   conn,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(faults.Seed)),
+		done:   make(chan struct{}),
+	}
+	if faults.Latency > 0 {
+		c.queue = make(chan delayed, 65536)
+		go c.deliver()
+	}
+	return c
+}
+
+// Write data delayed by Latency to the transport when it is due.
+func (c *Conn) deliver() {
+	for {
+		select {
+		case d := <-c.queue:
+			select {
+			case <-time.After(time.Until(d.due)):
+			case <-c.done:
+				return
+			}
+			if _, err := c.conn.Write(d.data); err != nil {
+				c.fail(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	if c.faults.ShortRead > 0 && len(b) > c.faults.ShortRead {
+		b = b[:c.faults.ShortRead]
+	}
+	n, err := c.conn.Read(b)
+	if ferr := c.Err(); ferr != nil {
+		return n, ferr
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	if c.faults.ShortWrite > 0 && len(b) > c.faults.ShortWrite {
+		b = b[:c.faults.ShortWrite]
+	}
+	if c.faults.FailRate > 0 && c.rand.Float64() < c.faults.FailRate {
+		c.Fail()
+		return 0, c.Err()
+	}
+	fail := false
+	c.lock.Lock()
+	if after := c.faults.FailAfter; after > 0 && c.written+int64(len(b)) >= after {
+		b = b[:after-c.written]
+		fail = true
+	}
+	c.written += int64(len(b))
+	c.lock.Unlock()
+
+	if bandwidth := c.faults.Bandwidth; bandwidth > 0 {
+		now := time.Now()
+		if c.sent.Before(now) {
+			c.sent = now
+		}
+		c.sent = c.sent.Add(time.Duration(len(b)) * time.Second / time.Duration(bandwidth))
+		time.Sleep(time.Until(c.sent))
+	}
+	n, err := c.send(b)
+	if err == nil && fail {
+		c.Fail()
+		err = c.Err()
+	}
+	return n, err
+}
+
+// Pass b on to the transport, after Latency.
+func (c *Conn) send(b []byte) (int, error) {
+	if c.queue == nil {
+		n, err := c.conn.Write(b)
+		if ferr := c.Err(); ferr != nil {
+			return n, ferr
+		}
+		return n, err
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case c.queue <- delayed{time.Now().Add(c.faults.Latency), data}:
+		return len(b), nil
+	case <-c.done:
+		return 0, c.Err()
+	}
+}
+
+// Fail the Conn now, closing the transport it wraps.
+func (c *Conn) Fail() {
+	c.fail(c.faults.Err)
+}
+
+// Close the Conn, and the transport it wraps.
+func (c *Conn) Close() error {
+	c.fail(io.ErrClosedPipe)
+	return nil
+}
+
+func (c *Conn) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// Err returns nil until the Conn fails or is closed, and then the error its
+// reads and writes return.
+func (c *Conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
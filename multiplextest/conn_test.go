@@ -0,0 +1,147 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplextest
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+type rwc struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// A Conn wrapping the writing end of a pipe, and the reading end.
+func pipe(faults Faults) (*Conn, io.ReadCloser) {
+	r, w := io.Pipe()
+	return Wrap(&rwc{Reader: eofReader{}, WriteCloser: w}, faults), r
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func TestShortWrite(t *testing.T) {
+	c, r := pipe(Faults{ShortWrite: 3})
+	go func() {
+		n, err := c.Write([]byte("hello"))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+	}()
+	b := make([]byte, 5)
+	n, err := r.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hel", string(b[:n]))
+}
+
+func TestShortRead(t *testing.T) {
+	r, w := io.Pipe()
+	c := Wrap(&rwc{Reader: r, WriteCloser: w}, Faults{ShortRead: 2})
+	go w.Write([]byte("hello"))
+	b := make([]byte, 5)
+	n, err := c.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "he", string(b[:n]))
+}
+
+func TestFailAfter(t *testing.T) {
+	c, r := pipe(Faults{FailAfter: 7})
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		assert.NoError(t, err)
+		n, err := c.Write([]byte("world"))
+		assert.Equal(t, 2, n)
+		assert.Equal(t, ErrInjected, err)
+		_, err = c.Write([]byte("!"))
+		assert.Equal(t, ErrInjected, err)
+	}()
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hellowo", string(b))
+	assert.Equal(t, ErrInjected, c.Err())
+}
+
+func TestFailRate(t *testing.T) {
+	// The same seed fails the same write.
+	failures := func() int {
+		c := Wrap(&rwc{Reader: eofReader{}, WriteCloser: nopCloser{ioutil.Discard}}, Faults{FailRate: 0.1, Seed: 42})
+		for i := 0; ; i++ {
+			if _, err := c.Write([]byte("x")); err != nil {
+				return i
+			}
+		}
+	}
+	assert.Equal(t, failures(), failures())
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestLatency(t *testing.T) {
+	c, r := pipe(Faults{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	n, err := c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(r, b)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.NoError(t, c.Close())
+}
+
+func TestBandwidth(t *testing.T) {
+	c := Wrap(&rwc{Reader: eofReader{}, WriteCloser: nopCloser{ioutil.Discard}}, Faults{Bandwidth: 1000})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := c.Write(make([]byte, 20))
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "%s", time.Since(start))
+}
+
+func TestFail(t *testing.T) {
+	r, w := io.Pipe()
+	c := Wrap(&rwc{Reader: r, WriteCloser: w}, Faults{})
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	c.Fail()
+	// The peer sees the transport end.
+	assert.Equal(t, ErrInjected, <-done)
+	_, err := r.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
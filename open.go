@@ -0,0 +1,343 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"gopkg.in/tomb.v1"
+)
+
+const (
+	// MaxServiceNameLength is the longest service name that can be passed to
+	// DialService.
+	MaxServiceNameLength = 255
+	// MaxMetadataSize is the largest metadata that can be attached to a
+	// channel with WithMetadata. Together with the longest service and codec
+	// names, it fits in the smallest frame.
+	MaxMetadataSize = FragmentSize - 2 - MaxServiceNameLength - MaxCodecNameLength
+)
+
+// A DialOption configures a channel opened with Dial.
+type DialOption func(*dialConfig)
+
+type dialConfig struct {
+	service  string
+	metadata []byte
+	codec    string
+}
+
+// WithService opens the channel for the named service, to be accepted with
+// AcceptService by the peer. See DialService.
+func WithService(name string) DialOption {
+	return func(c *dialConfig) {
+		c.service = name
+	}
+}
+
+// WithMetadata attaches up to MaxMetadataSize bytes of metadata to the
+// channel, sent to the peer along with the request to open it. The peer can
+// use it to decide what the channel is for, with Channel.Metadata, before
+// reading any data. The metadata is copied.
+func WithMetadata(metadata []byte) DialOption {
+	return func(c *dialConfig) {
+		c.metadata = append([]byte(nil), metadata...)
+	}
+}
+
+// DialAsync dials the remote end, creating a new multiplexed channel, without
+// waiting for the peer to acknowledge it. This saves a round trip per channel,
+// but if the peer refuses the channel, operations on it fail rather than
+// DialAsync. Streams created with WithAsyncDial always dial this way.
+func (m *MultiplexedStream) DialAsync(ctx context.Context, options ...DialOption) (*Channel, error) {
+	return m.dial(ctx, true, options)
+}
+
+// DialService dials the remote end, creating a new multiplexed channel for
+// the named service. The peer accepts it with AcceptService if it has
+// registered the service, and with Accept otherwise. An empty name is the same
+// as naming no service.
+//
+// Service names are at most MaxServiceNameLength bytes long. Dialling a peer
+// that predates service names fails with ErrServicesUnsupported.
+func (m *MultiplexedStream) DialService(name string, options ...DialOption) (*Channel, error) {
+	return m.Dial(append([]DialOption{WithService(name)}, options...)...)
+}
+
+// AcceptService accepts a new multiplexed channel opened by the remote end for
+// the named service, which must have been registered with WithServices or
+// Handle.
+func (m *MultiplexedStream) AcceptService(name string) (*Channel, error) {
+	return m.AcceptServiceContext(context.Background(), name)
+}
+
+// AcceptServiceContext is AcceptService with a context, as with AcceptContext.
+func (m *MultiplexedStream) AcceptServiceContext(ctx context.Context, name string) (*Channel, error) {
+	m.lock.Lock()
+	queue, ok := m.services[name]
+	m.lock.Unlock()
+	if !ok {
+		return nil, ErrUnknownService
+	}
+	return m.acceptFrom(ctx, queue)
+}
+
+// The queue that channels opened for service are accepted from, or nil if they
+// are refused.
+func (m *MultiplexedStream) acceptQueue(service string) chan *Channel {
+	if service == "" {
+		return m.accept
+	}
+	m.lock.Lock()
+	queue, ok := m.services[service]
+	m.lock.Unlock()
+	switch {
+	case ok:
+		return queue
+	case m.config.rejectUnknownServices:
+		return nil
+	default:
+		return m.accept
+	}
+}
+
+// ID returns the channel's ID, which is the same at both ends of the channel
+// and doesn't change. IDs are only reused by new streams.
+func (c *Channel) ID() uint32 {
+	return c.id
+}
+
+// Service returns the name of the service the channel was opened for (see
+// DialService), or "" if none was named.
+func (c *Channel) Service() string {
+	return c.service
+}
+
+// Metadata returns the metadata the channel was opened with (see
+// WithMetadata), or nil if there was none. It must not be modified.
+func (c *Channel) Metadata() []byte {
+	return c.metadata
+}
+
+// SetValue associates v with the channel, such as the authenticated user or
+// a trace span, replacing any previous value. The value is released once the
+// channel is closed, after any WithOnChannelClose callback has run, and
+// setting a value on a closed channel has no effect.
+func (c *Channel) SetValue(v interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if atomic.LoadInt64(&c.closed) == 0 {
+		c.value = v
+	}
+}
+
+// Value returns the value set with SetValue, or nil if there is none or the
+// channel has been closed.
+func (c *Channel) Value() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value
+}
+
+// The SYN that opens ch, carrying its service name, codec and metadata.
+func openPacket(ch *Channel) *packet {
+	p := &packet{id: ch.id, flags: SYN, ch: ch}
+	if ch.service == "" && ch.codec == "" && len(ch.metadata) == 0 {
+		return p
+	}
+	var payload []byte
+	if ch.service != "" {
+		p.flags |= SERVICE
+		payload = append(payload, byte(len(ch.service)))
+		payload = append(payload, ch.service...)
+	}
+	if ch.codec != "" {
+		p.flags |= COMPRESS
+		payload = append(payload, byte(len(ch.codec)))
+		payload = append(payload, ch.codec...)
+	}
+	if len(ch.metadata) > 0 {
+		p.flags |= META
+		payload = append(payload, ch.metadata...)
+	}
+	p.payload = payload
+	return p
+}
+
+// Take the service name, codec and metadata from the payload of a SYN,
+// leaving any data.
+func splitOpen(p *packet) (service, codec string, metadata []byte, err error) {
+	if p.flags&SERVICE != 0 {
+		if service, err = splitName(p); err != nil {
+			return "", "", nil, err
+		}
+	}
+	if p.flags&COMPRESS != 0 {
+		if codec, err = splitName(p); err != nil {
+			return "", "", nil, err
+		}
+	}
+	if p.flags&META != 0 {
+		if len(p.payload) > MaxMetadataSize {
+			return "", "", nil, fmt.Errorf("%w: %d bytes of metadata on channel %d", ErrProtocol, len(p.payload), p.id)
+		}
+		metadata = append([]byte(nil), p.payload...)
+		p.payload = nil
+	}
+	return service, codec, metadata, nil
+}
+
+// Take a name prefixed by its length from the payload of a SYN.
+func splitName(p *packet) (string, error) {
+	if len(p.payload) == 0 || len(p.payload) < 1+int(p.payload[0]) || p.payload[0] == 0 {
+		return "", fmt.Errorf("%w: malformed name in SYN for channel %d", ErrProtocol, p.id)
+	}
+	n := 1 + int(p.payload[0])
+	name := string(p.payload[1:n])
+	p.payload = p.payload[n:]
+	return name, nil
+}
+
+// Wait for the peer to acknowledge a channel we have sent a SYN for.
+func (m *MultiplexedStream) awaitOpen(ctx context.Context, ch *Channel, opened chan struct{}) (*Channel, error) {
+	var err error
+	select {
+	case <-opened:
+		// Acknowledged as the stream died.
+		if err := m.err(); err != nil {
+			return nil, err
+		}
+		return ch, nil
+
+	case <-ch.tomb.Dying():
+		// The peer may accept the channel and close it before its
+		// acknowledgement arrives, which isn't a failure to open it.
+		err = ch.tomb.Err()
+		if !isRefusal(err) && m.tomb.Err() == tomb.ErrStillAlive {
+			return ch, nil
+		}
+		return nil, err
+
+	case <-m.deadline.wait():
+		err = errTimeout
+
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// The peer has seen the channel, so it must be told to drop it.
+	ch.Reset()
+	return nil, err
+}
+
+// The peer has queued the channel for Accept, and accepted its codec if
+// compress is true.
+func (c *Channel) acknowledge(compress bool) {
+	if compress && c.encoder != nil {
+		atomic.StoreUint32(&c.compressing, 1)
+	}
+	c.lock.Lock()
+	if c.opened != nil {
+		close(c.opened)
+		c.opened = nil
+	}
+	c.lock.Unlock()
+}
+
+// Queue a reply to a packet from the peer: a channel acknowledgement or
+// refusal, or a ping reply. Replies are sent ahead of channel data without
+// blocking the reader, and are never dropped, as the peer's Dial or Ping may
+// be waiting for them.
+func (m *MultiplexedStream) reply(p *packet) {
+	m.hook(Outbound, p)
+	m.replyLock.Lock()
+	m.replies = append(m.replies, p)
+	m.replyLock.Unlock()
+	signal(m.replied)
+}
+
+// Write all queued replies to the connection.
+func (m *MultiplexedStream) writeReplies() error {
+	m.replyLock.Lock()
+	replies := m.replies
+	m.replies = nil
+	m.replyLock.Unlock()
+	for _, p := range replies {
+		if err := m.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RejectedError is returned by Dial, and by operations on channels opened
+// with DialAsync, when the peer's accept filter rejected the channel (see
+// WithAcceptFilter).
+type RejectedError struct {
+	code    uint32
+	message string
+}
+
+// Reject returns an error that an accept filter can return to reject a
+// channel, passing an application-defined code and message to the peer.
+func Reject(code uint32, message string) error {
+	return &RejectedError{code: code, message: message}
+}
+
+// Code returns the application-defined code passed to Reject.
+func (e *RejectedError) Code() uint32 { return e.code }
+
+// Message returns the message passed to Reject.
+func (e *RejectedError) Message() string { return e.message }
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("channel rejected by peer: %s (code %d)", e.message, e.code)
+}
+
+// Refuse a channel the peer opened because an accept filter returned err.
+func (m *MultiplexedStream) reject(id uint32, err error) {
+	var code uint32
+	message := err.Error()
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		code, message = rejected.code, rejected.message
+	}
+	if max := int(m.MaxFrameSize()) - 8; len(message) > max {
+		message = message[:max]
+	}
+	payload := make([]byte, 8+len(message))
+	binary.BigEndian.PutUint32(payload, refuseRejected)
+	binary.BigEndian.PutUint32(payload[4:], code)
+	copy(payload[8:], message)
+	atomic.AddUint64(&m.stats.refused, 1)
+	m.log(levelInfo, "channel refused", "channel_id", id, "error", err)
+	m.reply(&packet{id: id, flags: RST | REFUSE, payload: payload})
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Settings from a peer that acknowledges channels, or not.
+func openAckSettings(ack bool) []byte {
+	payload := make([]byte, settingSize)
+	binary.BigEndian.PutUint16(payload, settingFeatures)
+	if ack {
+		binary.BigEndian.PutUint32(payload[2:], uint32(FeatureOpenAck))
+	}
+	return payload
+}
+
+// A client whose peer is played by the test, writing to the returned pipe.
+func newClientWithFakePeer(options ...Option) (*MultiplexedStream, *gatedWriter, *io.PipeWriter) {
+	cr, sw := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	close(w.release)
+	cm := MultiplexedClient(&rwc{r: cr, w: w}, options...)
+	sendHandshake(sw)
+	return cm, w, sw
+}
+
+func TestDialRefused(t *testing.T) {
+	sm, cm := newServerAndClient(WithAcceptBacklog(0))
+	defer sm.Close()
+	defer cm.Close()
+
+	// Nothing is waiting in Accept, so there is no room for the channel.
+	_, err := cm.Dial()
+	assert.Equal(t, ErrBusy, err)
+	assert.Equal(t, 0, cm.channels.len())
+
+	// Asynchronously dialled channels fail when they are used.
+	c, err := cm.DialAsync(context.Background())
+	assert.NoError(t, err)
+	_, err = c.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrBusy), "%s", err)
+
+	accepted := make(chan *Channel)
+	go func() {
+		s, _ := sm.Accept()
+		accepted <- s
+	}()
+	waitFor(t, func() bool {
+		c, err = cm.Dial()
+		return err == nil
+	})
+	assert.NotNil(t, <-accepted)
+}
+
+func TestDialWaitsForAck(t *testing.T) {
+	cm, w, sw := newClientWithFakePeer()
+	defer cm.Close()
+	assert.NoError(t, writeFrame(sw, typeSettings, 0, 0, openAckSettings(true)))
+
+	dialled := make(chan error)
+	go func() {
+		_, err := cm.Dial()
+		dialled <- err
+	}()
+	waitFor(t, func() bool { return len(w.headers()) == 2 })
+	select {
+	case err := <-dialled:
+		t.Fatalf("Dial returned %v before the channel was acknowledged", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	id := w.headers()[1].ID
+	assert.NoError(t, writeFrame(sw, typeData, ACK, id, nil))
+	assert.NoError(t, <-dialled)
+}
+
+func TestDialCancelledAwaitingAck(t *testing.T) {
+	cm, w, sw := newClientWithFakePeer()
+	defer cm.Close()
+	assert.NoError(t, writeFrame(sw, typeSettings, 0, 0, openAckSettings(true)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err := cm.DialContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, cm.channels.len())
+
+	// The peer saw the SYN, so it is told to forget the channel.
+	waitFor(t, func() bool { return len(w.headers()) == 3 })
+	hdrs := w.headers()
+	assert.Equal(t, uint8(SYN), hdrs[1].Flags)
+	assert.Equal(t, uint8(RST|ABORT), hdrs[2].Flags)
+	assert.Equal(t, hdrs[1].ID, hdrs[2].ID)
+}
+
+func TestDialWithoutAck(t *testing.T) {
+	// Older peers don't acknowledge channels, and with WithAsyncDial they
+	// aren't waited for.
+	for _, test := range []struct {
+		ack     bool
+		options []Option
+	}{
+		{false, nil},
+		{true, []Option{WithAsyncDial()}},
+	} {
+		cm, _, sw := newClientWithFakePeer(test.options...)
+		assert.NoError(t, writeFrame(sw, typeSettings, 0, 0, openAckSettings(test.ack)))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := cm.DialContext(ctx)
+		assert.NoError(t, err)
+		cancel()
+		cm.Close()
+	}
+}
+
+func TestAcceptFilter(t *testing.T) {
+	errFull := errors.New("tenant is over quota")
+	var dials int32
+	filter := func(ch *Channel) error {
+		switch atomic.AddInt32(&dials, 1) {
+		case 1:
+			return Reject(42, "go away")
+		case 2:
+			return fmt.Errorf("rejected: %w", errFull)
+		case 3:
+			return nil
+		}
+		return Reject(1, strings.Repeat("x", FragmentSize))
+	}
+	sm, cm := newServerAndClient(WithAcceptFilter(filter))
+	defer sm.Close()
+	defer cm.Close()
+
+	_, err := cm.Dial()
+	rejected, ok := err.(*RejectedError)
+	assert.True(t, ok, "%v", err)
+	assert.Equal(t, uint32(42), rejected.Code())
+	assert.Equal(t, "go away", rejected.Message())
+
+	// Other errors are passed on as text.
+	_, err = cm.Dial()
+	rejected, ok = err.(*RejectedError)
+	assert.True(t, ok, "%v", err)
+	assert.Equal(t, uint32(0), rejected.Code())
+	assert.Equal(t, "rejected: tenant is over quota", rejected.Message())
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	go c.Write([]byte("hello"))
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+
+	// Long messages are truncated to fit in a frame.
+	c, err = cm.DialAsync(context.Background())
+	assert.NoError(t, err)
+	_, err = c.Read(make([]byte, 1))
+	assert.True(t, errors.As(err, &rejected), "%v", err)
+	assert.Equal(t, FragmentSize-8, len(rejected.Message()))
+
+	assert.Equal(t, 0, sm.AcceptBacklog())
+	waitFor(t, func() bool { return sm.channels.len() == 1 && cm.channels.len() == 1 })
+}
+
+func TestDialMetadata(t *testing.T) {
+	var filtered []byte
+	filter := func(ch *Channel) error {
+		filtered = ch.Metadata()
+		return nil
+	}
+	sm, cm := newServerAndClient(WithAcceptFilter(filter))
+	defer sm.Close()
+	defer cm.Close()
+
+	meta := []byte("logs")
+	c, err := cm.Dial(WithMetadata(meta))
+	assert.NoError(t, err)
+	copy(meta, "xxxx")
+	assert.Equal(t, []byte("logs"), c.Metadata())
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	// The metadata is available before any data is read, and isn't part of
+	// the data.
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("logs"), s.Metadata())
+	assert.Equal(t, []byte("logs"), filtered)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Channels without metadata have none.
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+	s, err = sm.Accept()
+	assert.NoError(t, err)
+	assert.Nil(t, s.Metadata())
+
+	_, err = cm.Dial(WithMetadata(make([]byte, MaxMetadataSize+1)))
+	assert.Equal(t, ErrMetadataTooLarge, err)
+	_, err = cm.Dial(WithMetadata(make([]byte, MaxMetadataSize)))
+	assert.NoError(t, err)
+	s, err = sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, MaxMetadataSize, len(s.Metadata()))
+}
+
+func TestChannelValue(t *testing.T) {
+	type user struct{ name string }
+	closed := make(chan interface{}, 1)
+	sm, cm := newServerAndClient(WithOnChannelClose(func(ch *Channel, err error) {
+		if ch.Value() != nil {
+			closed <- ch.Value()
+		}
+	}))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Nil(t, s.Value())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.SetValue(i)
+			_ = s.Value()
+		}(i)
+	}
+	wg.Wait()
+	s.SetValue(&user{"alice"})
+	assert.Equal(t, &user{"alice"}, s.Value())
+	// Values are local to each end.
+	assert.Nil(t, c.Value())
+
+	// Close callbacks see the value, which is then released.
+	assert.NoError(t, c.Close())
+	assert.Equal(t, &user{"alice"}, <-closed)
+	<-s.Done()
+	assert.Nil(t, s.Value())
+	s.SetValue(&user{"bob"})
+	assert.Nil(t, s.Value())
+}
+
+func TestDialMetadataUnsupported(t *testing.T) {
+	// Older peers would mistake the metadata for data.
+	cm, _, sw := newClientWithFakePeer()
+	defer cm.Close()
+	assert.NoError(t, writeFrame(sw, typeSettings, 0, 0, openAckSettings(false)))
+	_, err := cm.DialAsync(context.Background(), WithMetadata([]byte("logs")))
+	assert.Equal(t, ErrMetadataTooLarge, err)
+	assert.Equal(t, 0, cm.channels.len())
+}
+
+func TestPeerMetadataTooLarge(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithMaxFrameSize(MaxMetadataSize*2))
+	defer sm.Close()
+
+	// The frame itself is small enough.
+	sendHandshake(cw)
+	writeFrame(cw, typeData, SYN|META, 1, make([]byte, MaxMetadataSize+1))
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol), "%s", sm.Err())
+}
+
+func TestServices(t *testing.T) {
+	sm, cm := newServerAndClient(WithServices("rpc", "logs"))
+	defer sm.Close()
+	defer cm.Close()
+
+	// Each service is accepted concurrently, and only sees its own channels.
+	const channels = 20
+	wg := &sync.WaitGroup{}
+	for _, service := range []string{"rpc", "logs"} {
+		service := service
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < channels; i++ {
+				s, err := sm.AcceptService(service)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, service, s.Service())
+				buf := make([]byte, len(service))
+				_, err = io.ReadFull(s, buf)
+				assert.NoError(t, err)
+				assert.Equal(t, service, string(buf))
+				s.Close()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < channels; i++ {
+				c, err := cm.DialService(service)
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = c.Write([]byte(service))
+				assert.NoError(t, err)
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Unnamed channels, and those for services that aren't registered, are
+	// returned by Accept.
+	_, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = cm.DialService("metrics", WithMetadata([]byte("meta")))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, "", s.Service())
+	s, err = sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, "metrics", s.Service())
+	assert.Equal(t, []byte("meta"), s.Metadata())
+
+	_, err = sm.AcceptService("metrics")
+	assert.Equal(t, ErrUnknownService, err)
+	_, err = cm.DialService(strings.Repeat("x", MaxServiceNameLength+1))
+	assert.Equal(t, ErrServiceNameTooLong, err)
+}
+
+func TestUnknownServiceRejected(t *testing.T) {
+	filter := func(ch *Channel) error {
+		if ch.Service() != "rpc" {
+			return Reject(404, "no such service")
+		}
+		return nil
+	}
+	sm, cm := newServerAndClient(WithServices("rpc"), WithAcceptFilter(filter))
+	defer sm.Close()
+	defer cm.Close()
+
+	_, err := cm.DialService("rpc")
+	assert.NoError(t, err)
+	_, err = cm.DialService("logs")
+	rejected, ok := err.(*RejectedError)
+	assert.True(t, ok, "%v", err)
+	assert.Equal(t, uint32(404), rejected.Code())
+	_, err = cm.Dial()
+	assert.IsType(t, &RejectedError{}, err)
+}
+
+func TestServicesUnsupported(t *testing.T) {
+	cm, _, sw := newClientWithFakePeer()
+	defer cm.Close()
+	assert.NoError(t, writeFrame(sw, typeSettings, 0, 0, openAckSettings(false)))
+	_, err := cm.DialService("rpc")
+	assert.Equal(t, ErrServicesUnsupported, err)
+}
+
+func TestServiceNameInvalid(t *testing.T) {
+	for _, payload := range [][]byte{nil, {0}, {5, 'a', 'b'}} {
+		sr, cw := io.Pipe()
+		_, sw := io.Pipe()
+		sm := MultiplexedServer(&rwc{r: sr, w: sw})
+		sendHandshake(cw)
+		writeFrame(cw, typeData, SYN|SERVICE, 1, payload)
+		waitFor(t, func() bool { return sm.Err() != nil })
+		assert.True(t, errors.Is(sm.Err(), ErrProtocol), "%s", sm.Err())
+		sm.Close()
+	}
+}
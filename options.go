@@ -0,0 +1,680 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// An Option configures a MultiplexedStream.
+type Option func(*config)
+
+// Which end of a stream this is, see WithServer and WithClient.
+type role uint8
+
+const (
+	roleUnset role = iota
+	roleServer
+	roleClient
+)
+
+type config struct {
+	role          role
+	window        uint32
+	maxWindow     uint32
+	maxFrameSize  uint32
+	maxRecvSize   uint32
+	maxBuffered   int
+	maxChannels   int
+	acceptBacklog int
+	asyncDial     bool
+	acceptFilter  func(*Channel) error
+	services      []string
+	idleTimeout   time.Duration
+	clock         Clock
+
+	channelIdleTimeout    time.Duration
+	rejectUnknownServices bool
+	noHandshake           bool
+	features              Features
+	strictPacketTypes     bool
+	maxMessageSize        int
+	compression           Compression
+	codecs                map[string]func() Codec
+	transform             Transform
+	checksums             bool
+	checksumRecovery      bool
+	controlRate           int
+	limitOpens            bool // controlRate also applies to opens and resets.
+	openLimiter           OpenLimiter
+	openRate              float64
+	openBurst             int
+	limiter               Limiter
+	onOpen                func(*Channel)
+	onClose               func(*Channel, error)
+	frameHook             func(Direction, FrameInfo) error
+	debugDump             io.Writer
+	logger                Logger
+	sessionID             string
+	ignorePings           bool
+	closeFunc             func() error
+	faults                map[faultSite]func() error
+
+	problems map[string]string // Invalid values given to options, by option, see report.
+}
+
+// The configuration resulting from applying options, in order, to the
+// defaults.
+func newConfig(options []Option) config {
+	config := defaultConfig()
+	for _, option := range options {
+		option(&config)
+	}
+	return config
+}
+
+// Note that option was given an invalid value, described by problem, or that
+// it has since been given a valid value if problem is "". Only New rejects
+// invalid values: the legacy constructors use the nearest valid value instead.
+func (c *config) report(option, problem string, args ...interface{}) {
+	if problem == "" {
+		delete(c.problems, option)
+		return
+	}
+	if c.problems == nil {
+		c.problems = make(map[string]string)
+	}
+	c.problems[option] = fmt.Sprintf(problem, args...)
+}
+
+// Check that the configuration is complete and consistent, for New.
+func (c *config) validate() error {
+	if len(c.problems) > 0 {
+		options := make([]string, 0, len(c.problems))
+		for option := range c.problems {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, options[0], c.problems[options[0]])
+	}
+	switch {
+	case c.maxWindow != 0 && c.maxWindow < c.window:
+		return fmt.Errorf("%w: WithWindowAutoTuning: maximum window of %d bytes is smaller than the default window of %d bytes", ErrInvalidConfig, c.maxWindow, c.window)
+	case c.role == roleUnset:
+		return fmt.Errorf("%w: one of WithServer or WithClient is required", ErrInvalidConfig)
+	case c.noHandshake && c.compression != CompressionNone:
+		return fmt.Errorf("%w: WithCompression requires the handshake, which WithoutHandshake disables", ErrInvalidConfig)
+	case c.noHandshake && c.checksums:
+		return fmt.Errorf("%w: WithChecksums requires the handshake, which WithoutHandshake disables", ErrInvalidConfig)
+	case c.checksumRecovery && c.compression != CompressionNone:
+		return fmt.Errorf("%w: WithChecksumRecovery can't recover from corruption with WithCompression", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func defaultConfig() config {
+	return config{
+		window:        initialWindow,
+		acceptBacklog: 64,
+		maxFrameSize:  FragmentSize,
+		clock:         realClock{},
+		features:      allFeatures,
+
+		maxMessageSize: defaultMaxMessageSize,
+		controlRate:    defaultControlRate,
+		codecs:         map[string]func() Codec{CodecFlate: newFlateCodec},
+	}
+}
+
+// The problem with a frame size of bytes, if any, for report.
+func frameSizeProblem(bytes uint32) string {
+	if bytes < FragmentSize || bytes > maxPayloadSize {
+		return "%d bytes is outside the range of %d to %d bytes"
+	}
+	return ""
+}
+
+// The problem with a limit or timeout, if any, for report.
+func negativeProblem(negative bool) string {
+	if negative {
+		return "%v is negative, and 0 disables it"
+	}
+	return ""
+}
+
+// WithServer makes this the server end of the stream, for New. The peer must
+// be a client.
+func WithServer() Option {
+	return func(c *config) {
+		c.role = roleServer
+	}
+}
+
+// WithClient makes this the client end of the stream, for New. The peer must
+// be a server.
+func WithClient() Option {
+	return func(c *config) {
+		c.role = roleClient
+	}
+}
+
+// WithDefaultWindow sets the receive window of each channel, in bytes.
+//
+// Larger windows allow a single channel to make use of links with a high
+// bandwidth-delay product, at the cost of buffering up to this many bytes per
+// channel. Windows smaller than the protocol's initial window of 64KB are
+// rounded up.
+func WithDefaultWindow(bytes uint32) Option {
+	return func(c *config) {
+		c.report("WithDefaultWindow", "")
+		if bytes < initialWindow {
+			c.report("WithDefaultWindow", "window of %d bytes is smaller than the minimum of %d bytes", bytes, initialWindow)
+			bytes = initialWindow
+		}
+		c.window = bytes
+	}
+}
+
+// WithWindowAutoTuning enables automatic sizing of channel receive windows.
+//
+// The round-trip time to the peer is measured periodically, and each channel's
+// window is grown (up to max bytes) while the application reads faster than
+// the window allows data to arrive, and shrunk back towards the default size
+// when the application reads slowly.
+func WithWindowAutoTuning(max uint32) Option {
+	return func(c *config) {
+		c.maxWindow = max
+	}
+}
+
+// WithMaxFrameSize sets the largest packet payload, in bytes, that is sent to
+// or accepted from the peer. Writes are split into packets of at most this
+// size, and receiving a larger packet fails the stream with ErrProtocol,
+// unless WithMaxReceiveFrameSize is used.
+//
+// Smaller frames reduce the time other channels wait behind a frame that is
+// being sent, while larger frames reduce header overhead. Sizes are clamped to
+// between FragmentSize, which is the default, and 16MB.
+func WithMaxFrameSize(bytes uint32) Option {
+	return func(c *config) {
+		c.report("WithMaxFrameSize", frameSizeProblem(bytes), bytes, FragmentSize, maxPayloadSize)
+		switch {
+		case bytes < FragmentSize:
+			bytes = FragmentSize
+		case bytes > maxPayloadSize:
+			bytes = maxPayloadSize
+		}
+		c.maxFrameSize = bytes
+	}
+}
+
+// WithMaxReceiveFrameSize sets the largest packet payload, in bytes, that is
+// accepted from the peer, separately from the size of those sent (see
+// WithMaxFrameSize). It is advertised to the peer, and receiving a larger
+// packet fails the stream with ErrProtocol before its payload is read.
+//
+// By default this is the size set with WithMaxFrameSize. Sizes are clamped to
+// between FragmentSize and 16MB.
+func WithMaxReceiveFrameSize(bytes uint32) Option {
+	return func(c *config) {
+		c.report("WithMaxReceiveFrameSize", frameSizeProblem(bytes), bytes, FragmentSize, maxPayloadSize)
+		switch {
+		case bytes < FragmentSize:
+			bytes = FragmentSize
+		case bytes > maxPayloadSize:
+			bytes = maxPayloadSize
+		}
+		c.maxRecvSize = bytes
+	}
+}
+
+// WithMaxBufferedBytes caps the total amount of received but unread data
+// buffered across all channels of the stream. Once the cap is reached, channels
+// stop granting their peers more window until the application reads.
+//
+// The cap is soft: a channel whose buffered data the application has
+// completely read is always granted window. This ensures that an application
+// waiting on one channel can't be deadlocked by unread data on others, at the
+// cost of allowing the cap to be exceeded by up to one window per such
+// channel.
+func WithMaxBufferedBytes(n int) Option {
+	return func(c *config) {
+		c.report("WithMaxBufferedBytes", negativeProblem(n < 0), n)
+		c.maxBuffered = n
+	}
+}
+
+// WithMaxChannels limits the number of channels open on the stream at once,
+// whichever end opened them, to n. Once the limit is reached Dial fails with
+// ErrTooManyChannels, and channels the peer opens are refused: operations on
+// the peer's end fail with ErrTooManyChannels. A channel stops counting
+// towards the limit as soon as it is closed or reset by either end.
+//
+// By default the number of channels is unlimited.
+func WithMaxChannels(n int) Option {
+	return func(c *config) {
+		c.report("WithMaxChannels", negativeProblem(n < 0), n)
+		c.maxChannels = n
+	}
+}
+
+// WithAcceptBacklog sets how many channels opened by the peer may wait to be
+// returned by Accept, 64 by default. Once the backlog is full, further
+// channels are refused until Accept is called, and operations on the peer's
+// end fail with ErrBusy. With a backlog of zero, channels are only accepted if
+// a call to Accept is already waiting.
+func WithAcceptBacklog(n int) Option {
+	return func(c *config) {
+		c.report("WithAcceptBacklog", "")
+		if n < 0 {
+			c.report("WithAcceptBacklog", "backlog of %d is negative", n)
+			n = 0
+		}
+		c.acceptBacklog = n
+	}
+}
+
+// WithOpenRateLimit limits the rate at which the peer may open channels to
+// perSecond a second, after an initial burst of up to burst channels. Channels
+// opened faster than this are refused, and operations on the peer's end fail
+// with ErrRateLimited.
+//
+// Unlike WithMaxChannels, this limits channels however quickly they are
+// closed, protecting an application whose Accept loop does expensive work for
+// each channel from bursts of them.
+func WithOpenRateLimit(perSecond float64, burst int) Option {
+	return func(c *config) {
+		switch {
+		case perSecond < 0 || math.IsNaN(perSecond):
+			c.report("WithOpenRateLimit", "rate of %v channels a second is negative, and 0 disables it", perSecond)
+		case perSecond > 0 && burst < 1:
+			c.report("WithOpenRateLimit", "burst of %d channels is less than 1", burst)
+		default:
+			c.report("WithOpenRateLimit", "")
+		}
+		c.openLimiter = nil
+		c.openRate = perSecond
+		c.openBurst = burst
+	}
+}
+
+// WithOpenLimiter is like WithOpenRateLimit, but refuses the channels the peer
+// opens whenever limiter doesn't allow them, such as to share a limit between
+// streams.
+func WithOpenLimiter(limiter OpenLimiter) Option {
+	return func(c *config) {
+		c.openLimiter = limiter
+	}
+}
+
+// WithAsyncDial makes Dial and DialContext return as soon as the channel has
+// been queued to be sent to the peer, rather than waiting for the peer to
+// acknowledge it. This saves a round trip per channel, at the cost of a
+// refused channel only being noticed when it is next used. See DialAsync.
+func WithAsyncDial() Option {
+	return func(c *config) {
+		c.asyncDial = true
+	}
+}
+
+// WithAcceptFilter sets a function that decides whether to accept each
+// channel the peer opens, before it is queued for Accept. If it returns an
+// error the channel is rejected, and the peer's Dial fails with a
+// *RejectedError carrying the code and message of the error, if it was
+// created with Reject, or code 0 and the error's text otherwise.
+//
+// The filter is called by the goroutine that reads from the connection, so
+// it must not block, and must not read from or write to the channel.
+func WithAcceptFilter(filter func(ch *Channel) error) Option {
+	return func(c *config) {
+		c.acceptFilter = filter
+	}
+}
+
+// WithServices registers the names of services whose channels are returned by
+// AcceptService rather than Accept. Each service has its own backlog, of the
+// size set with WithAcceptBacklog.
+//
+// Channels for services that aren't registered are returned by Accept, unless
+// WithRejectUnknownServices is used.
+func WithServices(names ...string) Option {
+	return func(c *config) {
+		for _, name := range names {
+			option := fmt.Sprintf("WithServices(%q)", name)
+			switch {
+			case name == "":
+				c.report(option, "service has no name")
+			case len(name) > MaxServiceNameLength:
+				c.report(option, "name of %d bytes is longer than MaxServiceNameLength (%d)", len(name), MaxServiceNameLength)
+			}
+		}
+		c.services = append(c.services, names...)
+	}
+}
+
+// WithRejectUnknownServices refuses channels the peer opens for services that
+// haven't been registered with WithServices or Handle, rather than returning
+// them from Accept. The peer's Dial fails with ErrUnknownService. Channels
+// opened without naming a service are still returned by Accept.
+func WithRejectUnknownServices() Option {
+	return func(c *config) {
+		c.rejectUnknownServices = true
+	}
+}
+
+// WithoutHandshake disables the handshake that each end sends before anything
+// else, for compatibility with peers that predate it. Both ends must agree.
+func WithoutHandshake() Option {
+	return func(c *config) {
+		c.noHandshake = true
+	}
+}
+
+// WithCompression compresses the data sent on channels with the given
+// algorithm, transparently to the applications at each end. Channels are
+// opened and closed, and flow controlled, uncompressed. Both ends must use the
+// same algorithm: the handshake fails with ErrCompressionMismatch otherwise.
+// Compression is disabled by default, and with WithoutHandshake, a
+// combination New rejects.
+func WithCompression(compression Compression) Option {
+	return func(c *config) {
+		c.report("WithCompression", "")
+		if compression > CompressionFlate {
+			c.report("WithCompression", "unknown %s", compression)
+		}
+		c.compression = compression
+	}
+}
+
+// WithCodec registers a codec that channels may be compressed with (see
+// WithChannelCompression). newCodec is called for each direction of each
+// channel using the codec. Names are at most MaxCodecNameLength bytes long,
+// and longer names are truncated. Both ends must register the codec under the
+// same name.
+func WithCodec(name string, newCodec func() Codec) Option {
+	return func(c *config) {
+		option := fmt.Sprintf("WithCodec(%q)", name)
+		switch {
+		case name == "":
+			c.report(option, "codec has no name")
+		case len(name) > MaxCodecNameLength:
+			c.report(option, "name of %d bytes is longer than MaxCodecNameLength (%d)", len(name), MaxCodecNameLength)
+		case newCodec == nil:
+			c.report(option, "newCodec is nil")
+		default:
+			c.report(option, "")
+		}
+		if len(name) > MaxCodecNameLength {
+			name = name[:MaxCodecNameLength]
+		}
+		c.codecs[name] = newCodec
+	}
+}
+
+// WithTransform transforms the payloads of all data packets sent and
+// received with t, such as to encrypt them. The stream takes care of the
+// extra space transformed payloads take up, and payloads that fail to open
+// fail the stream with ErrProtocol. Both ends must use matching transforms.
+func WithTransform(t Transform) Option {
+	return func(c *config) {
+		c.transform = t
+	}
+}
+
+// WithChecksums follows each packet with a CRC-32C of its header and payload,
+// for transports that may corrupt data, such as some serial links. A packet
+// that fails its checksum fails the stream with ErrChecksum, unless
+// WithChecksumRecovery is used. Both ends must agree: the handshake fails with
+// ErrChecksumsMismatch otherwise. Checksums are disabled with
+// WithoutHandshake, a combination New rejects.
+func WithChecksums() Option {
+	return func(c *config) {
+		c.checksums = true
+	}
+}
+
+// WithChecksumRecovery drops packets that fail their checksum, and resets the
+// channel they belong to with ErrChecksum, rather than failing the stream.
+// This only helps if the corruption didn't affect the length of the packet,
+// so that the next packet can be found, and not at all with WithCompression,
+// whose state spans packets. Implies WithChecksums.
+func WithChecksumRecovery() Option {
+	return func(c *config) {
+		c.checksums = true
+		c.checksumRecovery = true
+	}
+}
+
+// WithoutFeatures disables optional protocol features, as if this end didn't
+// support them. See Features.
+func WithoutFeatures(features Features) Option {
+	return func(c *config) {
+		c.features &^= features
+	}
+}
+
+// WithStrictPacketTypes fails the stream with ErrProtocol when a packet of an
+// unknown type is received. By default such packets are skipped, so that
+// newer peers can introduce packet types without breaking older ones, and
+// counted by UnknownPackets.
+func WithStrictPacketTypes() Option {
+	return func(c *config) {
+		c.strictPacketTypes = true
+	}
+}
+
+// WithMaxMessageSize limits the size of messages sent with WriteMessage and
+// received with ReadMessage, 1MB by default. ReadMessage buffers a whole
+// message, so this bounds the memory it uses.
+func WithMaxMessageSize(bytes int) Option {
+	return func(c *config) {
+		c.report("WithMaxMessageSize", "")
+		if bytes < 1 {
+			c.report("WithMaxMessageSize", "size of %d bytes is less than 1", bytes)
+		}
+		c.maxMessageSize = bytes
+	}
+}
+
+// WithControlRateLimit fails the stream with ErrProtocol if the peer sends
+// control packets of any one kind, such as pings or window updates (see
+// ControlStats), faster than perSecond, as a peer flooding us with them is
+// burning our CPU without transferring any data. Bursts of up to perSecond
+// packets are allowed. Zero disables the limit.
+//
+// By default the limit is 50000, and doesn't apply to opening and resetting
+// channels, which WithOpenRateLimit and WithMaxChannels limit instead. Once
+// set with this option, it applies to them too.
+func WithControlRateLimit(perSecond int) Option {
+	return func(c *config) {
+		c.report("WithControlRateLimit", negativeProblem(perSecond < 0), perSecond)
+		c.controlRate = perSecond
+		c.limitOpens = true
+	}
+}
+
+// WithBandwidthLimiter limits the rate at which data is written to the
+// transport, such as to share an uplink fairly. Before each packet of channel
+// data is written, the limiter is asked to wait for its size in bytes,
+// including the header. Once the limiter is slowing the writer down, channel
+// writes block as their windows fill and their packets queue up.
+//
+// Control packets, such as pings and window updates, are small and aren't
+// limited. They are written as soon as they are queued, even while the writer
+// is waiting for the limiter, so that a slow limit doesn't delay pings or stop
+// the peer's data flowing in the other direction. An error from the limiter,
+// other than because it was interrupted to write a control packet, fails the
+// stream.
+func WithBandwidthLimiter(limiter Limiter) Option {
+	return func(c *config) {
+		c.limiter = limiter
+	}
+}
+
+// WithIdleTimeout closes the stream with ErrIdleTimeout if no packets at all
+// have been sent or received for the duration d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.report("WithIdleTimeout", negativeProblem(d < 0), d)
+		c.idleTimeout = d
+	}
+}
+
+// WithChannelIdleTimeout closes channels with ErrIdleTimeout if they are
+// neither read from nor written to for the duration d. The timeout can be
+// overridden per channel with Channel.SetIdleTimeout.
+func WithChannelIdleTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.report("WithChannelIdleTimeout", negativeProblem(d < 0), d)
+		c.channelIdleTimeout = d
+	}
+}
+
+// WithOnChannelOpen calls open with each channel before it is returned by
+// Accept, and each channel Dial sends to the peer, before Dial returns and
+// whether or not the peer accepts it.
+//
+// open is called synchronously, so it must not block.
+func WithOnChannelOpen(open func(ch *Channel)) Option {
+	return func(c *config) {
+		c.onOpen = open
+	}
+}
+
+// WithOnChannelClose calls close exactly once for each channel that is
+// returned by Accept or sent to the peer by Dial, whether or not
+// WithOnChannelOpen is also used. It is called once the channel has been
+// closed, by either end or because the stream closed, and after the function
+// passed to WithOnChannelOpen, if any. err is the reason the channel closed
+// (see ChannelStats.Err).
+//
+// close is called synchronously by the goroutine that closed the channel,
+// which may be the one reading from the transport, so it must not block.
+func WithOnChannelClose(close func(ch *Channel, err error)) Option {
+	return func(c *config) {
+		c.onClose = close
+	}
+}
+
+// WithFrameHook calls hook with each frame sent to or received from the peer,
+// just before it is queued to be sent or handled. Returning an error vetoes
+// the frame. A frame being sent is dropped, and the call that sent it, such as
+// Write, Dial, Ping, GoAway or SendExtension, fails with that error. A
+// received frame is dropped, except that a channel it opens is refused, with
+// ErrChannelRefused, and its data is discarded without shrinking the peer's
+// window. Either way, the stream and its channels carry on.
+//
+// Frames that either end waits for, or that keep the ends in step, can't be
+// vetoed, and errors returned for them are ignored: acknowledgements and
+// refusals of channels, FINs and RSTs, window updates, settings, and replies
+// to pings, as well as the peer's pings.
+//
+// hook is called without any locks held, by the goroutine sending or
+// receiving the frame. Frames are sent by the goroutine calling Write, Dial
+// and so on, so a slow hook only delays that call. Received frames, and the
+// replies to them, are passed to hook by the goroutine reading from the
+// transport, so a slow hook delays every frame received after them, on every
+// channel.
+func WithFrameHook(hook func(dir Direction, f FrameInfo) error) Option {
+	return func(c *config) {
+		c.frameHook = hook
+	}
+}
+
+// WithDebugDump writes a human-readable trace of every frame sent or received
+// to w: its direction, type, channel, flags and length, and a hex dump of the
+// start of its payload. Payloads are shown before compression.
+//
+// To keep the trace of a bulk transfer manageable, only the first 64 bytes of
+// each payload are dumped, and only a thousand frames a second, with a note
+// of how many were skipped. w is written to by the goroutines reading from
+// and writing to the transport, so it should be fast.
+func WithDebugDump(w io.Writer) Option {
+	return func(c *config) {
+		c.debugDump = w
+	}
+}
+
+// WithLogger logs significant events to logger, such as the stream closing,
+// protocol errors, and channels refused. Nothing is logged by default.
+//
+// Every message has the session's ID (see MultiplexedStream.ID) under the key
+// "session_id", and other keys include "channel_id" for the channel concerned
+// and "error" for an error.
+func WithLogger(logger Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithSessionID sets the ID of the session (see MultiplexedStream.ID), such
+// as the ID of the request it serves, to be agreed with the peer. IDs longer
+// than MaxSessionIDSize are truncated.
+func WithSessionID(id string) Option {
+	return func(c *config) {
+		c.report("WithSessionID", "")
+		if len(id) > MaxSessionIDSize {
+			c.report("WithSessionID", "ID of %d bytes is longer than MaxSessionIDSize (%d)", len(id), MaxSessionIDSize)
+			id = id[:MaxSessionIDSize]
+		}
+		c.sessionID = id
+	}
+}
+
+// WithClock uses clock for all time-based behaviour, such as to test
+// timeouts without waiting for them. The real clock is used by default, or
+// if clock is nil.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		c.clock = clock
+	}
+}
+
+// WithoutPingActivity excludes pings, sent or received, from LastActivity, so
+// that a stream kept alive by pings is still seen as inactive.
+func WithoutPingActivity() Option {
+	return func(c *config) {
+		c.ignorePings = true
+	}
+}
+
+// WithCloseFunc calls close once the stream has closed its transport, such as
+// to release resources the transport depends on. It is called once, however
+// many times the stream is closed, and an error it returns is logged (see
+// WithLogger).
+func WithCloseFunc(close func() error) Option {
+	return func(c *config) {
+		c.closeFunc = close
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm, err := New(&rwc{r: sr, w: sw}, WithServer())
+	assert.NoError(t, err)
+	defer sm.Close()
+	cm, err := New(&rwc{r: cr, w: cw}, WithClient())
+	assert.NoError(t, err)
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), c.ID()%2)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	go c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// Either end may dial.
+	s, err = sm.Dial()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), s.ID()%2)
+}
+
+func TestNewDefaults(t *testing.T) {
+	m, err := New(nopRWC(), WithClient())
+	assert.NoError(t, err)
+	defer m.Close()
+	assert.Equal(t, uint32(initialWindow), m.config.window)
+	assert.Equal(t, uint32(FragmentSize), m.config.maxFrameSize)
+	assert.Equal(t, uint32(FragmentSize), m.config.maxRecvSize)
+	assert.Equal(t, 64, m.config.acceptBacklog)
+	assert.Equal(t, allFeatures, m.config.features)
+	assert.Equal(t, CompressionNone, m.config.compression)
+	assert.False(t, m.config.checksums)
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	m, err := New(nopRWC(), WithClient(), WithDefaultWindow(1<<20), WithServer(), WithDefaultWindow(1<<21))
+	assert.NoError(t, err)
+	defer m.Close()
+	assert.Equal(t, roleServer, m.config.role)
+	assert.Equal(t, uint32(1<<21), m.config.window)
+
+	// The legacy constructors decide the role themselves.
+	m = MultiplexedServer(nopRWC(), WithClient())
+	defer m.Close()
+	assert.Equal(t, roleServer, m.config.role)
+	m = MultiplexedClient(nopRWC(), WithServer())
+	defer m.Close()
+	assert.Equal(t, roleClient, m.config.role)
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	var m *MultiplexedStream
+	var err error
+	for _, test := range []struct {
+		options  []Option
+		expected string
+	}{
+		{nil, "one of WithServer or WithClient is required"},
+		{[]Option{WithServer(), WithoutHandshake(), WithCompression(CompressionFlate)}, "WithCompression requires the handshake"},
+		{[]Option{WithServer(), WithChecksums(), WithoutHandshake()}, "WithChecksums requires the handshake"},
+		{[]Option{WithClient(), WithChecksumRecovery(), WithCompression(CompressionFlate)}, "WithChecksumRecovery can't recover"},
+	} {
+		m, err = New(nopRWC(), test.options...)
+		assert.Nil(t, m)
+		if assert.Error(t, err) {
+			assert.True(t, errors.Is(err, ErrInvalidConfig), "%s", err)
+			assert.Contains(t, err.Error(), test.expected)
+		}
+	}
+
+	// Each option reports its own invalid values.
+	for _, test := range []struct {
+		option   Option
+		expected string
+	}{
+		{WithDefaultWindow(1000), "WithDefaultWindow: window of 1000 bytes is smaller than the minimum of 65536 bytes"},
+		{WithWindowAutoTuning(100000), "WithWindowAutoTuning: maximum window of 100000 bytes is smaller than the default window of 262144 bytes"},
+		{WithMaxFrameSize(100), "WithMaxFrameSize: 100 bytes is outside the range of 1024 to 16777215 bytes"},
+		{WithMaxFrameSize(1 << 24), "WithMaxFrameSize: 16777216 bytes is outside the range"},
+		{WithMaxReceiveFrameSize(0), "WithMaxReceiveFrameSize: 0 bytes is outside the range"},
+		{WithMaxBufferedBytes(-1), "WithMaxBufferedBytes: -1 is negative, and 0 disables it"},
+		{WithMaxChannels(-2), "WithMaxChannels: -2 is negative"},
+		{WithAcceptBacklog(-1), "WithAcceptBacklog: backlog of -1 is negative"},
+		{WithOpenRateLimit(-1, 10), "WithOpenRateLimit: rate of -1 channels a second is negative"},
+		{WithOpenRateLimit(math.NaN(), 10), "WithOpenRateLimit: rate of NaN channels a second"},
+		{WithOpenRateLimit(10, 0), "WithOpenRateLimit: burst of 0 channels is less than 1"},
+		{WithMaxMessageSize(0), "WithMaxMessageSize: size of 0 bytes is less than 1"},
+		{WithControlRateLimit(-1), "WithControlRateLimit: -1 is negative"},
+		{WithIdleTimeout(-time.Second), "WithIdleTimeout: -1s is negative"},
+		{WithChannelIdleTimeout(-time.Second), "WithChannelIdleTimeout: -1s is negative"},
+		{WithSessionID(strings.Repeat("x", MaxSessionIDSize+1)), "WithSessionID: ID of 129 bytes is longer than MaxSessionIDSize (128)"},
+		{WithCodec("", newFlateCodec), `WithCodec(""): codec has no name`},
+		{WithCodec(strings.Repeat("x", MaxCodecNameLength+1), newFlateCodec), "name of 17 bytes is longer than MaxCodecNameLength (16)"},
+		{WithCodec("zstd", nil), `WithCodec("zstd"): newCodec is nil`},
+		{WithServices("echo", ""), `WithServices(""): service has no name`},
+		{WithServices(strings.Repeat("x", MaxServiceNameLength+1)), "name of 256 bytes is longer than MaxServiceNameLength (255)"},
+		{WithCompression(Compression(9)), "WithCompression: unknown compression(9)"},
+	} {
+		_, err := New(nopRWC(), WithServer(), WithDefaultWindow(1<<18), test.option)
+		if assert.Error(t, err, test.expected) {
+			assert.True(t, errors.Is(err, ErrInvalidConfig), "%s", err)
+			assert.Contains(t, err.Error(), test.expected)
+		}
+	}
+
+	_, err = New(nil, WithServer())
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "%s", err)
+	assert.Contains(t, err.Error(), "conn is nil")
+
+	// A valid value replaces an invalid one.
+	m, err = New(nopRWC(), WithServer(), WithDefaultWindow(1000), WithDefaultWindow(1<<20), WithSessionID(strings.Repeat("x", 200)), WithSessionID("id"))
+	assert.NoError(t, err)
+	m.Close()
+
+	// Disabling what was enabled is not a contradiction.
+	m, err = New(nopRWC(), WithServer(), WithCompression(CompressionFlate), WithCompression(CompressionNone), WithoutHandshake())
+	assert.NoError(t, err)
+	m.Close()
+}
+
+func TestLegacyConstructorsDontValidate(t *testing.T) {
+	// Invalid values are replaced by the nearest valid value.
+	m := MultiplexedServer(nopRWC(), WithDefaultWindow(1000), WithMaxFrameSize(100), WithAcceptBacklog(-1), WithSessionID(strings.Repeat("x", 200)))
+	defer m.Close()
+	assert.Equal(t, uint32(initialWindow), m.config.window)
+	assert.Equal(t, uint32(FragmentSize), m.config.maxFrameSize)
+	assert.Equal(t, 0, m.config.acceptBacklog)
+	assert.Equal(t, strings.Repeat("x", MaxSessionIDSize), m.config.sessionID)
+
+	// A nil conn fails the stream.
+	m = MultiplexedClient(nil)
+	waitFor(t, func() bool { return m.Err() != nil })
+	assert.True(t, errors.Is(m.Err(), ErrInvalidConfig), "%s", m.Err())
+	_, err := m.Dial()
+	assert.Error(t, err)
+}
+
+// A transport that is never written to by the peer.
+func nopRWC() io.ReadWriteCloser {
+	r, _ := io.Pipe()
+	_, w := io.Pipe()
+	return &rwc{r: r, w: w}
+}
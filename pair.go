@@ -0,0 +1,106 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// NewPair is New for transports whose two directions are separate, such as
+// the stdin and stdout of a process, or two unidirectional byte streams. The
+// stream reads from r and writes to w.
+//
+// Closing the stream closes whichever of r and w are io.Closers, once each,
+// and then calls the function of WithCloseFunc, if any.
+func NewPair(r io.Reader, w io.Writer, options ...Option) (*MultiplexedStream, error) {
+	if r == nil || w == nil {
+		return nil, fmt.Errorf("%w: NewPair: reader or writer is nil", ErrInvalidConfig)
+	}
+	return New(&pair{r: r, w: w}, options...)
+}
+
+// Pipe returns the server and client ends of a stream connected in memory,
+// such as for tests, or for communication within a process. Options apply to
+// both ends.
+//
+// As with io.Pipe, the transport is synchronous: each write blocks until the
+// peer has read it. This makes Pipe a good way of finding deadlocks, as there
+// is no buffer to hide them.
+func Pipe(options ...Option) (server, client *MultiplexedStream) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server = MultiplexedServer(&pair{r: sr, w: sw}, options...)
+	client = MultiplexedClient(&pair{r: cr, w: cw}, options...)
+	return server, client
+}
+
+// An io.ReadWriteCloser made of a reader and a writer.
+type pair struct {
+	r     io.Reader
+	w     io.Writer
+	close sync.Once
+	err   error
+}
+
+func (p *pair) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pair) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func (p *pair) Close() error {
+	p.close.Do(func() {
+		if c, ok := p.w.(io.Closer); ok {
+			p.err = c.Close()
+		}
+		if c, ok := p.r.(io.Closer); ok && !same(p.r, p.w) {
+			if err := c.Close(); p.err == nil {
+				p.err = err
+			}
+		}
+	})
+	return p.err
+}
+
+// Whether a and b are the same value, without panicking if they can't be
+// compared.
+func same(a, b interface{}) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	return ta == tb && ta.Comparable() && a == b
+}
+
+// Close the transport, and call the function of WithCloseFunc the first time.
+func (m *MultiplexedStream) closeConn() {
+	m.conn.Close()
+	if f := m.config.closeFunc; f != nil {
+		m.closeFunc.Do(func() {
+			if err := f(); err != nil {
+				m.log(levelWarn, "close function failed", "error", err)
+			}
+		})
+	}
+}
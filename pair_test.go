@@ -0,0 +1,130 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Counts calls to Close.
+type closeCounter struct {
+	io.ReadWriteCloser
+	closed int32
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return c.ReadWriteCloser.Close()
+}
+
+func TestNewPair(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	var closes int32
+	closeFunc := func() error {
+		atomic.AddInt32(&closes, 1)
+		return errors.New("ignored")
+	}
+	sm, err := NewPair(sr, sw, WithServer(), WithCloseFunc(closeFunc))
+	assert.NoError(t, err)
+	cm, err := NewPair(cr, cw, WithClient())
+	assert.NoError(t, err)
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	go c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// Both halves are closed, so the peer sees the stream end.
+	assert.NoError(t, sm.Close())
+	assert.NoError(t, sm.Close())
+	_, err = sr.Read(b)
+	assert.Equal(t, io.ErrClosedPipe, err)
+	_, err = sw.Write(b)
+	assert.Equal(t, io.ErrClosedPipe, err)
+	waitFor(t, func() bool { return cm.Err() != nil })
+	assert.Equal(t, int32(1), atomic.LoadInt32(&closes))
+}
+
+func TestNewPairClosesOnce(t *testing.T) {
+	r, w := io.Pipe()
+	conn := &closeCounter{ReadWriteCloser: &rwc{r: r, w: w}}
+	m, err := NewPair(conn, conn, WithServer())
+	assert.NoError(t, err)
+	m.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conn.closed))
+
+	// Halves that can't be closed are left alone.
+	r, w = io.Pipe()
+	m, err = NewPair(io.MultiReader(r), w, WithClient())
+	assert.NoError(t, err)
+	m.Close()
+	_, err = w.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+	r.Close()
+
+	_, err = NewPair(nil, w, WithClient())
+	assert.True(t, errors.Is(err, ErrInvalidConfig), "%s", err)
+}
+
+func TestPipe(t *testing.T) {
+	sm, cm := Pipe(WithMaxChannels(1))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, c.ID(), s.ID())
+	_, err = cm.Dial()
+	assert.Equal(t, ErrTooManyChannels, err)
+	_, err = sm.Dial()
+	assert.Equal(t, ErrTooManyChannels, err)
+
+	go c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(s, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// Closing one end closes the other.
+	assert.NoError(t, cm.Close())
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrSessionClosed), "%s", sm.Err())
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Interval after which the round-trip time is measured again.
+const rttInterval = time.Second * 30
+
+// RTT returns the most recently measured round-trip time to the peer, or zero
+// if it has not been measured.
+func (m *MultiplexedStream) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.rtt))
+}
+
+// An outstanding ping.
+type ping struct {
+	sent  time.Time
+	reply chan time.Duration // Receives the round-trip time, if non-nil.
+}
+
+// Ping the peer, returning the round-trip time.
+//
+// If ctx is done before the reply arrives, ctx.Err() is returned.
+func (m *MultiplexedStream) Ping(ctx context.Context) (time.Duration, error) {
+	nonce := atomic.AddUint64(&m.nonce, 1)
+	reply := make(chan time.Duration, 1)
+	m.lock.Lock()
+	m.pings[nonce] = &ping{sent: m.config.clock.Now(), reply: reply}
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.pings, nonce)
+		m.lock.Unlock()
+	}()
+
+	p := pingPacket(nonce, 0)
+	if err := m.hook(Outbound, p); err != nil {
+		return 0, err
+	}
+	select {
+	case m.control <- p:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-m.tomb.Dying():
+		return 0, m.err()
+	}
+
+	select {
+	case rtt := <-reply:
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-m.tomb.Dying():
+		return 0, m.err()
+	}
+}
+
+// Send a ping to measure the round-trip time, without waiting for the reply.
+func (m *MultiplexedStream) measureRTT() {
+	nonce := atomic.AddUint64(&m.nonce, 1)
+	m.lock.Lock()
+	m.pings[nonce] = &ping{sent: m.config.clock.Now()}
+	m.lock.Unlock()
+	p := pingPacket(nonce, 0)
+	if m.hook(Outbound, p) == nil {
+		select {
+		case m.control <- p:
+			return
+		default:
+		}
+	}
+	m.lock.Lock()
+	delete(m.pings, nonce)
+	m.lock.Unlock()
+}
+
+// Measure the round-trip time again if the last measurement is stale and no
+// ping is outstanding.
+func (m *MultiplexedStream) refreshRTT() {
+	m.lock.Lock()
+	stale := len(m.pings) == 0 && m.config.clock.Now().Sub(m.rttAt) > rttInterval
+	m.lock.Unlock()
+	if stale {
+		m.measureRTT()
+	}
+}
+
+func pingPacket(nonce uint64, flags uint16) *packet {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, nonce)
+	return &packet{typ: typePing, flags: flags, payload: payload}
+}
+
+// Reply to a ping from the peer, or record the round-trip time of a reply.
+func (m *MultiplexedStream) handlePing(p *packet) error {
+	if len(p.payload) != 8 {
+		return fmt.Errorf("%w: ping of %d bytes", ErrProtocol, len(p.payload))
+	}
+	nonce := binary.BigEndian.Uint64(p.payload)
+
+	if p.flags&ACK == 0 {
+		m.reply(pingPacket(nonce, ACK))
+		return nil
+	}
+
+	now := m.config.clock.Now()
+	m.lock.Lock()
+	ping, ok := m.pings[nonce]
+	delete(m.pings, nonce)
+	if ok {
+		m.rttAt = now
+	}
+	m.lock.Unlock()
+	if !ok {
+		// Abandoned, or a reply to a ping we never sent.
+		return nil
+	}
+	rtt := now.Sub(ping.sent)
+	atomic.StoreInt64(&m.rtt, int64(rtt))
+	if ping.reply != nil {
+		ping.reply <- rtt
+	}
+	return nil
+}
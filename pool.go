@@ -0,0 +1,98 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Payload buffers are pooled in power of two size classes, from
+// 1<<minPoolClass bytes up to the largest possible payload.
+const minPoolClass = 6
+
+var bufferPools [25]sync.Pool
+
+// Size class of a buffer of n bytes.
+func poolClass(n int) int {
+	if n <= 1<<minPoolClass {
+		return minPoolClass
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// Get a buffer with room for at least n bytes from the pool. It should be
+// returned with putBuffer once nothing refers to it.
+func getBuffer(n int) *[]byte {
+	class := poolClass(n)
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, 1<<class)
+	return &b
+}
+
+func putBuffer(b *[]byte) {
+	class := poolClass(cap(*b))
+	if cap(*b) != 1<<class {
+		return
+	}
+	*b = (*b)[:cap(*b)]
+	bufferPools[class].Put(b)
+}
+
+var packetPool = sync.Pool{New: func() interface{} { return &packet{} }}
+
+// A data packet from ch carrying a copy of b, in pooled memory. The writer
+// returns it to the pool once it has been sent.
+func newDataPacket(ch *Channel, b []byte) *packet {
+	buf := getBuffer(len(b))
+	copy(*buf, b)
+	return newBufferPacket(ch, buf, len(b))
+}
+
+// A data packet from ch whose payload is the first n bytes of buf, which is
+// taken over by the packet.
+func newBufferPacket(ch *Channel, buf *[]byte, n int) *packet {
+	p := packetPool.Get().(*packet)
+	p.id = ch.id
+	p.ch = ch
+	p.buf = buf
+	p.payload = (*buf)[:n]
+	return p
+}
+
+// Return a packet created by newDataPacket to the pool. Other packets are
+// left alone.
+func (p *packet) release() {
+	if p.buf == nil {
+		return
+	}
+	putBuffer(p.buf)
+	*p = packet{}
+	packetPool.Put(p)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"sync"
+	"time"
+)
+
+// An OpenLimiter decides whether to accept each channel the peer opens (see
+// WithOpenLimiter). It is satisfied by *rate.Limiter from
+// golang.org/x/time/rate.
+type OpenLimiter interface {
+	// Allow reports whether a channel may be opened now. It is called by the
+	// goroutine that reads from the connection, so it must not block.
+	Allow() bool
+}
+
+// A token bucket, refilled at rate tokens a second up to burst tokens, which
+// it starts with.
+type tokenBucket struct {
+	lock   sync.Mutex
+	clock  Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	at     time.Time // When tokens was last refilled.
+}
+
+func newTokenBucket(clock Clock, rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		clock:  clock,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		at:     clock.Now(),
+	}
+}
+
+// Add the tokens accrued since the last refill. Called with the lock held.
+func (b *tokenBucket) refill() {
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.at).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.at = now
+}
+
+// Take n tokens, returning how long to wait until they would have been
+// available. The bucket goes into debt rather than refusing, so that any
+// number of tokens can be taken.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Return n tokens that were taken but not used.
+func (b *tokenBucket) refund(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Allow takes a token, if there is one.
+func (b *tokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// SetRateLimit limits the rate at which data is written to the channel to
+// bytesPerSecond, or removes the limit if it is zero. Writes are smoothed over
+// packet boundaries: each packet waits until the channel has earned its size
+// since the last, with bursts of up to one packet allowed after the channel
+// has been idle. Other channels are unaffected.
+//
+// A write that is waiting for the limit fails with a timeout once the write
+// deadline passes, having written only the packets sent before then.
+func (c *Channel) SetRateLimit(bytesPerSecond int) {
+	var rate *tokenBucket
+	if bytesPerSecond > 0 {
+		rate = newTokenBucket(c.m.config.clock, float64(bytesPerSecond), int(c.m.MaxFrameSize()))
+	}
+	c.lock.Lock()
+	c.rate = rate
+	c.lock.Unlock()
+}
+
+// Wait until the rate limit allows n bytes to be written.
+func (c *Channel) throttle(n int) error {
+	c.lock.Lock()
+	rate := c.rate
+	c.lock.Unlock()
+	if rate == nil {
+		return nil
+	}
+	delay := rate.take(n)
+	if delay <= 0 {
+		return nil
+	}
+	var err error
+	select {
+	case <-c.m.config.clock.After(delay):
+		return nil
+	case <-c.writeDeadline.wait():
+		err = errTimeout
+	case <-c.m.deadline.wait():
+		err = errTimeout
+	case <-c.tomb.Dying():
+		err = c.err()
+	}
+	rate.refund(n)
+	return err
+}
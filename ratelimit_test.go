@@ -0,0 +1,168 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestOpenRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithOpenRateLimit(10, 5), WithClock(clock))
+	cm := MultiplexedClient(&rwc{r: cr, w: cw})
+	defer sm.Close()
+	defer cm.Close()
+
+	dial := func() error {
+		_, err := cm.Dial()
+		return err
+	}
+
+	// A burst is allowed, then channels are refused until tokens accrue.
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, dial())
+	}
+	assert.Equal(t, ErrRateLimited, dial())
+	clock.Advance(100 * time.Millisecond)
+	assert.NoError(t, dial())
+	assert.Equal(t, ErrRateLimited, dial())
+
+	// Idle time accrues no more than the burst.
+	clock.Advance(time.Minute)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, dial())
+	}
+	assert.Equal(t, ErrRateLimited, dial())
+	assert.Equal(t, 11, sm.AcceptBacklog())
+	assert.NoError(t, sm.Err())
+}
+
+type openLimiterFunc func() bool
+
+func (f openLimiterFunc) Allow() bool { return f() }
+
+func TestOpenLimiter(t *testing.T) {
+	allow := false
+	sm, cm := newServerAndClient(WithOpenLimiter(openLimiterFunc(func() bool { return allow })))
+	defer sm.Close()
+	defer cm.Close()
+
+	_, err := cm.Dial()
+	assert.Equal(t, ErrRateLimited, err)
+	assert.True(t, isRefusal(err))
+
+	allow = true
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+}
+
+func TestChannelRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	sm, cm := newServerAndClient(WithClock(clock))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	c.SetRateLimit(10 * 1024)
+
+	data := make([]byte, 50*1024)
+	go c.Write(data)
+	var received int64
+	go func() {
+		b := make([]byte, FragmentSize)
+		for {
+			n, err := s.Read(b)
+			atomic.AddInt64(&received, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Other channels aren't limited.
+	c2, err := cm.Dial()
+	assert.NoError(t, err)
+	s2, err := sm.Accept()
+	assert.NoError(t, err)
+	go c2.Write(data)
+	_, err = io.ReadFull(s2, make([]byte, len(data)))
+	assert.NoError(t, err)
+
+	var elapsed time.Duration
+	for {
+		waitFor(t, func() bool { return clock.Pending() > 0 || atomic.LoadInt64(&received) == int64(len(data)) })
+		if atomic.LoadInt64(&received) == int64(len(data)) {
+			break
+		}
+		clock.Advance(100 * time.Millisecond)
+		elapsed += 100 * time.Millisecond
+	}
+	// After a burst of one packet, the rest arrive at the limit.
+	expected := time.Duration(float64(len(data)-FragmentSize) / (10 * 1024) * float64(time.Second))
+	assert.True(t, elapsed > expected*9/10 && elapsed < expected*11/10, "took %s, expected %s", elapsed, expected)
+}
+
+func TestChannelRateLimitDeadline(t *testing.T) {
+	clock := newFakeClock()
+	sm, cm := newServerAndClient(WithClock(clock))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	c.SetRateLimit(1024)
+	assert.NoError(t, c.SetWriteDeadline(clock.Now().Add(20*time.Millisecond)))
+	var n int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = c.Write(make([]byte, FragmentSize*4))
+	}()
+	// Once the write is waiting for tokens, expire the deadline.
+	waitFor(t, func() bool { return clock.Pending() == 2 })
+	clock.Advance(20 * time.Millisecond)
+	<-done
+	assert.Equal(t, errTimeout, err)
+	assert.Equal(t, FragmentSize, n)
+
+	// Removing the limit lets writes through.
+	c.SetRateLimit(0)
+	assert.NoError(t, c.SetWriteDeadline(time.Time{}))
+	n, err = c.Write(make([]byte, FragmentSize*4))
+	assert.NoError(t, err)
+	assert.Equal(t, FragmentSize*4, n)
+}
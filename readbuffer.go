@@ -0,0 +1,241 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// A contiguous run of received data, held in a pooled buffer.
+type segment struct {
+	buf      *[]byte
+	off, end int // Unread data is (*buf)[off:end].
+}
+
+func (s segment) bytes() []byte { return (*s.buf)[s.off:s.end] }
+
+// Received data waiting to be read, kept in the pooled buffers the reader
+// received it into rather than copied.
+type readQueue struct {
+	segments []segment
+	n        int      // Total unread bytes.
+	off      uint64   // Total bytes read.
+	ends     []uint64 // Offsets at which unread messages end, see EOM.
+}
+
+func (q *readQueue) Len() int { return q.n }
+
+// Append b, which must be the start of the pooled buffer buf, followed by the
+// end of a message if eom is true. Small payloads are copied into the last
+// segment if it has room, so that many tiny frames can't pin a buffer each.
+// Returns whether the queue took ownership of buf.
+func (q *readQueue) write(buf *[]byte, b []byte, eom bool) bool {
+	q.n += len(b)
+	if eom {
+		q.ends = append(q.ends, q.off+uint64(q.n))
+	}
+	if len(b) == 0 {
+		return false
+	}
+	if i := len(q.segments) - 1; i >= 0 {
+		last := &q.segments[i]
+		if cap(*last.buf)-last.end >= len(b) {
+			last.end += copy((*last.buf)[last.end:cap(*last.buf)], b)
+			return false
+		}
+	}
+	q.segments = append(q.segments, segment{buf: buf, end: len(b)})
+	return true
+}
+
+// Copy unread data into b, ignoring the ends of messages.
+func (q *readQueue) read(b []byte) int {
+	n := q.copy(b)
+	q.skipEnds()
+	return n
+}
+
+// Copy unread data into b, stopping at the end of the current message.
+// Returns whether the message has been completely read.
+func (q *readQueue) readPart(b []byte) (int, bool) {
+	if len(q.ends) == 0 {
+		return q.copy(b), false
+	}
+	if left := q.ends[0] - q.off; uint64(len(b)) > left {
+		b = b[:left]
+	}
+	n := q.copy(b)
+	if q.off < q.ends[0] {
+		return n, false
+	}
+	q.ends = q.ends[1:]
+	return n, true
+}
+
+// Drop the ends of messages that have been read past.
+func (q *readQueue) skipEnds() {
+	for len(q.ends) > 0 && q.ends[0] <= q.off {
+		q.ends = q.ends[1:]
+	}
+}
+
+// Copy unread data into b, returning buffers that have been fully read to
+// the pool.
+func (q *readQueue) copy(b []byte) int {
+	n := 0
+	for n < len(b) && len(q.segments) > 0 {
+		s := &q.segments[0]
+		c := copy(b[n:], s.bytes())
+		s.off += c
+		n += c
+		if s.off == s.end {
+			putBuffer(s.buf)
+			q.pop()
+		}
+	}
+	q.n -= n
+	q.off += uint64(n)
+	return n
+}
+
+// Remove the first segment from the queue, without releasing its buffer.
+func (q *readQueue) next() segment {
+	s := q.segments[0]
+	q.pop()
+	q.n -= s.end - s.off
+	q.off += uint64(s.end - s.off)
+	q.skipEnds()
+	return s
+}
+
+func (q *readQueue) pop() {
+	last := len(q.segments) - 1
+	copy(q.segments, q.segments[1:])
+	q.segments[last] = segment{}
+	q.segments = q.segments[:last]
+}
+
+// Discard all unread data.
+func (q *readQueue) reset() {
+	for _, s := range q.segments {
+		putBuffer(s.buf)
+	}
+	q.segments = nil
+	q.off += uint64(q.n)
+	q.n = 0
+	q.ends = nil
+}
+
+// ReadBuffer returns the next run of received data without copying it,
+// blocking until data is available as Read does. The returned slice is only
+// valid until release is called, after which its memory is reused. Release
+// should be called once the data is no longer needed, and has no effect if
+// called again.
+//
+// ReadBuffer returns at most one frame's worth of data, and may return less
+// if part of the frame has already been read with Read. The two can be mixed
+// freely.
+func (c *Channel) ReadBuffer() (b []byte, release func(), err error) {
+	_, s, _, err := c.read(nil, readBorrow)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.bytes(), func() {
+		if s.buf != nil {
+			putBuffer(s.buf)
+			s.buf = nil
+		}
+	}, nil
+}
+
+// How Channel.read consumes received data.
+const (
+	readAll    = iota // Copy into b.
+	readBorrow        // Remove the next segment from the read queue and return it.
+	readPart          // Copy into b, up to the end of the current message.
+)
+
+// Wait for received data and consume it as mode says. Returns whether the end
+// of a message was reached, in readPart mode.
+func (c *Channel) read(b []byte, mode int) (int, segment, bool, error) {
+	if mode != readPart {
+		if err := useMode(&c.readMode, modeStream); err != nil {
+			return 0, segment{}, false, err
+		}
+	}
+	for {
+		if isClosed(c.readDeadline.wait()) || isClosed(c.m.deadline.wait()) {
+			return 0, segment{}, false, errTimeout
+		}
+
+		c.lock.Lock()
+		if c.rbuf.Len() > 0 || mode == readPart && len(c.rbuf.ends) > 0 {
+			var n int
+			var s segment
+			var end bool
+			switch mode {
+			case readBorrow:
+				s = c.rbuf.next()
+				n = s.end - s.off
+			case readPart:
+				n, end = c.rbuf.readPart(b)
+			default:
+				n = c.rbuf.read(b)
+			}
+			more := c.rbuf.Len() > 0 || len(c.rbuf.ends) > 0
+			c.lock.Unlock()
+			if more {
+				// Pass any remaining data on to concurrent readers.
+				signal(c.readable)
+			}
+			atomic.AddInt64(&c.m.buffered, -int64(n))
+			c.touch()
+			c.updateWindow(n)
+			c.m.relieve()
+			return n, s, end, nil
+		}
+		eof := c.readClosed || c.peerWriteClosed
+		c.lock.Unlock()
+
+		if err := c.err(); err != nil {
+			return 0, segment{}, false, err
+		}
+		if eof {
+			return 0, segment{}, false, io.EOF
+		}
+
+		select {
+		case <-c.readable:
+		case <-c.readDeadline.wait():
+			return 0, segment{}, false, errTimeout
+		case <-c.m.deadline.wait():
+			return 0, segment{}, false, errTimeout
+		case <-c.tomb.Dying():
+		}
+	}
+}
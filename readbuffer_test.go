@@ -0,0 +1,216 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestReadQueue(t *testing.T) {
+	q := &readQueue{}
+	for _, s := range []string{"hello", " ", "world"} {
+		buf := getBuffer(len(s))
+		// Small writes are copied into the first buffer.
+		taken := q.write(buf, (*buf)[:copy(*buf, s)], false)
+		assert.Equal(t, s == "hello", taken)
+		if !taken {
+			putBuffer(buf)
+		}
+	}
+	big := getBuffer(1024)
+	assert.True(t, q.write(big, (*big)[:1024], false))
+	assert.Equal(t, 11+1024, q.Len())
+	assert.Equal(t, 2, len(q.segments))
+
+	b := make([]byte, 6)
+	assert.Equal(t, 6, q.read(b))
+	assert.Equal(t, "hello ", string(b))
+	assert.Equal(t, "world", string(q.next().bytes()))
+	assert.Equal(t, 1024, q.Len())
+	q.reset()
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 0, len(q.segments))
+}
+
+func TestReadBuffer(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	data := make([]byte, FragmentSize*3)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+		c.Close()
+	}()
+
+	// Mix zero-copy and copying reads.
+	received := &bytes.Buffer{}
+	b := make([]byte, 1000)
+	for i := 0; ; i++ {
+		if i%2 == 0 {
+			n, err := s.Read(b)
+			received.Write(b[:n])
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			continue
+		}
+		payload, release, err := s.ReadBuffer()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.True(t, len(payload) > 0)
+		received.Write(payload)
+		release()
+		release()
+	}
+	assert.Equal(t, data, received.Bytes())
+	assert.Equal(t, 0, sm.Buffered())
+}
+
+// Everything the peer wrote is read before the error that ends the channel,
+// however it ends and whatever size the reads.
+func TestReadDrainedBeforeClose(t *testing.T) {
+	data := make([]byte, 10*1024)
+	rand.Read(data)
+	endings := []struct {
+		name string
+		end  func(sm, cm *MultiplexedStream, c *Channel)
+		err  error
+	}{
+		{"Close", func(sm, cm *MultiplexedStream, c *Channel) { c.Close() }, io.EOF},
+		{"CloseWrite", func(sm, cm *MultiplexedStream, c *Channel) { c.CloseWrite() }, io.EOF},
+		// Unlike closing a channel, closing a stream doesn't wait for data
+		// written to be sent, so the data must have arrived first.
+		{"peer session", func(sm, cm *MultiplexedStream, c *Channel) {
+			waitFor(t, func() bool { return sm.Buffered() == len(data) })
+			cm.Close()
+			waitFor(t, func() bool { return sm.Err() != nil })
+		}, ErrSessionClosed},
+		{"session", func(sm, cm *MultiplexedStream, c *Channel) {
+			waitFor(t, func() bool { return sm.Buffered() == len(data) })
+			sm.Close()
+		}, ErrSessionClosed},
+	}
+	for _, ending := range endings {
+		for _, size := range []int{1, 7, 1000, FragmentSize, len(data), initialWindow} {
+			sm, cm := newServerAndClient()
+			c, err := cm.Dial()
+			assert.NoError(t, err)
+			s, err := sm.Accept()
+			assert.NoError(t, err)
+			_, err = c.Write(data)
+			assert.NoError(t, err)
+			ending.end(sm, cm, c)
+
+			received := &bytes.Buffer{}
+			b := make([]byte, size)
+			for {
+				var n int
+				n, err = s.Read(b)
+				received.Write(b[:n])
+				if err != nil {
+					break
+				}
+			}
+			assert.Equal(t, data, received.Bytes(), "%s, reading %d bytes at a time", ending.name, size)
+			if ending.err == io.EOF {
+				assert.Equal(t, io.EOF, err, ending.name)
+			} else {
+				assert.True(t, errors.Is(err, ending.err), "%s: %v", ending.name, err)
+			}
+			sm.Close()
+			cm.Close()
+		}
+	}
+}
+
+const benchFrameSize = 256 * 1024
+
+// Large frames make the cost of copying them visible.
+func benchmarkRead(b *testing.B, zeroCopy bool) {
+	sm, cm := newServerAndClient(WithMaxFrameSize(benchFrameSize), WithDefaultWindow(benchFrameSize*16))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+
+	data := make([]byte, benchFrameSize)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, len(data))
+	for n := 0; n < len(data)*b.N; {
+		if zeroCopy {
+			payload, release, err := s.ReadBuffer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			n += len(payload)
+			release()
+		} else {
+			r, err := s.Read(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			n += r
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkReadBuffer(b *testing.B) {
+	benchmarkRead(b, true)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of shards in a registry. A power of two.
+const registryShards = 32
+
+// registry maps channel IDs to open channels.
+//
+// It is looked up for every packet received, and updated by every goroutine
+// opening or closing a channel, so it is sharded by ID rather than guarded by
+// the stream's lock.
+type registry struct {
+	count  int64 // Number of channels registered, atomic.
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	lock     sync.RWMutex
+	channels map[uint32]*Channel
+	_        [32]byte // Keep shards on separate cache lines.
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].channels = make(map[uint32]*Channel)
+	}
+	return r
+}
+
+// Each end allocates IDs of one parity, so skip the low bit.
+func (r *registry) shard(id uint32) *registryShard {
+	return &r.shards[(id>>1)%registryShards]
+}
+
+func (r *registry) get(id uint32) (*Channel, bool) {
+	s := r.shard(id)
+	s.lock.RLock()
+	ch, ok := s.channels[id]
+	s.lock.RUnlock()
+	return ch, ok
+}
+
+// Register ch, unless max is positive and there are already that many
+// channels registered.
+func (r *registry) add(ch *Channel, max int) bool {
+	for {
+		n := atomic.LoadInt64(&r.count)
+		if max > 0 && n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.count, n, n+1) {
+			break
+		}
+	}
+	s := r.shard(ch.id)
+	s.lock.Lock()
+	s.channels[ch.id] = ch
+	s.lock.Unlock()
+	return true
+}
+
+// Remove ch, if it is still registered.
+func (r *registry) remove(ch *Channel) {
+	s := r.shard(ch.id)
+	s.lock.Lock()
+	registered := s.channels[ch.id] == ch
+	if registered {
+		delete(s.channels, ch.id)
+	}
+	s.lock.Unlock()
+	if registered {
+		atomic.AddInt64(&r.count, -1)
+	}
+}
+
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// All registered channels, in no particular order.
+func (r *registry) all() []*Channel {
+	channels := make([]*Channel, 0, r.len())
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.lock.RLock()
+		for _, ch := range s.channels {
+			channels = append(channels, ch)
+		}
+		s.lock.RUnlock()
+	}
+	return channels
+}
+
+// NumChannels returns the number of open channels, whether dialled or
+// accepted, including those waiting for Accept. A half-closed channel is open
+// until both ends have closed it. It is cheap enough to call for every Dial,
+// such as to pick the least loaded of a pool of streams.
+func (m *MultiplexedStream) NumChannels() int {
+	return m.channels.len()
+}
+
+// Channels returns a snapshot of the open channels, in order of ID. Each
+// channel's Stats and String describe it further. Channels opened or closed
+// while the snapshot is taken may or may not be included, and those included
+// may since have closed.
+func (m *MultiplexedStream) Channels() []*Channel {
+	channels := m.channels.all()
+	sort.Slice(channels, func(i, j int) bool { return channels[i].id < channels[j].id })
+	return channels
+}
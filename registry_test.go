@@ -0,0 +1,241 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	a := &Channel{id: 1}
+	b := &Channel{id: 2}
+	assert.True(t, r.add(a, 2))
+	assert.True(t, r.add(b, 2))
+	assert.False(t, r.add(&Channel{id: 3}, 2))
+	assert.Equal(t, 2, r.len())
+	ch, ok := r.get(1)
+	assert.True(t, ok)
+	assert.Equal(t, a, ch)
+
+	// Only the channel registered under an ID removes it.
+	r.remove(&Channel{id: 1})
+	_, ok = r.get(1)
+	assert.True(t, ok)
+	r.remove(a)
+	_, ok = r.get(1)
+	assert.False(t, ok)
+	assert.Equal(t, 1, r.len())
+	assert.Equal(t, []*Channel{b}, r.all())
+}
+
+func BenchmarkRegistryParallel(b *testing.B) {
+	r := newRegistry()
+	for id := uint32(0); id < 1024; id++ {
+		r.add(&Channel{id: id}, 0)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		id := uint32(0)
+		for pb.Next() {
+			id++
+			if id%16 == 0 {
+				// Occasionally open and close a channel.
+				ch := &Channel{id: 1024 + id%1024}
+				r.add(ch, 0)
+				r.remove(ch)
+			} else {
+				r.get(id % 1024)
+			}
+		}
+	})
+}
+
+func TestMaxChannelsDial(t *testing.T) {
+	sm, cm := newServerAndClient(WithMaxChannels(2))
+	defer sm.Close()
+	defer cm.Close()
+
+	a, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+	_, err = cm.Dial()
+	assert.Equal(t, ErrTooManyChannels, err)
+
+	a.Close()
+	_, err = cm.Dial()
+	assert.NoError(t, err)
+}
+
+func TestMaxChannelsRefused(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	sm.config.maxChannels = 1
+
+	a, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+
+	_, err = cm.Dial()
+	assert.Equal(t, ErrTooManyChannels, err)
+	assert.Equal(t, 1, cm.channels.len())
+
+	// Without waiting for the peer, the refusal is seen on first use.
+	b, err := cm.DialAsync(context.Background())
+	assert.NoError(t, err)
+	_, err = b.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrTooManyChannels), "%s", err)
+
+	// Closing a channel makes room.
+	a.Close()
+	waitFor(t, func() bool { return sm.channels.len() == 0 })
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+}
+
+func TestMaxChannelsChurn(t *testing.T) {
+	const max = 8
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	sm.config.maxChannels = max
+
+	go func() {
+		for {
+			s, err := sm.Accept()
+			if err != nil {
+				return
+			}
+			assert.True(t, sm.channels.len() <= max)
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < max*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4)
+			for j := 0; j < 50; j++ {
+				c, err := cm.Dial()
+				if errors.Is(err, ErrTooManyChannels) {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				if _, err = c.Write(buf); err == nil {
+					_, err = io.ReadFull(c, buf)
+				}
+				if err != nil {
+					assert.True(t, errors.Is(err, ErrTooManyChannels), "%s", err)
+				}
+				if j%2 == 0 {
+					c.Reset()
+				} else {
+					c.Close()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every channel is accounted for once closed.
+	waitFor(t, func() bool { return sm.channels.len() == 0 && cm.channels.len() == 0 })
+}
+
+func TestNumChannels(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	assert.Equal(t, 0, cm.NumChannels())
+	c1, err := cm.Dial()
+	assert.NoError(t, err)
+	s1, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = sm.Dial()
+	assert.NoError(t, err)
+	c2, err := cm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cm.NumChannels())
+	assert.Equal(t, 2, sm.NumChannels())
+
+	// Half-closed channels are still open.
+	assert.NoError(t, c1.CloseWrite())
+	_, err = s1.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, cm.NumChannels())
+	assert.Equal(t, 2, sm.NumChannels())
+	assert.NoError(t, s1.CloseWrite())
+	waitFor(t, func() bool { return cm.NumChannels() == 1 && sm.NumChannels() == 1 })
+
+	assert.NoError(t, c2.Close())
+	waitFor(t, func() bool { return cm.NumChannels() == 0 && sm.NumChannels() == 0 })
+}
+
+func TestChannels(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	assert.Empty(t, cm.Channels())
+	var dialled []*Channel
+	for i := 0; i < 3; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		_, err = sm.Accept()
+		assert.NoError(t, err)
+		dialled = append(dialled, c)
+	}
+	assert.Equal(t, dialled, cm.Channels())
+
+	assert.NoError(t, dialled[1].Close())
+	assert.Equal(t, []*Channel{dialled[0], dialled[2]}, cm.Channels())
+	waitFor(t, func() bool { return len(sm.Channels()) == 2 })
+	for i, s := range sm.Channels() {
+		assert.Equal(t, []*Channel{dialled[0], dialled[2]}[i].ID(), s.ID())
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"container/heap"
+	"sync/atomic"
+)
+
+// SetPriority sets the priority of data written to the channel. When the
+// transport can't keep up, packets from channels with a higher priority are
+// sent ahead of those queued by channels with a lower priority. The default
+// priority is 0.
+//
+// Priorities only affect the order in which this end sends packets, and are
+// not communicated to the peer.
+func (c *Channel) SetPriority(priority int) {
+	atomic.StoreInt32(&c.priority, int32(priority))
+	atomic.StoreUint32(&c.m.sched.stale, 1)
+}
+
+// Priority returns the priority of the channel.
+func (c *Channel) Priority() int {
+	return int(atomic.LoadInt32(&c.priority))
+}
+
+// SetWeight sets the channel's share of the transport relative to other
+// channels with the same priority. When several channels have data queued,
+// each is sent a number of bytes proportional to its weight, so that a busy
+// channel can't starve the rest. The default weight, and the minimum, is 1.
+func (c *Channel) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	atomic.StoreInt32(&c.weight, int32(weight))
+}
+
+// Weight returns the weight of the channel.
+func (c *Channel) Weight() int {
+	if weight := atomic.LoadInt32(&c.weight); weight > 1 {
+		return int(weight)
+	}
+	return 1
+}
+
+// Packets waiting to be written to the transport, in the order chosen by the
+// writer. Only accessed by the writer, except for stale.
+//
+// Packets for a single channel are always sent in the order they were queued.
+// Between channels with the same priority the transport is shared with
+// weighted fair queueing: each queue accumulates virtual time as its packets
+// are sent, in proportion to their size and inversely to the channel's weight,
+// and the queue that is furthest behind goes next.
+//
+// Non-empty queues are kept in a heap, so that choosing the next packet stays
+// cheap however many channels have data queued.
+type scheduler struct {
+	seq    uint64
+	vtime  uint64                // Virtual time of the last packet sent.
+	queues map[uint32]*sendQueue // Non-empty queues, by channel ID.
+	active queueHeap             // Non-empty queues, next to send first.
+	stale  uint32                // A channel's priority has changed, atomic.
+}
+
+type sendQueue struct {
+	ch       *Channel // May be nil for packets not sent by a channel.
+	priority int      // Of ch, as of when the queue was last ordered.
+	vtime    uint64   // Virtual time at which the next packet is due.
+	packets  []queuedPacket
+}
+
+type queuedPacket struct {
+	*packet
+	seq uint64 // Position in the order packets were queued.
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{queues: make(map[uint32]*sendQueue)}
+}
+
+func (q *sendQueue) refresh() {
+	q.priority = 0
+	if q.ch != nil {
+		q.priority = q.ch.Priority()
+	}
+}
+
+func (s *scheduler) push(p *packet) {
+	q, ok := s.queues[p.id]
+	if !ok {
+		// An idle channel doesn't accumulate credit.
+		q = &sendQueue{vtime: s.vtime}
+		s.queues[p.id] = q
+	}
+	if q.ch == nil {
+		q.ch = p.ch
+	}
+	s.seq++
+	q.packets = append(q.packets, queuedPacket{p, s.seq})
+	if !ok {
+		q.refresh()
+		heap.Push(&s.active, q)
+	}
+}
+
+// Remove and return the next packet to send, or nil if there are none.
+func (s *scheduler) pop() *packet {
+	if len(s.active) == 0 {
+		return nil
+	}
+	if atomic.SwapUint32(&s.stale, 0) != 0 {
+		for _, q := range s.active {
+			q.refresh()
+		}
+		heap.Init(&s.active)
+	}
+	best := s.active[0]
+	p := best.packets[0].packet
+	best.packets[0] = queuedPacket{}
+	best.packets = best.packets[1:]
+	weight := 1
+	if best.ch != nil {
+		weight = best.ch.Weight()
+	}
+	s.vtime = best.vtime
+	best.vtime += uint64(headerSize+len(p.payload)) / uint64(weight)
+	if len(best.packets) == 0 {
+		heap.Pop(&s.active)
+		delete(s.queues, p.id)
+	} else {
+		heap.Fix(&s.active, 0)
+	}
+	return p
+}
+
+// Queues ordered by priority, then by virtual time, then by the order their
+// next packets were queued in.
+type queueHeap []*sendQueue
+
+func (h queueHeap) Len() int { return len(h) }
+
+func (h queueHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	switch {
+	case a.priority != b.priority:
+		return a.priority > b.priority
+	case a.vtime != b.vtime:
+		return a.vtime < b.vtime
+	}
+	return a.packets[0].seq < b.packets[0].seq
+}
+
+func (h queueHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *queueHeap) Push(x interface{}) { *h = append(*h, x.(*sendQueue)) }
+
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return q
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// A transport that blocks writes until released, then records them.
+type gatedWriter struct {
+	release chan struct{}
+	lock    sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (g *gatedWriter) Write(b []byte) (int, error) {
+	<-g.release
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.buf.Write(b)
+}
+
+func (g *gatedWriter) Close() error { return nil }
+
+// Headers of the packets written after the handshake, in order.
+func (g *gatedWriter) headers() []header {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var headers []header
+	r := bytes.NewReader(bytes.TrimPrefix(g.buf.Bytes(), []byte(handshakeMagic+"\x00\x03\x00\x00")))
+	for {
+		var hdr header
+		if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+			return headers
+		}
+		r.Seek(int64(hdr.Length), io.SeekCurrent)
+		headers = append(headers, hdr)
+	}
+}
+
+// IDs of the data packets written, in order.
+func (g *gatedWriter) dataPackets() []uint32 {
+	var ids []uint32
+	for _, hdr := range g.headers() {
+		if hdr.Type == typeData && hdr.Length > 0 {
+			ids = append(ids, hdr.ID)
+		}
+	}
+	return ids
+}
+
+func TestChannelPriority(t *testing.T) {
+	cr, _ := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	cm := MultiplexedClient(&rwc{r: cr, w: w}, WithAsyncDial())
+	defer cm.Close()
+
+	// The writer is stuck on the first SYN, so everything else queues up.
+	bulk, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = bulk.Write(make([]byte, initialWindow))
+	assert.NoError(t, err)
+	interactive, err := cm.Dial()
+	assert.NoError(t, err)
+	interactive.SetPriority(1)
+	assert.Equal(t, 1, interactive.Priority())
+	_, err = interactive.Write([]byte("PING"))
+	assert.NoError(t, err)
+
+	close(w.release)
+	packets := initialWindow/FragmentSize + 1
+	waitFor(t, func() bool { return len(w.dataPackets()) == packets })
+	ids := w.dataPackets()
+	assert.Equal(t, interactive.id, ids[0])
+	for _, id := range ids[1:] {
+		assert.Equal(t, bulk.id, id)
+	}
+}
+
+func TestChannelFairQueueing(t *testing.T) {
+	cr, _ := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	cm := MultiplexedClient(&rwc{r: cr, w: w}, WithAsyncDial())
+	defer cm.Close()
+
+	a, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = a.Write(make([]byte, FragmentSize*16))
+	assert.NoError(t, err)
+	b, err := cm.Dial()
+	assert.NoError(t, err)
+	b.SetWeight(2)
+	assert.Equal(t, 2, b.Weight())
+	_, err = b.Write(make([]byte, FragmentSize*16))
+	assert.NoError(t, err)
+
+	// Rather than a draining completely first, b gets two thirds of the
+	// transport until it runs out of data.
+	close(w.release)
+	waitFor(t, func() bool { return len(w.dataPackets()) == 32 })
+	ids := w.dataPackets()
+	counts := map[uint32]int{}
+	for _, id := range ids[:12] {
+		counts[id]++
+	}
+	assert.Equal(t, 4, counts[a.id])
+	assert.Equal(t, 8, counts[b.id])
+}
+
+// Round-trip time on one channel while others saturate the transport.
+func BenchmarkContendedLatency(b *testing.B) {
+	sm, cm := newServerAndClient(WithDefaultWindow(1024 * 1024))
+	defer sm.Close()
+	defer cm.Close()
+
+	const bulk = 4
+	for i := 0; i < bulk; i++ {
+		c, err := cm.Dial()
+		assert.NoError(b, err)
+		s, err := sm.Accept()
+		assert.NoError(b, err)
+		go io.Copy(ioutil.Discard, s)
+		go func() {
+			buf := make([]byte, 1024*1024)
+			for {
+				if _, err := c.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	c, err := cm.Dial()
+	assert.NoError(b, err)
+	s, err := sm.Accept()
+	assert.NoError(b, err)
+	go io.Copy(s, s)
+
+	buf := make([]byte, 4)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = c.Write(buf)
+		assert.NoError(b, err)
+		_, err = io.ReadFull(c, buf)
+		assert.NoError(b, err)
+	}
+}
+
+func TestLargeWriteInterleaved(t *testing.T) {
+	sm, cm := newServerAndClient(WithDefaultWindow(4 * 1024 * 1024))
+	defer sm.Close()
+	defer cm.Close()
+
+	a, err := cm.Dial()
+	assert.NoError(t, err)
+	sa, err := sm.Accept()
+	assert.NoError(t, err)
+	go io.Copy(sa, sa)
+	b, err := cm.Dial()
+	assert.NoError(t, err)
+	sb, err := sm.Accept()
+	assert.NoError(t, err)
+
+	const size = 32 * 1024 * 1024
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, sb)
+		received <- n
+	}()
+	written := make(chan error)
+	go func() {
+		_, err := b.Write(make([]byte, size))
+		if err == nil {
+			err = b.Close()
+		}
+		written <- err
+	}()
+
+	// Ping-pong on a while b's single write is in progress.
+	buf := make([]byte, 4)
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+		_, err = a.Write([]byte("PING"))
+		assert.NoError(t, err)
+		_, err = io.ReadFull(a, buf)
+		assert.NoError(t, err)
+		assert.True(t, time.Since(start) < time.Millisecond*250, "round trip took %s", time.Since(start))
+	}
+
+	assert.NoError(t, <-written)
+	assert.Equal(t, int64(size), <-received)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"fmt"
+)
+
+// Handle registers a handler for channels the peer opens for the named
+// service (see DialService), or for channels opened without naming a service
+// if name is "". Once Serve has been called, each such channel is passed to
+// handler in a goroutine of its own, and closed when handler returns.
+//
+// Handle panics if a handler is already registered for name.
+func (m *MultiplexedStream) Handle(name string, handler func(ch *Channel)) {
+	m.lock.Lock()
+	if _, ok := m.handlers[name]; ok {
+		m.lock.Unlock()
+		panic(fmt.Sprintf("multiplex: multiple handlers for service %q", name))
+	}
+	if m.handlers == nil {
+		m.handlers = make(map[string]func(*Channel))
+	}
+	m.handlers[name] = handler
+	queue := m.serviceQueue(name)
+	serving := m.serving
+	m.lock.Unlock()
+
+	if serving {
+		go m.serve(queue, handler)
+	}
+}
+
+// Serve passes channels opened by the peer to the handlers registered with
+// Handle, including those registered while it runs, until the stream is shut
+// down or closed. It then returns the error Accept would return.
+//
+// Channels for services without a handler are left for Accept and
+// AcceptService, or refused if WithRejectUnknownServices is used.
+func (m *MultiplexedStream) Serve() error {
+	m.lock.Lock()
+	m.serving = true
+	errs := make(chan error, len(m.handlers))
+	for name, handler := range m.handlers {
+		queue := m.serviceQueue(name)
+		go func(handler func(*Channel)) {
+			errs <- m.serve(queue, handler)
+		}(handler)
+	}
+	n := len(m.handlers)
+	m.lock.Unlock()
+
+	if n == 0 {
+		select {
+		case <-m.draining:
+			return ErrShutdown
+		case <-m.tomb.Dying():
+			return m.err()
+		}
+	}
+	err := <-errs
+	for i := 1; i < n; i++ {
+		<-errs
+	}
+	return err
+}
+
+// The accept queue for the named service, created if it isn't registered.
+// Must be called with lock held.
+func (m *MultiplexedStream) serviceQueue(name string) chan *Channel {
+	if name == "" {
+		return m.accept
+	}
+	queue, ok := m.services[name]
+	if !ok {
+		queue = make(chan *Channel, m.config.acceptBacklog)
+		m.services[name] = queue
+	}
+	return queue
+}
+
+// Pass channels accepted from queue to handler until accepting fails.
+func (m *MultiplexedStream) serve(queue chan *Channel, handler func(*Channel)) error {
+	for {
+		ch, err := m.acceptFrom(context.Background(), queue)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer ch.Close()
+			handler(ch)
+		}()
+	}
+}
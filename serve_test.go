@@ -0,0 +1,124 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Handler that echoes the service name and what it reads.
+func echoService(ch *Channel) {
+	ch.Write([]byte(ch.Service() + ":"))
+	io.Copy(ch, ch)
+}
+
+func TestServe(t *testing.T) {
+	sm, cm := newServerAndClient(WithRejectUnknownServices())
+	defer sm.Close()
+	defer cm.Close()
+
+	sm.Handle("rpc", echoService)
+	sm.Handle("", echoService)
+	served := make(chan error)
+	go func() { served <- sm.Serve() }()
+	// Handlers can be registered while serving.
+	sm.Handle("logs", echoService)
+
+	// Naming no service is the same as calling Dial.
+	for _, service := range []string{"rpc", "logs", ""} {
+		c, err := cm.DialService(service)
+		assert.NoError(t, err)
+		_, err = c.Write([]byte("hello"))
+		assert.NoError(t, err)
+		assert.NoError(t, c.CloseWrite())
+		b, err := io.ReadAll(c)
+		assert.NoError(t, err)
+		assert.Equal(t, service+":hello", string(b))
+	}
+
+	_, err := cm.DialService("metrics")
+	assert.Equal(t, ErrUnknownService, err)
+
+	// Channels are closed once their handler returns.
+	sm.Handle("quit", func(*Channel) {})
+	c, err := cm.DialService("quit")
+	assert.NoError(t, err)
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	assert.NoError(t, sm.Shutdown(context.Background()))
+	assert.Equal(t, ErrShutdown, <-served)
+}
+
+func TestServeWithoutHandlers(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+
+	served := make(chan error)
+	go func() { served <- sm.Serve() }()
+	sm.Close()
+	assert.Equal(t, ErrSessionClosed, <-served)
+}
+
+func TestHandleTwice(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	sm.Handle("rpc", echoService)
+	assert.Panics(t, func() { sm.Handle("rpc", echoService) })
+}
+
+func ExampleMultiplexedStream_Handle() {
+	ln, err := net.Listen("tcp", ":1234")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(conn net.Conn) {
+			mx := MultiplexedServer(conn)
+			mx.Handle("greeter", func(c *Channel) {
+				b := make([]byte, 5)
+				if _, err := io.ReadFull(c, b); err == nil {
+					fmt.Printf("Received: %s\n", b)
+				}
+			})
+			mx.Serve()
+		}(conn)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// MaxSessionIDSize is the largest session ID, in bytes (see WithSessionID).
+const MaxSessionIDSize = 128
+
+// The session ID is advertised with a settingSessionID whose value is the
+// length of the ID, with the top bit set if it was chosen by the application,
+// followed by settingSessionIDData for each 4 bytes of the ID. Older peers
+// ignore both.
+const sessionIDSupplied = 1 << 31
+
+// ID returns the identifier of the session, which both ends agree on, for
+// correlating their logs. It is chosen by WithSessionID at either end, or
+// randomly if neither uses it; if both do, the client's is used.
+//
+// Until the peer's settings arrive, and with older peers, this is the ID
+// proposed by this end.
+func (m *MultiplexedStream) ID() string {
+	return m.sessionID.Load().(string)
+}
+
+// A random session ID.
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// The settings advertising our session ID.
+func (m *MultiplexedStream) sessionIDSettings() []byte {
+	id := m.ID()
+	value := uint32(len(id))
+	if m.config.sessionID != "" {
+		value |= sessionIDSupplied
+	}
+	chunks := (len(id) + 3) / 4
+	b := make([]byte, settingSize*(1+chunks))
+	binary.BigEndian.PutUint16(b, settingSessionID)
+	binary.BigEndian.PutUint32(b[2:], value)
+	padded := make([]byte, chunks*4)
+	copy(padded, id)
+	for i := 0; i < chunks; i++ {
+		s := b[settingSize*(i+1):]
+		binary.BigEndian.PutUint16(s, settingSessionIDData)
+		copy(s[2:settingSize], padded[i*4:])
+	}
+	return b
+}
+
+// Agree on the session ID, given the peer's.
+func (m *MultiplexedStream) agreeSessionID(id string, supplied bool) {
+	ours := m.config.sessionID != ""
+	if supplied != ours {
+		if supplied {
+			m.sessionID.Store(id)
+		}
+		return
+	}
+	// Both or neither chose, so the client's wins.
+	if m.parity() == 0 {
+		m.sessionID.Store(id)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestSessionID(t *testing.T) {
+	long := strings.Repeat("x", MaxSessionIDSize+1)
+	tests := []struct {
+		name           string
+		server, client []Option
+		expected       string
+	}{
+		{"Generated", nil, nil, ""},
+		{"Client", nil, []Option{WithSessionID("client")}, "client"},
+		{"Server", []Option{WithSessionID("server")}, nil, "server"},
+		{"Both", []Option{WithSessionID("server")}, []Option{WithSessionID("client")}, "client"},
+		{"Odd", []Option{WithSessionID("12345")}, nil, "12345"},
+		{"Long", nil, []Option{WithSessionID(long)}, long[:MaxSessionIDSize]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cr, sw := io.Pipe()
+			sr, cw := io.Pipe()
+			sm := MultiplexedServer(&rwc{r: sr, w: sw}, test.server...)
+			cm := MultiplexedClient(&rwc{r: cr, w: cw}, test.client...)
+			defer sm.Close()
+			defer cm.Close()
+			_, err := cm.Dial()
+			assert.NoError(t, err)
+			_, err = sm.Accept()
+			assert.NoError(t, err)
+
+			assert.Equal(t, sm.ID(), cm.ID())
+			if test.expected == "" {
+				assert.Equal(t, 32, len(cm.ID()))
+			} else {
+				assert.Equal(t, test.expected, cm.ID())
+			}
+		})
+	}
+}
+
+// Peers that don't send a session ID leave ours as it was.
+func TestSessionIDOldPeer(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithSessionID("server"))
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	assert.NoError(t, writeFrame(cw, typeSettings, 0, 0, settingsPayload(FragmentSize)))
+	assert.NoError(t, sm.awaitSettings(context.Background()))
+	assert.Equal(t, "server", sm.ID())
+}
+
+func TestSessionIDTruncated(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	payload := make([]byte, settingSize*2)
+	binary.BigEndian.PutUint16(payload, settingSessionID)
+	binary.BigEndian.PutUint32(payload[2:], 5)
+	binary.BigEndian.PutUint16(payload[settingSize:], settingSessionIDData)
+	assert.NoError(t, sendHandshake(cw))
+	go writeFrame(cw, typeSettings, 0, 0, payload)
+	waitFor(t, func() bool { return sm.Err() != nil })
+	assert.True(t, errors.Is(sm.Err(), ErrProtocol))
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// Settings advertised to the peer when the stream starts.
+const (
+	settingMaxFrameSize = iota + 1
+	// Parity of the IDs of channels the sender opens: 0 for servers and 1 for
+	// clients.
+	settingChannelIDParity
+	// The Features the sender supports.
+	settingFeatures
+	// Largest metadata the sender accepts with a SYN.
+	settingMaxMetadata
+	// The length of the sender's session ID, and 4 bytes of it (see
+	// sessionIDSupplied).
+	settingSessionID
+	settingSessionIDData
+)
+
+// Size of each setting in a settings packet: a 2 byte ID and 4 byte value.
+const settingSize = 6
+
+// MaxFrameSize returns the largest packet payload that is sent to the peer:
+// the smaller of the size configured with WithMaxFrameSize and the size the
+// peer advertised. Until the peer's settings arrive this is FragmentSize,
+// which every peer accepts.
+func (m *MultiplexedStream) MaxFrameSize() uint32 {
+	if size := atomic.LoadUint32(&m.frameSize); size != 0 {
+		return size
+	}
+	return FragmentSize
+}
+
+// Tell the peer what we are willing to receive. Queued before the writer
+// starts, so it is the first packet sent.
+func (m *MultiplexedStream) sendSettings() {
+	var maxMetadata uint32
+	if m.config.features.Has(FeatureMetadata) {
+		maxMetadata = MaxMetadataSize
+	}
+	payload := make([]byte, settingSize*4)
+	binary.BigEndian.PutUint16(payload, settingMaxFrameSize)
+	binary.BigEndian.PutUint32(payload[2:], m.config.maxRecvSize)
+	binary.BigEndian.PutUint16(payload[settingSize:], settingChannelIDParity)
+	binary.BigEndian.PutUint32(payload[settingSize+2:], m.parity())
+	binary.BigEndian.PutUint16(payload[settingSize*2:], settingFeatures)
+	binary.BigEndian.PutUint32(payload[settingSize*2+2:], uint32(m.config.features))
+	binary.BigEndian.PutUint16(payload[settingSize*3:], settingMaxMetadata)
+	binary.BigEndian.PutUint32(payload[settingSize*3+2:], maxMetadata)
+	payload = append(payload, m.sessionIDSettings()...)
+	p := &packet{typ: typeSettings, payload: payload}
+	m.hook(Outbound, p)
+	m.control <- p
+}
+
+func (m *MultiplexedStream) handleSettings(p *packet) error {
+	if len(p.payload)%settingSize != 0 {
+		return fmt.Errorf("%w: settings of %d bytes", ErrProtocol, len(p.payload))
+	}
+	var (
+		sessionID       []byte
+		sessionIDSize   = -1
+		sessionSupplied bool
+	)
+	for b := p.payload; len(b) > 0; b = b[settingSize:] {
+		value := binary.BigEndian.Uint32(b[2:])
+		switch binary.BigEndian.Uint16(b) {
+		case settingMaxFrameSize:
+			if value < FragmentSize {
+				return fmt.Errorf("%w: peer advertised a max frame size of %d bytes", ErrProtocol, value)
+			}
+			if value > m.config.maxFrameSize {
+				value = m.config.maxFrameSize
+			}
+			atomic.StoreUint32(&m.frameSize, value)
+
+		case settingChannelIDParity:
+			if value > 1 || value == m.parity() {
+				return fmt.Errorf("%w: peer opens channels with the same IDs as us, both ends are clients or servers", ErrProtocol)
+			}
+			atomic.StoreUint32(&m.peerParity, value+1)
+
+		case settingFeatures:
+			// Features newer than us are ignored.
+			atomic.StoreUint32(&m.peerFeatures, value&uint32(allFeatures))
+
+		case settingMaxMetadata:
+			atomic.StoreUint32(&m.peerMaxMetadata, value)
+
+		case settingSessionID:
+			sessionIDSize = int(value &^ sessionIDSupplied)
+			sessionSupplied = value&sessionIDSupplied != 0
+			if sessionIDSize > MaxSessionIDSize {
+				return fmt.Errorf("%w: session ID of %d bytes", ErrProtocol, sessionIDSize)
+			}
+
+		case settingSessionIDData:
+			sessionID = append(sessionID, b[2:settingSize]...)
+		}
+		// Unknown settings are ignored, so that they can be added without
+		// breaking older peers.
+	}
+	if sessionIDSize >= 0 {
+		if len(sessionID) < sessionIDSize {
+			return fmt.Errorf("%w: session ID of %d bytes, of which %d were sent", ErrProtocol, sessionIDSize, len(sessionID))
+		}
+		m.agreeSessionID(string(sessionID[:sessionIDSize]), sessionSupplied)
+	}
+	m.settle.Do(func() {
+		m.log(levelInfo, "session started", "role", m.role())
+		close(m.settled)
+	})
+	return nil
+}
+
+// Wait for the peer's settings to arrive. They are the first packet the peer
+// sends, so this takes at most one trip across the connection. Once they have
+// arrived this succeeds even if the stream has since died, so that data
+// received before it did can still be read.
+func (m *MultiplexedStream) awaitSettings(ctx context.Context) error {
+	if isClosed(m.settled) {
+		return nil
+	}
+	select {
+	case <-m.settled:
+		return nil
+	case <-m.deadline.wait():
+		return errTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.tomb.Dying():
+		return m.err()
+	}
+}
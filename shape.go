@@ -0,0 +1,87 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/tomb.v1"
+)
+
+// A Limiter limits the rate at which data is written to the transport (see
+// WithBandwidthLimiter). It is satisfied by *rate.Limiter from
+// golang.org/x/time/rate, whose burst must then be at least the size of a
+// packet: the maximum frame size plus a 10 byte header.
+type Limiter interface {
+	// WaitN blocks until n bytes may be written, or ctx is done.
+	WaitN(ctx context.Context, n int) error
+}
+
+// Wait until the bandwidth limiter allows packet p to be written. The wait is
+// abandoned to write any control packet or reply that is queued meanwhile, so
+// that pings and window updates aren't held up behind data.
+func (m *MultiplexedStream) shape(p *packet) error {
+	limiter := m.config.limiter
+	if limiter == nil {
+		return nil
+	}
+	n := headerSize + len(p.payload)
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		waited := make(chan error, 1)
+		go func() { waited <- limiter.WaitN(ctx, n) }()
+
+		var err error
+		select {
+		case err = <-waited:
+			cancel()
+			if err != nil {
+				// Not the transport's fault, so the stream fails with
+				// this rather than a TransportError.
+				err = fmt.Errorf("bandwidth limiter: %w", err)
+				m.tomb.Kill(err)
+			}
+			return err
+		case c := <-m.control:
+			cancel()
+			err = m.write(c)
+		case <-m.replied:
+			cancel()
+			err = m.writeReplies()
+		case <-m.tomb.Dying():
+			cancel()
+			<-waited
+			return tomb.ErrDying
+		}
+		// The limiter may have allowed the packet before noticing the
+		// cancellation.
+		if werr := <-waited; err != nil || werr == nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Allows bytes as the test hands them out, and records how many were waited
+// for.
+type budgetLimiter struct {
+	lock   sync.Mutex
+	budget int
+	waited int
+	more   chan struct{}
+}
+
+func newBudgetLimiter(budget int) *budgetLimiter {
+	return &budgetLimiter{budget: budget, more: make(chan struct{}, 1)}
+}
+
+func (b *budgetLimiter) WaitN(ctx context.Context, n int) error {
+	for {
+		b.lock.Lock()
+		if b.budget >= n {
+			b.budget -= n
+			b.waited += n
+			b.lock.Unlock()
+			return nil
+		}
+		b.lock.Unlock()
+		select {
+		case <-b.more:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *budgetLimiter) allow(n int) {
+	b.lock.Lock()
+	b.budget += n
+	b.lock.Unlock()
+	signal(b.more)
+}
+
+func (b *budgetLimiter) Waited() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.waited
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := newBudgetLimiter(headerSize)
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithBandwidthLimiter(limiter))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// While data is held back, pings and data in the other direction still
+	// flow.
+	data := make([]byte, FragmentSize*4)
+	go c.Write(data)
+	for i := 0; i < 3; i++ {
+		_, err = cm.Ping(context.Background())
+		assert.NoError(t, err)
+	}
+	go s.Write([]byte("hello"))
+	_, err = io.ReadFull(c, make([]byte, 5))
+	assert.NoError(t, err)
+	assert.NoError(t, s.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = s.Read(data)
+	assert.True(t, errors.Is(err, errTimeout), "%v", err)
+
+	// Each packet is waited for once, header included.
+	limiter.allow(len(data) + 4*headerSize)
+	assert.NoError(t, s.SetReadDeadline(time.Time{}))
+	_, err = io.ReadFull(s, data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data)+5*headerSize, limiter.Waited())
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) WaitN(ctx context.Context, n int) error {
+	return errors.New("exceeds burst")
+}
+
+func TestBandwidthLimiterError(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	cm := MultiplexedClient(&rwc{r: cr, w: cw}, WithBandwidthLimiter(failingLimiter{}), WithAsyncDial())
+	defer sm.Close()
+	defer cm.Close()
+
+	_, err := cm.Dial()
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return cm.Err() != nil })
+	assert.Equal(t, "bandwidth limiter: exceeds burst", cm.Err().Error())
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Longest interval between checks for open channels during Shutdown.
+const shutdownPollIntervalMax = time.Millisecond * 500
+
+// Shutdown gracefully closes the stream.
+//
+// Shutdown stops accepting new channels: the peer is sent a GoAway, pending
+// and future calls to Accept and Dial return ErrShutdown, channels opened by
+// the peer are refused, and channels queued for Accept are closed. It then
+// waits for all open channels to be closed before closing the stream.
+//
+// If ctx is done before all channels are closed, the stream is closed
+// immediately and ctx.Err() is returned.
+func (m *MultiplexedStream) Shutdown(ctx context.Context) error {
+	m.drain.Do(func() { close(m.draining) })
+	m.GoAway()
+
+	interval := time.Millisecond
+	for {
+		m.closeAcceptQueue()
+		if m.channels.len() == 0 {
+			m.Close()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			m.Close()
+			return ctx.Err()
+		case <-m.tomb.Dying():
+			return nil
+		case <-m.config.clock.After(interval):
+			if interval *= 2; interval > shutdownPollIntervalMax {
+				interval = shutdownPollIntervalMax
+			}
+		}
+	}
+}
+
+// Wait blocks until the stream has terminated, whether it was closed or
+// failed, and returns the error that terminated it (see Err).
+//
+// Unlike Close, Wait doesn't return until the stream is entirely finished: its
+// goroutines have exited, including the one writing to any Tap, the transport
+// has been closed, and every channel has been closed.
+func (m *MultiplexedStream) Wait() error {
+	m.tomb.Wait()
+	m.workers.Wait()
+	m.tapLock.Lock()
+	t := m.tap
+	m.tapLock.Unlock()
+	if t != nil {
+		<-t.done
+	}
+	return m.err()
+}
+
+// Close channels that have been opened by the peer but not yet accepted.
+func (m *MultiplexedStream) closeAcceptQueue() {
+	closeQueue(m.accept)
+	m.lock.Lock()
+	queues := make([]chan *Channel, 0, len(m.services))
+	for _, queue := range m.services {
+		queues = append(queues, queue)
+	}
+	m.lock.Unlock()
+	for _, queue := range queues {
+		closeQueue(queue)
+	}
+}
+
+func closeQueue(queue chan *Channel) {
+	for {
+		select {
+		case ch := <-queue:
+			ch.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Reasons for refusing a channel, sent as the payload of an RST with the
+// REFUSE flag.
+const (
+	refuseGoingAway = iota + 1
+	refuseTooManyChannels
+	refuseBusy
+	// Followed by the 4 byte code and message of a *RejectedError.
+	refuseRejected
+	refuseUnknownService
+	refuseRateLimited
+	// By the frame hook (see WithFrameHook).
+	refuseVetoed
+)
+
+// Tell the peer that a channel it opened has been closed, without creating
+// it.
+func (m *MultiplexedStream) refuse(id uint32, reason uint32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, reason)
+	atomic.AddUint64(&m.stats.refused, 1)
+	m.log(levelInfo, "channel refused", "channel_id", id, "error", refusalError(payload))
+	m.reply(&packet{id: id, flags: RST | REFUSE, payload: payload})
+}
+
+// The error a channel refused by the peer fails with.
+func refusalError(payload []byte) error {
+	if len(payload) >= 4 {
+		switch binary.BigEndian.Uint32(payload) {
+		case refuseGoingAway:
+			return ErrGoAway
+		case refuseTooManyChannels:
+			return ErrTooManyChannels
+		case refuseBusy:
+			return ErrBusy
+		case refuseUnknownService:
+			return ErrUnknownService
+		case refuseRateLimited:
+			return ErrRateLimited
+		case refuseRejected:
+			if len(payload) >= 8 {
+				return &RejectedError{
+					code:    binary.BigEndian.Uint32(payload[4:]),
+					message: string(payload[8:]),
+				}
+			}
+		}
+	}
+	return ErrChannelRefused
+}
+
+// Whether a channel failed with err because the peer refused it.
+func isRefusal(err error) bool {
+	if _, ok := err.(*RejectedError); ok {
+		return true
+	}
+	switch err {
+	case ErrGoAway, ErrTooManyChannels, ErrBusy, ErrRateLimited, ErrUnknownService, ErrChannelRefused:
+		return true
+	}
+	return false
+}
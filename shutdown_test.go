@@ -0,0 +1,322 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/multiplex/multiplextest"
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+
+	const channels = 3
+	var clients []*Channel
+	for i := 0; i < channels; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		clients = append(clients, c)
+	}
+
+	// Handlers that are still working when Shutdown is called.
+	release := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < channels; i++ {
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-release
+			s.Write([]byte("DONE"))
+			s.Close()
+		}()
+	}
+
+	shutdown := make(chan error)
+	go func() { shutdown <- sm.Shutdown(context.Background()) }()
+
+	// New channels are refused in both directions.
+	waitFor(t, func() bool { return isClosed(sm.draining) })
+	_, err := sm.Accept()
+	assert.Equal(t, ErrShutdown, err)
+	_, err = sm.Dial()
+	assert.Equal(t, ErrShutdown, err)
+	waitFor(t, cm.GoingAway)
+	_, err = cm.Dial()
+	assert.Equal(t, ErrGoAway, err)
+
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned with channels still open")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// In-flight channels complete their work.
+	close(release)
+	for _, c := range clients {
+		b, err := ioutil.ReadAll(c)
+		assert.NoError(t, err)
+		assert.Equal(t, "DONE", string(b))
+	}
+	assert.NoError(t, <-shutdown)
+	wg.Wait()
+}
+
+func TestShutdownContextExpired(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	_, err = sm.Accept()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err = sm.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The stream was closed forcibly.
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+// The number of goroutines running methods of m.
+func goroutinesOf(m *MultiplexedStream) int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	receiver := "(*MultiplexedStream)."
+	pointer := fmt.Sprintf("(%p", m)
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		for _, line := range strings.Split(g, "\n") {
+			if strings.Contains(line, receiver) && (strings.Contains(line, pointer+")") || strings.Contains(line, pointer+",")) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+func TestWait(t *testing.T) {
+	sm, cm := newServerAndClient(WithIdleTimeout(time.Hour))
+	defer cm.Close()
+	stop := sm.Tap(ioutil.Discard)
+	defer stop()
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.NotEqual(t, 0, goroutinesOf(sm))
+
+	waited := make(chan error, 1)
+	go func() { waited <- sm.Wait() }()
+	select {
+	case err := <-waited:
+		t.Fatalf("Wait returned %v before the stream terminated", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.NoError(t, sm.Close())
+	assert.True(t, errors.Is(<-waited, ErrSessionClosed))
+	assert.Equal(t, 0, goroutinesOf(sm))
+	assert.Equal(t, 0, sm.NumChannels())
+	_, err = s.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrSessionClosed), "%v", err)
+
+	// The peer sees the transport closed.
+	assert.True(t, errors.Is(cm.Wait(), ErrSessionClosed))
+	assert.Equal(t, 0, goroutinesOf(cm))
+	_, err = c.Write([]byte("hello"))
+	assert.Error(t, err)
+}
+
+func TestWaitTransportFailed(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+	conn := multiplextest.Wrap(&rwc{r: cr, w: cw}, multiplextest.Faults{})
+	cm := MultiplexedClient(conn)
+	_, err := cm.Dial()
+	assert.NoError(t, err)
+
+	conn.Fail()
+	err = cm.Wait()
+	var terr *TransportError
+	assert.True(t, errors.As(err, &terr), "%v", err)
+	assert.True(t, errors.Is(err, multiplextest.ErrInjected), "%v", err)
+	assert.Equal(t, err, cm.Close())
+	assert.Equal(t, 0, goroutinesOf(cm))
+}
+
+// Check that the streams terminate, leaving no goroutines behind.
+func assertNoLeaks(t *testing.T, streams ...*MultiplexedStream) {
+	for _, m := range streams {
+		waited := make(chan struct{})
+		go func() {
+			m.Wait()
+			close(waited)
+		}()
+		select {
+		case <-waited:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream didn't terminate")
+		}
+		assert.Equal(t, 0, goroutinesOf(m))
+	}
+}
+
+// Wait for a blocked call to return, with its error.
+func awaitReturn(t *testing.T, returned chan error) error {
+	select {
+	case err := <-returned:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("call still blocked after close")
+		return nil
+	}
+}
+
+// Ways to end a stream: closing the server or the client, or closing the
+// server's transport beneath it.
+var closers = []struct {
+	name  string
+	close func(sm, cm *MultiplexedStream, sconn io.Closer)
+}{
+	{"server", func(sm, cm *MultiplexedStream, sconn io.Closer) { sm.Close() }},
+	{"client", func(sm, cm *MultiplexedStream, sconn io.Closer) { cm.Close() }},
+	{"transport", func(sm, cm *MultiplexedStream, sconn io.Closer) { sconn.Close() }},
+}
+
+func TestNoLeaksClosingDuringDial(t *testing.T) {
+	for _, closer := range closers {
+		t.Run(closer.name, func(t *testing.T) {
+			// The server holds the SYN, so that Dial is in progress.
+			opening := make(chan struct{})
+			release := make(chan struct{})
+			hold := withFault(faultAccept, func() error {
+				close(opening)
+				<-release
+				return nil
+			})
+			sm, cm, sconn := newFaultyServerAndClient([]Option{hold}, nil)
+			dialled := make(chan error, 1)
+			go func() {
+				_, err := cm.Dial()
+				dialled <- err
+			}()
+			<-opening
+			closer.close(sm, cm, sconn)
+			close(release)
+			assert.Error(t, awaitReturn(t, dialled))
+			assertNoLeaks(t, sm, cm)
+		})
+	}
+}
+
+func TestNoLeaksClosingDuringAccept(t *testing.T) {
+	for _, closer := range closers {
+		t.Run(closer.name, func(t *testing.T) {
+			sm, cm, sconn := newFaultyServerAndClient(nil, nil)
+			accepted := make(chan error, 1)
+			go func() {
+				_, err := sm.Accept()
+				accepted <- err
+			}()
+			closer.close(sm, cm, sconn)
+			assert.Error(t, awaitReturn(t, accepted))
+			assertNoLeaks(t, sm, cm)
+		})
+	}
+}
+
+func TestNoLeaksClosingWithUnreadData(t *testing.T) {
+	for _, closer := range closers {
+		t.Run(closer.name, func(t *testing.T) {
+			sm, cm, sconn := newFaultyServerAndClient(nil, nil)
+			c, err := cm.Dial()
+			assert.NoError(t, err)
+			s, err := sm.Accept()
+			assert.NoError(t, err)
+			_, err = c.Write([]byte("hello"))
+			assert.NoError(t, err)
+			waitFor(t, func() bool { return atomic.LoadInt64(&sm.buffered) == 5 })
+
+			closer.close(sm, cm, sconn)
+			assertNoLeaks(t, sm, cm)
+			_, err = ioutil.ReadAll(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNoLeaksClosingDuringWrite(t *testing.T) {
+	for _, closer := range closers {
+		t.Run(closer.name, func(t *testing.T) {
+			sm, cm, sconn := newFaultyServerAndClient(nil, nil)
+			c, err := cm.Dial()
+			assert.NoError(t, err)
+			_, err = sm.Accept()
+			assert.NoError(t, err)
+
+			// Nothing is read, so the write blocks once the window is
+			// used up.
+			written := make(chan error, 1)
+			go func() {
+				_, err := c.Write(make([]byte, 2*initialWindow))
+				written <- err
+			}()
+			waitFor(t, func() bool { return c.SendWindow() == 0 })
+			closer.close(sm, cm, sconn)
+			assert.Error(t, awaitReturn(t, written))
+			assertNoLeaks(t, sm, cm)
+		})
+	}
+}
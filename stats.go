@@ -0,0 +1,259 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// StreamStats are counters of a stream's activity since it was created (see
+// MultiplexedStream.Stats). They only ever increase.
+type StreamStats struct {
+	ChannelsOpened   uint64 // Opened with Dial, whether or not the peer accepted them.
+	ChannelsAccepted uint64 // Opened by the peer and returned by Accept.
+	ChannelsRefused  uint64 // Opened by the peer and refused, before reaching Accept.
+	ChannelsClosed   uint64 // Opened or accepted, and since closed by either end.
+
+	BytesSent     uint64 // Data written to channels and sent, before compression.
+	BytesReceived uint64 // Data received on channels, after decompression.
+
+	PacketsSent     PacketCounts
+	PacketsReceived PacketCounts
+	ResetsSent      uint64 // Data packets with RST, including refusals.
+	ResetsReceived  uint64
+
+	UnknownPackets uint64 // See UnknownPackets.
+	StrayPackets   uint64 // See StrayPackets.
+	CorruptPackets uint64 // See CorruptPackets.
+	ProtocolErrors uint64 // Whether the stream failed with ErrProtocol.
+}
+
+// PacketCounts counts packets by type.
+type PacketCounts struct {
+	Data         uint64
+	WindowUpdate uint64
+	Ping         uint64
+	GoAway       uint64
+	Settings     uint64
+	Other        uint64 // Extensions and packets of unknown types.
+}
+
+// Indexes of packet counts, one per type and a last for any other.
+const numCountedTypes = typeSettings + 2
+
+func countedType(typ uint8) int {
+	if typ <= typeSettings {
+		return int(typ)
+	}
+	return numCountedTypes - 1
+}
+
+// Counters behind StreamStats, all atomic.
+type streamCounters struct {
+	opened, accepted, refused, closed uint64
+	bytesSent, bytesReceived          uint64
+	sent, received                    [numCountedTypes]uint64
+	resetsSent, resetsReceived        uint64
+	protocolErrors                    uint64
+}
+
+func packetCounts(c *[numCountedTypes]uint64) PacketCounts {
+	return PacketCounts{
+		Data:         atomic.LoadUint64(&c[typeData]),
+		WindowUpdate: atomic.LoadUint64(&c[typeWindowUpdate]),
+		Ping:         atomic.LoadUint64(&c[typePing]),
+		GoAway:       atomic.LoadUint64(&c[typeGoAway]),
+		Settings:     atomic.LoadUint64(&c[typeSettings]),
+		Other:        atomic.LoadUint64(&c[numCountedTypes-1]),
+	}
+}
+
+// Stats returns counters of the stream's activity so far. Each counter is read
+// atomically, but not all at the same instant, so while the stream is busy
+// they may not be exactly consistent with each other.
+func (m *MultiplexedStream) Stats() StreamStats {
+	s := &m.stats
+	return StreamStats{
+		ChannelsOpened:   atomic.LoadUint64(&s.opened),
+		ChannelsAccepted: atomic.LoadUint64(&s.accepted),
+		ChannelsRefused:  atomic.LoadUint64(&s.refused),
+		ChannelsClosed:   atomic.LoadUint64(&s.closed),
+		BytesSent:        atomic.LoadUint64(&s.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&s.bytesReceived),
+		PacketsSent:      packetCounts(&s.sent),
+		PacketsReceived:  packetCounts(&s.received),
+		ResetsSent:       atomic.LoadUint64(&s.resetsSent),
+		ResetsReceived:   atomic.LoadUint64(&s.resetsReceived),
+		UnknownPackets:   m.UnknownPackets(),
+		StrayPackets:     m.StrayPackets(),
+		CorruptPackets:   m.CorruptPackets(),
+		ProtocolErrors:   atomic.LoadUint64(&s.protocolErrors),
+	}
+}
+
+// Count a packet written to the transport.
+func (m *MultiplexedStream) countSent(p *packet) {
+	s := &m.stats
+	atomic.AddUint64(&s.sent[countedType(p.typ)], 1)
+	if p.typ != typeData {
+		return
+	}
+	switch {
+	case p.flags&RST != 0:
+		atomic.AddUint64(&s.resetsSent, 1)
+	case p.flags&SYN == 0:
+		atomic.AddUint64(&s.bytesSent, uint64(len(p.payload)))
+		if p.ch != nil {
+			p.ch.stats.sent(len(p.payload))
+		}
+	}
+}
+
+// Count a packet received from the peer.
+func (m *MultiplexedStream) countReceived(p *packet) {
+	s := &m.stats
+	atomic.AddUint64(&s.received[countedType(p.typ)], 1)
+	if p.typ == typeData && p.flags&RST != 0 {
+		atomic.AddUint64(&s.resetsReceived, 1)
+	}
+}
+
+// ChannelStats are counters of a channel's activity (see Channel.Stats).
+type ChannelStats struct {
+	Created time.Time // When the channel was dialled or received from the peer.
+	Closed  time.Time // When the channel was closed, or zero while it is open.
+	Err     error     // Why the channel was closed, or nil while it is open.
+
+	BytesSent       uint64 // Data written and sent, before compression.
+	BytesReceived   uint64 // Data received, after decompression, whether or not it has been read.
+	PacketsSent     uint64 // Data packets sent.
+	PacketsReceived uint64 // Data packets received.
+}
+
+// Counters behind ChannelStats, all atomic.
+type channelCounters struct {
+	bytesSent, bytesReceived     uint64
+	packetsSent, packetsReceived uint64
+}
+
+func (s *channelCounters) sent(n int) {
+	atomic.AddUint64(&s.packetsSent, 1)
+	atomic.AddUint64(&s.bytesSent, uint64(n))
+}
+
+func (s *channelCounters) received(n int) {
+	atomic.AddUint64(&s.packetsReceived, 1)
+	atomic.AddUint64(&s.bytesReceived, uint64(n))
+}
+
+// Stats returns counters of the channel's activity so far. They remain
+// readable after the channel is closed, until the Channel is dropped.
+func (c *Channel) Stats() ChannelStats {
+	s := &c.stats
+	stats := ChannelStats{
+		Created:         c.created,
+		BytesSent:       atomic.LoadUint64(&s.bytesSent),
+		BytesReceived:   atomic.LoadUint64(&s.bytesReceived),
+		PacketsSent:     atomic.LoadUint64(&s.packetsSent),
+		PacketsReceived: atomic.LoadUint64(&s.packetsReceived),
+	}
+	if closed := atomic.LoadInt64(&c.closed); closed != 0 {
+		stats.Closed = time.Unix(0, closed)
+		stats.Err = c.tomb.Err()
+	}
+	return stats
+}
+
+// String describes the channel for logs, such as "channel 42 (dialled, open,
+// rx=1.2MB tx=300KB)". It may be called concurrently with IO on the channel.
+func (c *Channel) String() string {
+	var buf [64]byte
+	b := append(buf[:0], "channel "...)
+	b = strconv.AppendUint(b, uint64(c.id), 10)
+	b = append(b, " ("...)
+	b = append(b, c.origin()...)
+	b = append(b, ", "...)
+	b = append(b, c.state()...)
+	b = append(b, ", rx="...)
+	b = appendSize(b, atomic.LoadUint64(&c.stats.bytesReceived))
+	b = append(b, " tx="...)
+	b = appendSize(b, atomic.LoadUint64(&c.stats.bytesSent))
+	b = append(b, ')')
+	return string(b)
+}
+
+// GoString describes the channel for %#v, with exact byte counts.
+func (c *Channel) GoString() string {
+	return fmt.Sprintf("&multiplex.Channel{ID: %d, Origin: %q, State: %q, Service: %q, BytesReceived: %d, BytesSent: %d}",
+		c.id, c.origin(), c.state(), c.service,
+		atomic.LoadUint64(&c.stats.bytesReceived), atomic.LoadUint64(&c.stats.bytesSent))
+}
+
+// Whether the channel was opened by this end or the peer.
+func (c *Channel) origin() string {
+	if c.id%2 == c.m.parity() {
+		return "dialled"
+	}
+	return "accepted"
+}
+
+func (c *Channel) state() string {
+	if atomic.LoadInt64(&c.closed) != 0 {
+		return "closed"
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case c.opened != nil:
+		return "opening"
+	case c.readClosed || c.writeClosed || c.peerWriteClosed:
+		return "half-closed"
+	}
+	return "open"
+}
+
+// Append n bytes to b as a size such as 300KB or 1.2MB.
+func appendSize(b []byte, n uint64) []byte {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return append(strconv.AppendUint(b, n, 10), 'B')
+	}
+	size, unit := float64(n)/1024, 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	precision := 0
+	if size < 10 {
+		precision = 1
+	}
+	b = strconv.AppendFloat(b, size, 'f', precision, 64)
+	return append(b, units[unit], 'B')
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	sm, cm := newServerAndClient(WithRejectUnknownServices())
+	defer sm.Close()
+	defer cm.Close()
+
+	data := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		c, err := cm.Dial()
+		assert.NoError(t, err)
+		_, err = c.Write(data)
+		assert.NoError(t, err)
+		s, err := sm.Accept()
+		assert.NoError(t, err)
+		_, err = io.ReadFull(s, data)
+		assert.NoError(t, err)
+		assert.NoError(t, c.Close())
+	}
+	_, err := cm.DialService("unknown")
+	assert.Equal(t, ErrUnknownService, err)
+	_, err = cm.Ping(context.Background())
+	assert.NoError(t, err)
+	// Packets are counted once written, which may be after the peer has
+	// read them.
+	waitFor(t, func() bool {
+		return sm.Stats().ChannelsClosed == 3 && sm.Stats().PacketsSent.Ping == 1 && cm.Stats().PacketsSent.Ping == 1
+	})
+
+	assert.Equal(t, StreamStats{
+		ChannelsOpened: 4,
+		ChannelsClosed: 4,
+		BytesSent:      3000,
+		PacketsSent:    PacketCounts{Data: 10, Ping: 1, Settings: 1},
+		ResetsSent:     3,
+		// Acknowledgements and the refusal.
+		PacketsReceived: PacketCounts{Data: 4, Ping: 1, Settings: 1},
+		ResetsReceived:  1,
+	}, cm.Stats())
+	assert.Equal(t, StreamStats{
+		ChannelsAccepted: 3,
+		ChannelsRefused:  1,
+		ChannelsClosed:   3,
+		BytesReceived:    3000,
+		PacketsSent:      PacketCounts{Data: 4, Ping: 1, Settings: 1},
+		ResetsSent:       1,
+		PacketsReceived:  PacketCounts{Data: 10, Ping: 1, Settings: 1},
+		ResetsReceived:   3,
+	}, sm.Stats())
+}
+
+func TestStatsProtocolError(t *testing.T) {
+	sr, cw := io.Pipe()
+	_, sw := io.Pipe()
+	sm := MultiplexedServer(&rwc{r: sr, w: sw})
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	go writeFrame(cw, typePing, 0, 0, nil)
+	waitFor(t, func() bool { return sm.Err() != nil })
+	stats := sm.Stats()
+	assert.Equal(t, uint64(1), stats.ProtocolErrors)
+	assert.Equal(t, uint64(1), stats.PacketsReceived.Ping)
+}
+
+func TestChannelStats(t *testing.T) {
+	clock := newFakeClock()
+	sm, cm := newServerAndClient(WithClock(clock))
+	defer sm.Close()
+	defer cm.Close()
+
+	created := clock.Now()
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	data := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		_, err = c.Write(data)
+		assert.NoError(t, err)
+	}
+	_, err = io.ReadFull(s, make([]byte, 3000))
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return c.Stats().PacketsSent == 3 })
+	assert.Equal(t, ChannelStats{Created: created, BytesSent: 3000, PacketsSent: 3}, c.Stats())
+	assert.Equal(t, ChannelStats{Created: created, BytesReceived: 3000, PacketsReceived: 3}, s.Stats())
+
+	clock.Advance(time.Second)
+	assert.NoError(t, c.Close())
+	<-s.tomb.Dead()
+	stats := c.Stats()
+	assert.Equal(t, created.Add(time.Second), stats.Closed)
+	assert.Equal(t, ErrChannelClosed, stats.Err)
+	assert.Equal(t, uint64(3000), stats.BytesSent)
+	stats = s.Stats()
+	assert.Equal(t, created.Add(time.Second), stats.Closed)
+	assert.Equal(t, io.EOF, stats.Err)
+	assert.Equal(t, uint64(3000), stats.BytesReceived)
+}
+
+func TestChannelString(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("channel %d (dialled, open, rx=0B tx=0B)", c.ID()), fmt.Sprintf("%v", c))
+	assert.Equal(t, fmt.Sprintf("channel %d (accepted, open, rx=0B tx=0B)", s.ID()), s.String())
+
+	// Safe to call while the channel is in use.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = c.String()
+		}
+	}()
+	_, err = c.Write(make([]byte, 3000))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 3000))
+	assert.NoError(t, err)
+	<-done
+	waitFor(t, func() bool { return c.Stats().BytesSent == 3000 })
+	assert.Equal(t, fmt.Sprintf("channel %d (dialled, open, rx=0B tx=2.9KB)", c.ID()), c.String())
+
+	assert.NoError(t, c.CloseWrite())
+	assert.Equal(t, fmt.Sprintf("channel %d (dialled, half-closed, rx=0B tx=2.9KB)", c.ID()), c.String())
+	assert.NoError(t, c.Close())
+	assert.Equal(t, fmt.Sprintf("channel %d (dialled, closed, rx=0B tx=2.9KB)", c.ID()), c.String())
+	assert.Equal(t, fmt.Sprintf(`&multiplex.Channel{ID: %d, Origin: "dialled", State: "closed", Service: "", BytesReceived: 0, BytesSent: 3000}`, c.ID()), fmt.Sprintf("%#v", c))
+}
+
+func TestAppendSize(t *testing.T) {
+	for n, expected := range map[uint64]string{
+		0:              "0B",
+		1023:           "1023B",
+		1024:           "1.0KB",
+		300 * 1024:     "300KB",
+		1258291:        "1.2MB",
+		5 << 30:        "5.0GB",
+		math.MaxUint64: "16EB",
+	} {
+		assert.Equal(t, expected, string(appendSize(nil, n)))
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Most stray packets answered with an RST each second, so that a peer sending
+// packets for made up channels can't make us send as many.
+const maxStrayResets = 100
+
+// A data packet arrived for a channel that isn't open: one closed locally
+// whose peer hadn't yet heard, or one that was never opened. Tell the peer to
+// stop sending on it, unless it is itself an RST.
+//
+// The RST is queued behind anything the channel sent before it closed, such
+// as its own RST carrying the reason, rather than sent ahead as a reply. If
+// the queue is full it is dropped, as the reader must not block.
+func (m *MultiplexedStream) handleStray(p *packet) {
+	atomic.AddUint64(&m.stray, 1)
+	m.log(levelDebug, "stray packet", "channel_id", p.id, "flags", formatFlags(p.flags))
+	if p.flags&RST != 0 {
+		return
+	}
+	if now := m.config.clock.Now(); now.Sub(m.strayAt) >= time.Second {
+		m.strayAt = now
+		m.strayResets = 0
+	}
+	if m.strayResets >= maxStrayResets {
+		return
+	}
+	rst := &packet{id: p.id, flags: RST | ABORT}
+	m.hook(Outbound, rst)
+	select {
+	case m.out <- rst:
+		m.strayResets++
+	default:
+	}
+}
+
+// StrayPackets returns the number of data packets received for channels that
+// weren't open, such as those sent by the peer before it learnt that a channel
+// had been closed.
+func (m *MultiplexedStream) StrayPackets() uint64 {
+	return atomic.LoadUint64(&m.stray)
+}
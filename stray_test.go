@@ -0,0 +1,126 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// IDs of the RSTs written.
+func (g *gatedWriter) resets() []uint32 {
+	var ids []uint32
+	for _, hdr := range g.headers() {
+		if hdr.Type == typeData && hdr.Flags&RST != 0 {
+			ids = append(ids, hdr.ID)
+		}
+	}
+	return ids
+}
+
+func TestStrayPackets(t *testing.T) {
+	sr, cw := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	close(w.release)
+	sm := MultiplexedServer(&rwc{r: sr, w: w})
+	defer sm.Close()
+
+	// Data for a channel that was never opened is answered with an RST, but
+	// an RST isn't.
+	assert.NoError(t, sendHandshake(cw))
+	assert.NoError(t, writeFrame(cw, typeData, 0, 5, []byte("hello")))
+	assert.NoError(t, writeFrame(cw, typeData, FIN, 7, nil))
+	assert.NoError(t, writeFrame(cw, typeData, RST, 9, nil))
+	waitFor(t, func() bool { return sm.StrayPackets() == 3 })
+	waitFor(t, func() bool { return len(w.resets()) == 2 })
+	assert.Equal(t, []uint32{5, 7}, w.resets())
+	for _, hdr := range w.headers() {
+		if hdr.Flags&RST != 0 {
+			assert.Equal(t, uint8(RST|ABORT), hdr.Flags)
+		}
+	}
+	assert.NoError(t, sm.Err())
+}
+
+func TestStrayPacketsRateLimited(t *testing.T) {
+	clock := newFakeClock()
+	sr, cw := io.Pipe()
+	w := &gatedWriter{release: make(chan struct{})}
+	close(w.release)
+	sm := MultiplexedServer(&rwc{r: sr, w: w}, WithClock(clock))
+	defer sm.Close()
+
+	assert.NoError(t, sendHandshake(cw))
+	for i := 0; i < maxStrayResets*2; i++ {
+		assert.NoError(t, writeFrame(cw, typeData, 0, uint32(i*2+1), []byte("x")))
+	}
+	waitFor(t, func() bool { return sm.StrayPackets() == maxStrayResets*2 })
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, maxStrayResets, len(w.resets()))
+
+	// The limit applies per second.
+	clock.Advance(time.Second)
+	assert.NoError(t, writeFrame(cw, typeData, 0, 1, []byte("x")))
+	waitFor(t, func() bool { return len(w.resets()) == maxStrayResets+1 })
+}
+
+func TestStrayPacketsAfterClose(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+
+	// The peer keeps writing until it hears the channel was closed, without
+	// upsetting the stream.
+	done := make(chan error)
+	go func() {
+		for {
+			if _, err := c.Write([]byte("late")); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	_, err = io.ReadFull(s, make([]byte, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, s.CloseWithError(1, "go away"))
+	err = <-done
+	var cerr *ChannelError
+	if assert.True(t, errors.As(err, &cerr), "expected *ChannelError, got %v", err) {
+		assert.Equal(t, "go away", cerr.Message())
+	}
+	assert.NoError(t, sm.Err())
+	assert.NoError(t, cm.Err())
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Frames queued for a tap's writer, beyond which they are dropped.
+	tapBacklog = 1024
+
+	// Size of the direction, time and length preceding each tapped frame.
+	tapRecordHeaderSize = 13
+
+	// Upper bound on the size of a tapped frame accepted by ReadTap.
+	maxTapFrameSize = headerSize + maxPayloadSize + 1024
+)
+
+// A tap copies frames to a writer (see Tap).
+type tap struct {
+	w       io.Writer
+	records chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Tap records a copy of every frame sent or received from now on to w, until
+// the returned function is called or the stream closes. The function stops
+// the tap, and waits for the frames already recorded to be written to w.
+// Calling Tap again replaces the previous tap.
+//
+// Frames are written to w by a goroutine of its own, and are dropped rather
+// than ever delaying the stream, whenever w falls a thousand or so behind
+// (see TapDropped). If w fails, the remaining frames are dropped.
+//
+// Each frame is recorded as a byte for its direction (0 for Inbound and 1 for
+// Outbound), the time it was sent or received as 8 bytes of Unix nanoseconds,
+// the frame's size as 4 bytes, and then the frame exactly as it is on the
+// wire (see Frame), followed by its checksum if WithChecksums is used. All
+// integers are big-endian. The handshake is not recorded. Use
+// ReadTap to parse the recording.
+func (m *MultiplexedStream) Tap(w io.Writer) (stop func()) {
+	t := &tap{
+		w:       w,
+		records: make(chan []byte, tapBacklog),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	m.tapLock.Lock()
+	previous := m.tap
+	m.tap = t
+	atomic.StoreUint32(&m.tapping, 1)
+	m.tapLock.Unlock()
+	if previous != nil {
+		close(previous.stop)
+	}
+	go m.runTap(t)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.tapLock.Lock()
+			if m.tap == t {
+				m.tap = nil
+				atomic.StoreUint32(&m.tapping, 0)
+			}
+			m.tapLock.Unlock()
+			close(t.stop)
+		})
+		<-t.done
+	}
+}
+
+// TapDropped returns the number of frames not recorded by Tap because its
+// writer had fallen behind or failed.
+func (m *MultiplexedStream) TapDropped() uint64 {
+	return atomic.LoadUint64(&m.tapDropped)
+}
+
+// Write the frames recorded by t until it is stopped or the stream dies, and
+// then those already recorded.
+func (m *MultiplexedStream) runTap(t *tap) {
+	defer close(t.done)
+	var err error
+	write := func(record []byte) {
+		if err == nil {
+			_, err = t.w.Write(record)
+		}
+		if err != nil {
+			atomic.AddUint64(&m.tapDropped, 1)
+		}
+	}
+loop:
+	for {
+		select {
+		case record := <-t.records:
+			write(record)
+		case <-t.stop:
+			break loop
+		case <-m.tomb.Dying():
+			break loop
+		}
+	}
+	for {
+		select {
+		case record := <-t.records:
+			write(record)
+		default:
+			return
+		}
+	}
+}
+
+// Record a frame, if the stream is tapped, without blocking.
+func (m *MultiplexedStream) tapFrame(dir Direction, hdr, payload, sum []byte) {
+	if atomic.LoadUint32(&m.tapping) == 0 {
+		return
+	}
+	size := len(hdr) + len(payload) + len(sum)
+	record := make([]byte, tapRecordHeaderSize, tapRecordHeaderSize+size)
+	record[0] = byte(dir)
+	binary.BigEndian.PutUint64(record[1:], uint64(m.config.clock.Now().UnixNano()))
+	binary.BigEndian.PutUint32(record[9:], uint32(size))
+	record = append(append(append(record, hdr...), payload...), sum...)
+
+	m.tapLock.Lock()
+	defer m.tapLock.Unlock()
+	if m.tap == nil {
+		return
+	}
+	select {
+	case m.tap.records <- record:
+	default:
+		atomic.AddUint64(&m.tapDropped, 1)
+	}
+}
+
+// TapRecord is a frame recorded by Tap.
+type TapRecord struct {
+	Direction Direction
+	Time      time.Time
+	Frame     Frame  // The payload is as on the wire, so possibly compressed or transformed.
+	Raw       []byte // The whole frame as on the wire, including the header and checksum.
+}
+
+// ReadTap parses the frames recorded by Tap from r, calling fn with each in
+// turn. It stops at the first error returned by fn, and returns it.
+//
+// The end of r is expected between frames, and otherwise io.ErrUnexpectedEOF
+// is returned.
+func ReadTap(r io.Reader, fn func(TapRecord) error) error {
+	var prefix [tapRecordHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := binary.BigEndian.Uint32(prefix[9:])
+		if size < headerSize || size > maxTapFrameSize {
+			return fmt.Errorf("%w: tapped frame of %d bytes", ErrProtocol, size)
+		}
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		frame, err := decodeFrame(raw)
+		if err != nil {
+			return err
+		}
+		err = fn(TapRecord{
+			Direction: Direction(prefix[0]),
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(prefix[1:]))),
+			Frame:     frame,
+			Raw:       raw,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func TestTap(t *testing.T) {
+	clock := newFakeClock()
+	sm, cm := newServerAndClient(WithClock(clock), WithChecksums())
+	defer cm.Close()
+	capture := &bytes.Buffer{}
+	stop := sm.Tap(capture)
+
+	c, err := cm.Dial()
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	_, err = c.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(s, make([]byte, 5))
+	assert.NoError(t, err)
+	_, err = s.Write([]byte("world!"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 6))
+	assert.NoError(t, err)
+	assert.NoError(t, sm.Close())
+	stop()
+
+	type frame struct {
+		dir     Direction
+		typ     FrameType
+		flags   uint16
+		payload string
+	}
+	var got []frame
+	err = ReadTap(bytes.NewReader(capture.Bytes()), func(r TapRecord) error {
+		assert.Equal(t, clock.Now(), r.Time)
+		f := r.Frame
+		assert.Equal(t, headerSize+len(f.Payload)+checksumSize, len(r.Raw))
+		if f.Type == FrameData {
+			assert.Equal(t, c.id, f.ChannelID)
+			got = append(got, frame{r.Direction, f.Type, f.Flags, string(f.Payload)})
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []frame{
+		{Inbound, FrameData, SYN, ""},
+		{Outbound, FrameData, ACK, ""},
+		{Inbound, FrameData, 0, "hello"},
+		{Outbound, FrameData, 0, "world!"},
+	}, got[:4])
+	assert.Equal(t, uint64(0), sm.TapDropped())
+}
+
+type blockingWriter struct{ unblock chan struct{} }
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.unblock
+	return len(p), nil
+}
+
+func TestTapDropsFrames(t *testing.T) {
+	sm, cm := newServerAndClient()
+	defer sm.Close()
+	defer cm.Close()
+	w := &blockingWriter{unblock: make(chan struct{})}
+	stop := sm.Tap(w)
+
+	for i := 0; i < tapBacklog; i++ {
+		_, err := cm.Ping(context.Background())
+		assert.NoError(t, err)
+	}
+	assert.True(t, sm.TapDropped() > 0)
+	close(w.unblock)
+	stop()
+}
+
+func TestReadTapTruncated(t *testing.T) {
+	capture := &bytes.Buffer{}
+	sm, cm := newServerAndClient()
+	defer cm.Close()
+	stop := sm.Tap(capture)
+	_, err := cm.Ping(context.Background())
+	assert.NoError(t, err)
+	sm.Close()
+	stop()
+
+	b := capture.Bytes()
+	assert.NoError(t, ReadTap(bytes.NewReader(b), func(TapRecord) error { return nil }))
+	err = ReadTap(bytes.NewReader(b[:len(b)-1]), func(TapRecord) error { return nil })
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+// A Transform transforms the payloads of data packets on their way to and
+// from the wire, such as to encrypt them when the transport can't be secured
+// with TLS (see WithTransform).
+//
+// Payloads are sealed in the order they are written to the transport and
+// opened in the order they are read from it, each by a single goroutine, so a
+// Transform may keep state between payloads, such as a nonce counter. Only
+// the headers of packets, and packets other than data, are left as is.
+type Transform interface {
+	// Seal appends the transformed form of plaintext to dst.
+	Seal(dst, plaintext []byte) ([]byte, error)
+	// Open appends the plaintext that ciphertext was sealed from to dst,
+	// failing if ciphertext wasn't sealed by the peer's Transform.
+	Open(dst, ciphertext []byte) ([]byte, error)
+	// Overhead returns the most that Seal grows a payload by, in bytes.
+	Overhead() int
+}
+
+// Open a payload sealed by the peer into a pooled buffer, which is returned
+// along with the plaintext.
+func openPayload(t Transform, ciphertext []byte) (*[]byte, []byte, error) {
+	buf := getBuffer(len(ciphertext))
+	plaintext, err := t.Open((*buf)[:0], ciphertext)
+	if err != nil {
+		putBuffer(buf)
+		return nil, nil, err
+	}
+	buf, plaintext = pooled(buf, plaintext)
+	return buf, plaintext, nil
+}
+
+// Make sure b, appended to the empty pooled buffer buf by a function that
+// may have reallocated it, is at the start of a pooled buffer.
+func pooled(buf *[]byte, b []byte) (*[]byte, []byte) {
+	if len(b) == 0 || &b[0] == &(*buf)[:1][0] {
+		return buf, b
+	}
+	putBuffer(buf)
+	buf = getBuffer(len(b))
+	return buf, (*buf)[:copy(*buf, b)]
+}
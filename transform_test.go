@@ -0,0 +1,150 @@
+// Copyright (c) 2014, Alec Thomas
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  - Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//  - Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//  - Neither the name of SwapOff.org nor the names of its contributors may
+//    be used to endorse or promote products derived from this software without
+//    specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package multiplex
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+// Encrypts payloads with AES-GCM, using a counter as the nonce. Each end has
+// one transform, which seals with its own counter and opens with the peer's.
+type gcmTransform struct {
+	aead        cipher.AEAD
+	sent, recvd uint64
+}
+
+func newGCMTransform(key []byte) *gcmTransform {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &gcmTransform{aead: aead}
+}
+
+func (g *gcmTransform) nonce(counter uint64) []byte {
+	nonce := make([]byte, g.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	return nonce
+}
+
+func (g *gcmTransform) Seal(dst, plaintext []byte) ([]byte, error) {
+	g.sent++
+	return g.aead.Seal(dst, g.nonce(g.sent), plaintext, nil), nil
+}
+
+func (g *gcmTransform) Open(dst, ciphertext []byte) ([]byte, error) {
+	g.recvd++
+	return g.aead.Open(dst, g.nonce(g.recvd), ciphertext, nil)
+}
+
+func (g *gcmTransform) Overhead() int { return g.aead.Overhead() }
+
+// Records everything written, to check that it was transformed.
+type recordingWriter struct {
+	io.WriteCloser
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	r.buf.Write(b)
+	r.lock.Unlock()
+	return r.WriteCloser.Write(b)
+}
+
+func (r *recordingWriter) Contains(b []byte) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return bytes.Contains(r.buf.Bytes(), b)
+}
+
+func TestTransform(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	recorder := &recordingWriter{WriteCloser: cw}
+	sm := MultiplexedServer(&rwc{r: sr, w: sw}, WithTransform(newGCMTransform(key)), WithMaxFrameSize(FragmentSize*4))
+	cm := MultiplexedClient(&rwc{r: cr, w: recorder}, WithTransform(newGCMTransform(key)), WithMaxFrameSize(FragmentSize*4))
+	defer sm.Close()
+	defer cm.Close()
+
+	c, err := cm.Dial(WithMetadata([]byte("secret metadata")))
+	assert.NoError(t, err)
+	s, err := sm.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret metadata", string(s.Metadata()))
+
+	// Full frames grow when sealed, but are still accepted.
+	data := make([]byte, FragmentSize*20)
+	rand.Read(data)
+	copy(data, "secret data")
+	go c.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(s, received)
+	assert.NoError(t, err)
+	assert.Equal(t, data, received)
+
+	// Data is sent in both directions.
+	go s.Write([]byte("hello"))
+	_, err = io.ReadFull(c, received[:5])
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(received[:5]))
+
+	assert.False(t, recorder.Contains([]byte("secret")))
+}
+
+func TestTransformMismatch(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	server := MultiplexedServer(&rwc{r: sr, w: sw}, WithTransform(newGCMTransform(bytes.Repeat([]byte{1}, 16))))
+	client := MultiplexedClient(&rwc{r: cr, w: cw}, WithTransform(newGCMTransform(bytes.Repeat([]byte{2}, 16))))
+	defer server.Close()
+	defer client.Close()
+
+	// Packets sealed with the wrong key fail the stream.
+	c, err := client.DialAsync(context.Background())
+	assert.NoError(t, err)
+	go c.Write([]byte("hello"))
+	waitFor(t, func() bool { return server.Err() != nil })
+	assert.True(t, errors.Is(server.Err(), ErrProtocol), "%s", server.Err())
+}